@@ -0,0 +1,241 @@
+package controllers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/martin226/slideitin/backend/api/middleware"
+	"github.com/martin226/slideitin/backend/api/models"
+	"github.com/martin226/slideitin/backend/api/services/batch"
+	"github.com/martin226/slideitin/backend/api/services/ingest"
+	"github.com/martin226/slideitin/backend/api/services/usage"
+)
+
+// BatchController handles the batch generation API endpoints
+type BatchController struct {
+	batchService  *batch.Service
+	ingestService *ingest.Service
+	usageService  *usage.Service
+}
+
+// NewBatchController creates a new batch controller
+func NewBatchController(batchService *batch.Service, ingestService *ingest.Service, usageService *usage.Service) *BatchController {
+	return &BatchController{
+		batchService:  batchService,
+		ingestService: ingestService,
+		usageService:  usageService,
+	}
+}
+
+// CreateBatch handles a batch generation request, creating one job per document group
+func (c *BatchController) CreateBatch(ctx *gin.Context) {
+	// Parse form data first
+	if err := ctx.Request.ParseMultipartForm(32 << 20); err != nil { // 32 MB in memory, rest on disk
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "Failed to parse form data",
+		})
+		return
+	}
+
+	// Parse JSON data from form
+	var req models.BatchRequest
+	jsonData := ctx.PostForm("data")
+	if jsonData == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "Missing data field in form",
+		})
+		return
+	}
+
+	if err := json.Unmarshal([]byte(jsonData), &req); err != nil {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("Invalid request format: %v", err),
+		})
+		return
+	}
+
+	if len(req.Groups) == 0 {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "Batch must contain at least one group",
+		})
+		return
+	}
+	if len(req.Groups) > c.batchService.MaxGroups() {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": fmt.Sprintf("Too many groups: %d (maximum is %d)", len(req.Groups), c.batchService.MaxGroups()),
+		})
+		return
+	}
+
+	// Read every uploaded file once, keyed by filename so groups can share files
+	uploaded := make(map[string]models.File)
+	if form, err := ctx.MultipartForm(); err == nil {
+		for _, file := range form.File["files"] {
+			if _, exists := uploaded[file.Filename]; exists {
+				ctx.JSON(http.StatusBadRequest, gin.H{
+					"error": fmt.Sprintf("Duplicate file name: %s", file.Filename),
+				})
+				return
+			}
+
+			data, status, err := readUploadedFile(file)
+			if err != nil {
+				ctx.JSON(status, gin.H{
+					"error": err.Error(),
+				})
+				return
+			}
+			uploaded[file.Filename] = data
+		}
+	}
+
+	// Validate each group and collect its files
+	groups := make([]batch.Group, 0, len(req.Groups))
+	for i, group := range req.Groups {
+		slideReq := models.SlideRequest{
+			Theme:    group.Theme,
+			Settings: group.Settings,
+			URLs:     group.URLs,
+		}
+		if err := validateSlideRequest(slideReq); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("Group %d: %v", i+1, err),
+			})
+			return
+		}
+
+		files := make([]models.File, 0, len(group.Files)+len(group.URLs))
+		for _, filename := range group.Files {
+			file, ok := uploaded[filename]
+			if !ok {
+				ctx.JSON(http.StatusBadRequest, gin.H{
+					"error": fmt.Sprintf("Group %d: file %s was not uploaded", i+1, filename),
+				})
+				return
+			}
+			files = append(files, file)
+		}
+
+		if len(group.URLs) > 0 {
+			urlFiles, err := c.ingestService.FetchFiles(ctx.Request.Context(), group.URLs)
+			if err != nil {
+				ctx.JSON(ingestErrorStatus(err), gin.H{
+					"error": fmt.Sprintf("Group %d: %v", i+1, err),
+				})
+				return
+			}
+			files = append(files, urlFiles...)
+		}
+
+		if len(files) == 0 {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("Group %d: no files or URLs provided", i+1),
+			})
+			return
+		}
+
+		groups = append(groups, batch.Group{
+			Name:     group.Name,
+			Theme:    group.Theme,
+			Settings: group.Settings,
+			Files:    files,
+			NoCache:  group.NoCache,
+		})
+	}
+
+	// Log the request
+	slog.InfoContext(ctx.Request.Context(), "Received batch generation request", "groups", len(groups), "files", len(uploaded))
+
+	// Count every job against the caller's quotas up front so a batch is accepted or rejected as a whole
+	reservation, ok := reserveQuota(ctx, c.usageService, len(groups))
+	if !ok {
+		return
+	}
+
+	// Generate unique IDs for the batch and each of its jobs
+	batchID := uuid.New().String()
+	jobIDs := make([]string, 0, len(groups))
+	for range groups {
+		jobIDs = append(jobIDs, uuid.New().String())
+	}
+
+	firestoreBatch, err := c.batchService.CreateBatch(ctx.Request.Context(), batchID, middleware.OwnerID(ctx), reservation, jobIDs, groups)
+	if err != nil {
+		releaseQuota(ctx, c.usageService, reservation, len(groups))
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	// Return the initial aggregated status immediately
+	ctx.JSON(http.StatusAccepted, c.batchService.GetStatus(ctx, firestoreBatch))
+}
+
+// GetBatchStatus handles retrieving the aggregated status of a batch
+func (c *BatchController) GetBatchStatus(ctx *gin.Context) {
+	id := ctx.Param("id")
+	if id == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "Missing batch ID",
+		})
+		return
+	}
+
+	firestoreBatch, err := c.batchService.GetBatch(ctx, id, middleware.OwnerID(ctx))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("Batch not found: %v", err),
+		})
+		return
+	}
+
+	response := c.batchService.GetStatus(ctx, firestoreBatch)
+	if response.Counts["completed"] > 0 {
+		response.DownloadURL = "/v1/batches/" + id + "/download"
+	}
+	ctx.JSON(http.StatusOK, response)
+}
+
+// DownloadBatch handles downloading a zip archive of all finished PDFs in a batch
+func (c *BatchController) DownloadBatch(ctx *gin.Context) {
+	id := ctx.Param("id")
+	if id == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "Missing batch ID",
+		})
+		return
+	}
+
+	firestoreBatch, err := c.batchService.GetBatch(ctx, id, middleware.OwnerID(ctx))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("Batch not found: %v", err),
+		})
+		return
+	}
+
+	// Build the archive in memory so we can still return an error before any bytes are sent
+	var buf bytes.Buffer
+	count, err := c.batchService.WriteZip(ctx, firestoreBatch, &buf)
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	if count == 0 {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"error": "No finished presentations in this batch yet",
+		})
+		return
+	}
+
+	ctx.Header("Content-Disposition", fmt.Sprintf("attachment; filename=batch-%s.zip", id))
+	ctx.Data(http.StatusOK, "application/zip", buf.Bytes())
+}
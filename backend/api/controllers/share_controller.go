@@ -0,0 +1,119 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/martin226/slideitin/backend/api/middleware"
+	"github.com/martin226/slideitin/backend/api/models"
+	"github.com/martin226/slideitin/backend/api/services/queue"
+	"github.com/martin226/slideitin/backend/api/services/share"
+)
+
+// ShareController handles the share link API endpoints
+type ShareController struct {
+	queueService *queue.Service
+	shareService *share.Service
+}
+
+// NewShareController creates a new share controller
+func NewShareController(queueService *queue.Service, shareService *share.Service) *ShareController {
+	return &ShareController{
+		queueService: queueService,
+		shareService: shareService,
+	}
+}
+
+// CreateShare handles creating a signed, expiring link to a result
+func (c *ShareController) CreateShare(ctx *gin.Context) {
+	id := ctx.Param("id")
+	if id == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "Missing result ID",
+		})
+		return
+	}
+
+	// The body is optional, an empty request creates a link with the default lifetime
+	var req models.ShareRequest
+	if ctx.Request.ContentLength > 0 {
+		if err := ctx.ShouldBindJSON(&req); err != nil {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("Invalid request format: %v", err),
+			})
+			return
+		}
+	}
+
+	var ttl time.Duration
+	if req.TTL != "" {
+		parsed, err := time.ParseDuration(req.TTL)
+		if err != nil || parsed <= 0 || parsed > c.shareService.MaxTTL() {
+			ctx.JSON(http.StatusBadRequest, gin.H{
+				"error": fmt.Sprintf("Invalid ttl: must be a duration up to %s", c.shareService.MaxTTL()),
+			})
+			return
+		}
+		ttl = parsed
+	}
+
+	// Only the result's owner may share it
+	ownerID := middleware.OwnerID(ctx)
+	result, err := c.queueService.GetResult(ctx, id, ownerID)
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("Result not found: %v", err),
+		})
+		return
+	}
+
+	// Links never outlive the result, which is still deleted when its retention ends
+	link, err := c.shareService.CreateShare(ctx, id, ownerID, ttl, result.ExpiresAt, req.Password)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, share.ErrDisabled) {
+			status = http.StatusServiceUnavailable
+		}
+		ctx.JSON(status, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	url := c.shareService.URL(link)
+	ctx.JSON(http.StatusCreated, models.ShareResponse{
+		ID:          link.ID,
+		URL:         url,
+		DownloadURL: url + "&download=true",
+		Protected:   link.HasPassword(),
+		ExpiresAt:   link.ExpiresAt,
+	})
+}
+
+// RevokeShare handles revoking a share link
+func (c *ShareController) RevokeShare(ctx *gin.Context) {
+	id := ctx.Param("id")
+	shareID := ctx.Param("shareId")
+	if id == "" || shareID == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "Missing result or share ID",
+		})
+		return
+	}
+
+	if err := c.shareService.Revoke(ctx, id, shareID, middleware.OwnerID(ctx)); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, share.ErrNotFound) {
+			status = http.StatusNotFound
+		}
+		ctx.JSON(status, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+
+	ctx.Status(http.StatusNoContent)
+}
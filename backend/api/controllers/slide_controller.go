@@ -1,35 +1,72 @@
 package controllers
 
 import (
+	"bytes"
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"html/template"
 	"io"
-	"log"
+	"log/slog"
+	"mime/multipart"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
-	"path/filepath"
 
+	"github.com/gin-contrib/sse"
 	"github.com/gin-gonic/gin"
 	"github.com/google/uuid"
+	"github.com/martin226/slideitin/backend/api/middleware"
 	"github.com/martin226/slideitin/backend/api/models"
+	"github.com/martin226/slideitin/backend/api/services/ingest"
 	"github.com/martin226/slideitin/backend/api/services/queue"
+	"github.com/martin226/slideitin/backend/api/services/share"
+	"github.com/martin226/slideitin/backend/api/services/telemetry"
+	"github.com/martin226/slideitin/backend/api/services/usage"
+	"github.com/martin226/slideitin/backend/api/services/webhook"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// shutdownRetryAfter is how long clients are asked to wait before retrying a job refused by a shutdown
+const shutdownRetryAfter = 30 * time.Second
+
 // SlideController handles the slide generation API endpoints
 type SlideController struct {
-	queueService  *queue.Service
+	queueService   *queue.Service
+	ingestService  *ingest.Service
+	usageService   *usage.Service
+	shareService   *share.Service
+	webhookService *webhook.Service
+
+	// shutdown is closed when the server shuts down so SSE streams end and clients reconnect
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
 }
 
 // NewSlideController creates a new slide controller
-func NewSlideController(queueService *queue.Service) *SlideController {
+func NewSlideController(queueService *queue.Service, ingestService *ingest.Service, usageService *usage.Service, shareService *share.Service, webhookService *webhook.Service) *SlideController {
 	return &SlideController{
-		queueService:  queueService,
+		queueService:   queueService,
+		ingestService:  ingestService,
+		usageService:   usageService,
+		shareService:   shareService,
+		webhookService: webhookService,
+		shutdown:       make(chan struct{}),
 	}
 }
 
+// CloseStreams ends every SSE stream with a reconnect event so clients resume against another
+// instance instead of waiting on a connection that is about to drop
+func (c *SlideController) CloseStreams() {
+	c.shutdownOnce.Do(func() { close(c.shutdown) })
+}
+
 // GenerateSlides handles the slide generation request
 func (c *SlideController) GenerateSlides(ctx *gin.Context) {
 	// Parse form data first
@@ -57,52 +94,19 @@ func (c *SlideController) GenerateSlides(ctx *gin.Context) {
 		return
 	}
 
-	// Validate theme
-	isValidTheme := false
-	for _, theme := range models.ValidThemes {
-		if req.Theme == theme {
-			isValidTheme = true
-			break
-		}
-	}
-	if !isValidTheme {
+	// Validate theme and settings
+	if err := validateSlideRequest(req); err != nil {
 		ctx.JSON(http.StatusBadRequest, gin.H{
-			"error": fmt.Sprintf("Invalid theme: %s. Supported themes are: %s", req.Theme, strings.Join(models.ValidThemes, ", ")),
+			"error": err.Error(),
 		})
 		return
 	}
 
-	// Validate slideDetail setting
-	isValidSlideDetail := false
-	if req.Settings.SlideDetail != "" {
-		for _, detail := range models.ValidSlideDetails {
-			if req.Settings.SlideDetail == detail {
-				isValidSlideDetail = true
-				break
-			}
-		}
-		if !isValidSlideDetail {
-			ctx.JSON(http.StatusBadRequest, gin.H{
-				"error": fmt.Sprintf("Invalid slideDetail: %s. Supported values are: %s", 
-					req.Settings.SlideDetail, strings.Join(models.ValidSlideDetails, ", ")),
-			})
-			return
-		}
-	}
-
-	// Validate audience setting
-	isValidAudience := false
-	if req.Settings.Audience != "" {
-		for _, audience := range models.ValidAudiences {
-			if req.Settings.Audience == audience {
-				isValidAudience = true
-				break
-			}
-		}
-		if !isValidAudience {
+	// Validate the completion callback, if any
+	if req.CallbackURL != "" {
+		if err := c.webhookService.ValidateCallback(req.CallbackURL, req.CallbackSecret); err != nil {
 			ctx.JSON(http.StatusBadRequest, gin.H{
-				"error": fmt.Sprintf("Invalid audience: %s. Supported values are: %s", 
-					req.Settings.Audience, strings.Join(models.ValidAudiences, ", ")),
+				"error": err.Error(),
 			})
 			return
 		}
@@ -118,93 +122,76 @@ func (c *SlideController) GenerateSlides(ctx *gin.Context) {
 	}
 
 	files := form.File["files"]
-	if len(files) == 0 {
+	if len(files) == 0 && len(req.URLs) == 0 {
 		ctx.JSON(http.StatusBadRequest, gin.H{
-			"error": "No files uploaded",
+			"error": "No files or URLs provided",
 		})
 		return
 	}
 
 	// Read file data into memory to prevent it from being released
-	fileData := make([]models.File, 0, len(files))
-	
+	fileData := make([]models.File, 0, len(files)+len(req.URLs))
+
 	for _, file := range files {
-		// Open the file
-		src, err := file.Open()
+		data, status, err := readUploadedFile(file)
 		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("Failed to open file %s: %v", file.Filename, err),
+			ctx.JSON(status, gin.H{
+				"error": err.Error(),
 			})
 			return
 		}
-		
-		// Read the file data
-		data, err := io.ReadAll(src)
-		src.Close() // Close the file after reading
-		
-		if err != nil {
-			ctx.JSON(http.StatusInternalServerError, gin.H{
-				"error": fmt.Sprintf("Failed to read file %s: %v", file.Filename, err),
-			})
-			return
-		}
-		
-		// Detect MIME type from file content instead of using header
-		// DetectContentType only needs the first 512 bytes
-		mimeType := http.DetectContentType(data)
-		
-		// Remove charset information if present
-		if semicolonIndex := strings.Index(mimeType, ";"); semicolonIndex != -1 {
-			mimeType = strings.TrimSpace(mimeType[:semicolonIndex])
-		}
-		
-		// Validate file type - only allow PDF, Markdown and TXT
-		isAllowed := false
-
-		// Check by file extension first
-		fileExt := strings.ToLower(filepath.Ext(file.Filename))
-		if fileExt == ".pdf" || fileExt == ".md" || fileExt == ".txt" {
-			// Now check MIME type
-			if mimeType == "application/pdf" {
-				// PDF is valid
-				isAllowed = true
-			} else if mimeType == "text/plain" {
-				// Plain text (could be TXT or MD)
-				isAllowed = true
-			} else if strings.Contains(mimeType, "markdown") || strings.Contains(mimeType, "text/") {
-				// Some systems detect markdown as text/markdown, text/x-markdown, or just text/plain
-				// For text files, we'll trust the extension more than the mime type
-				if fileExt == ".md" || fileExt == ".txt" {
-					isAllowed = true
-				}
-			}
-		}
+		fileData = append(fileData, data)
+	}
 
-		if !isAllowed {
-			ctx.JSON(http.StatusBadRequest, gin.H{
-				"error": fmt.Sprintf("Unsupported file type: %s. Only PDF, Markdown, and TXT files are allowed", file.Filename),
+	// Fetch any URLs and convert them to markdown files
+	if len(req.URLs) > 0 {
+		urlFiles, err := c.ingestService.FetchFiles(ctx.Request.Context(), req.URLs)
+		if err != nil {
+			ctx.JSON(ingestErrorStatus(err), gin.H{
+				"error": err.Error(),
 			})
 			return
 		}
-		
-		// Store the file data
-		fileData = append(fileData, models.File{
-			Filename: file.Filename,
-			Data:     data,
-			Type:     mimeType,
-		})
+		fileData = append(fileData, urlFiles...)
 	}
 
 	// Log the request
-	log.Printf("Received slide generation request: Theme: %s, Files count: %d, Settings: %+v", 
-		req.Theme, len(fileData), req.Settings)
+	slog.InfoContext(ctx.Request.Context(), "Received slide generation request",
+		"theme", req.Theme, "files", len(fileData), "urls", len(req.URLs), "settings", req.Settings)
+
+	// Count the job against the caller's quotas before it costs anything
+	reservation, ok := reserveQuota(ctx, c.usageService, 1)
+	if !ok {
+		return
+	}
 
 	// Generate a unique job ID
 	jobID := uuid.New().String()
 
-	// Add job to queue instead of processing immediately
-	job, err := c.queueService.AddJob(ctx, jobID, req.Theme, fileData, req.Settings)
+	// Report the retention applied to the result so clients know how long it will be available
+	retention := c.queueService.RetentionPolicy(middleware.OwnerID(ctx))
+
+	// Tag the request's span so the job's trace can be found by its ID
+	trace.SpanFromContext(ctx.Request.Context()).SetAttributes(telemetry.JobIDKey.String(jobID))
+
+	// Notify the callback once the job finishes, including when it failed to start. It's stored
+	// with the job so it can't miss the job finishing.
+	var delivery *queue.WebhookDelivery
+	if req.CallbackURL != "" {
+		delivery = webhook.NewDelivery(req.CallbackURL, req.CallbackSecret)
+	}
+
+	// Add job to queue instead of processing immediately. The job keeps the request's trace but
+	// isn't canceled if the client disconnects.
+	job, err := c.queueService.AddJob(context.WithoutCancel(ctx.Request.Context()), jobID, middleware.OwnerID(ctx), reservation, req.Theme, fileData, req.Settings, req.NoCache, delivery)
+
 	if err != nil {
+		// The tokens the job used, if any, are charged by the queue, but the job itself isn't counted
+		releaseQuota(ctx, c.usageService, reservation, 1)
+		// Ask the client to come back once another instance is up
+		if errors.Is(err, queue.ErrShuttingDown) {
+			middleware.RetryAfter(ctx, shutdownRetryAfter)
+		}
 		ctx.JSON(http.StatusServiceUnavailable, gin.H{
 			"error": err.Error(),
 		})
@@ -218,9 +205,140 @@ func (c *SlideController) GenerateSlides(ctx *gin.Context) {
 		Message:   job.Message,
 		CreatedAt: job.CreatedAt,
 		UpdatedAt: job.UpdatedAt,
+		Retention: &retention,
+		Cache:     job.Cache,
 	})
 }
 
+// ingestErrorStatus returns the response status for a failure to fetch URLs: a client error when
+// the URL or document isn't acceptable, otherwise Bad Gateway
+func ingestErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, ingest.ErrDisabled), errors.Is(err, ingest.ErrNotAllowed),
+		errors.Is(err, ingest.ErrInvalidURL), errors.Is(err, ingest.ErrUnsupportedScheme),
+		errors.Is(err, ingest.ErrTooManyURLs):
+		return http.StatusBadRequest
+	case errors.Is(err, ingest.ErrTooLarge):
+		return http.StatusRequestEntityTooLarge
+	case errors.Is(err, ingest.ErrUnsupportedContent):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, ingest.ErrNoContent):
+		return http.StatusUnprocessableEntity
+	}
+	return http.StatusBadGateway
+}
+
+// validateSlideRequest checks the theme and settings of a slide request against the supported values
+func validateSlideRequest(req models.SlideRequest) error {
+	// Validate theme
+	isValidTheme := false
+	for _, theme := range models.ValidThemes {
+		if req.Theme == theme {
+			isValidTheme = true
+			break
+		}
+	}
+	if !isValidTheme {
+		return fmt.Errorf("Invalid theme: %s. Supported themes are: %s", req.Theme, strings.Join(models.ValidThemes, ", "))
+	}
+
+	// Validate slideDetail setting
+	isValidSlideDetail := false
+	if req.Settings.SlideDetail != "" {
+		for _, detail := range models.ValidSlideDetails {
+			if req.Settings.SlideDetail == detail {
+				isValidSlideDetail = true
+				break
+			}
+		}
+		if !isValidSlideDetail {
+			return fmt.Errorf("Invalid slideDetail: %s. Supported values are: %s",
+				req.Settings.SlideDetail, strings.Join(models.ValidSlideDetails, ", "))
+		}
+	}
+
+	// Validate audience setting
+	isValidAudience := false
+	if req.Settings.Audience != "" {
+		for _, audience := range models.ValidAudiences {
+			if req.Settings.Audience == audience {
+				isValidAudience = true
+				break
+			}
+		}
+		if !isValidAudience {
+			return fmt.Errorf("Invalid audience: %s. Supported values are: %s",
+				req.Settings.Audience, strings.Join(models.ValidAudiences, ", "))
+		}
+	}
+
+	// Validate math setting
+	if req.Settings.Math && req.Settings.Audience != "academic" {
+		return errors.New("The math setting is only supported for the academic audience")
+	}
+
+	return nil
+}
+
+// readUploadedFile reads an uploaded file into memory and validates its type.
+// On failure it also returns the HTTP status the error should be reported with.
+func readUploadedFile(file *multipart.FileHeader) (models.File, int, error) {
+	// Open the file
+	src, err := file.Open()
+	if err != nil {
+		return models.File{}, http.StatusInternalServerError, fmt.Errorf("Failed to open file %s: %v", file.Filename, err)
+	}
+
+	// Read the file data
+	data, err := io.ReadAll(src)
+	src.Close() // Close the file after reading
+
+	if err != nil {
+		return models.File{}, http.StatusInternalServerError, fmt.Errorf("Failed to read file %s: %v", file.Filename, err)
+	}
+
+	// Detect MIME type from file content instead of using header
+	// DetectContentType only needs the first 512 bytes
+	mimeType := http.DetectContentType(data)
+
+	// Remove charset information if present
+	if semicolonIndex := strings.Index(mimeType, ";"); semicolonIndex != -1 {
+		mimeType = strings.TrimSpace(mimeType[:semicolonIndex])
+	}
+
+	// Validate file type - only allow PDF, Markdown and TXT
+	isAllowed := false
+
+	// Check by file extension first
+	fileExt := strings.ToLower(filepath.Ext(file.Filename))
+	if fileExt == ".pdf" || fileExt == ".md" || fileExt == ".txt" {
+		// Now check MIME type
+		if mimeType == "application/pdf" {
+			// PDF is valid
+			isAllowed = true
+		} else if mimeType == "text/plain" {
+			// Plain text (could be TXT or MD)
+			isAllowed = true
+		} else if strings.Contains(mimeType, "markdown") || strings.Contains(mimeType, "text/") {
+			// Some systems detect markdown as text/markdown, text/x-markdown, or just text/plain
+			// For text files, we'll trust the extension more than the mime type
+			if fileExt == ".md" || fileExt == ".txt" {
+				isAllowed = true
+			}
+		}
+	}
+
+	if !isAllowed {
+		return models.File{}, http.StatusBadRequest, fmt.Errorf("Unsupported file type: %s. Only PDF, Markdown, and TXT files are allowed", file.Filename)
+	}
+
+	return models.File{
+		Filename: file.Filename,
+		Data:     data,
+		Type:     mimeType,
+	}, http.StatusOK, nil
+}
+
 // StreamSlideStatus handles both regular status checks and SSE streaming of job status updates
 func (c *SlideController) StreamSlideStatus(ctx *gin.Context) {
 	id := ctx.Param("id")
@@ -232,7 +350,8 @@ func (c *SlideController) StreamSlideStatus(ctx *gin.Context) {
 	}
 
 	// Get job status from queue
-	job := c.queueService.GetJob(id)
+	ownerID := middleware.OwnerID(ctx)
+	job := c.queueService.GetJob(id, ownerID)
 	if job == nil {
 		ctx.JSON(http.StatusNotFound, gin.H{
 			"error": "Job not found",
@@ -246,13 +365,27 @@ func (c *SlideController) StreamSlideStatus(ctx *gin.Context) {
 
 	// If client doesn't want SSE, return a regular JSON response
 	if !wantsSSE {
-		ctx.JSON(http.StatusOK, gin.H{
+		response := gin.H{
 			"id":        job.ID,
 			"status":    job.Status,
 			"message":   job.Message,
 			"resultUrl": job.ResultURL,
 			"updatedAt": job.UpdatedAt,
-		})
+			"seq":       job.EventSeq,
+		}
+		if job.ResultExpiresAt > 0 {
+			response["resultExpiresAt"] = job.ResultExpiresAt
+		}
+		if job.Webhook != nil {
+			response["webhook"] = job.Webhook
+		}
+		if job.Metrics != nil {
+			response["metrics"] = job.Metrics
+		}
+		if job.Progress != nil {
+			response["progress"] = job.Progress
+		}
+		ctx.JSON(http.StatusOK, response)
 		return
 	}
 
@@ -265,6 +398,9 @@ func (c *SlideController) StreamSlideStatus(ctx *gin.Context) {
 	ctx.Writer.Header().Set("X-Accel-Buffering", "no") // Disable buffering in Nginx if used
 	ctx.Writer.Flush()
 
+	// Reconnecting EventSource clients send the ID of the last event they received
+	lastEventID := parseLastEventID(ctx)
+
 	// Create channel for job updates and set up a cancellation context
 	updates := make(chan queue.JobUpdate, 10)
 	streamCtx, cancelStream := context.WithCancel(ctx.Request.Context())
@@ -279,10 +415,10 @@ func (c *SlideController) StreamSlideStatus(ctx *gin.Context) {
 			// Signal that the watch goroutine is done
 			close(watchDone)
 		}()
-		
-		err := c.queueService.WatchJob(streamCtx, id, updates)
+
+		err := c.queueService.WatchJob(streamCtx, id, ownerID, lastEventID, updates)
 		if err != nil && err != context.Canceled {
-			log.Printf("Error watching job %s: %v", id, err)
+			slog.ErrorContext(streamCtx, "Error watching job", "job_id", id, "error", err)
 		}
 	}()
 
@@ -302,9 +438,13 @@ func (c *SlideController) StreamSlideStatus(ctx *gin.Context) {
 				return false // Channel closed
 			}
 
-			// Send SSE event with job update
-			ctx.SSEvent("update", update)
-			
+			// Send SSE event with job update, using its sequence number as the event ID
+			ctx.Render(-1, sse.Event{
+				Id:    strconv.FormatInt(update.Seq, 10),
+				Event: "update",
+				Data:  update,
+			})
+
 			// If job is completed or failed, end the stream
 			if update.Status == queue.StatusCompleted || update.Status == queue.StatusFailed {
 				// Send a final event indicating the stream will close
@@ -314,18 +454,35 @@ func (c *SlideController) StreamSlideStatus(ctx *gin.Context) {
 					"message": "Stream closing normally",
 				})
 				ctx.Writer.Flush()
-				
+
 				// Wait a moment before closing to ensure the message is sent
 				time.Sleep(100 * time.Millisecond)
-				
+
 				cancelStream()
 				// Wait for the watch goroutine to finish before returning
 				<-watchDone
 				return false
 			}
-			
+
 			return true
 
+		case <-c.shutdown:
+			// Tell the client to reconnect, resuming from the last event it received
+			ctx.Render(-1, sse.Event{
+				Event: "reconnect",
+				Retry: 1000,
+				Data: gin.H{
+					"id":      id,
+					"message": "Server restarting, reconnect to resume",
+				},
+			})
+			ctx.Writer.Flush()
+
+			cancelStream()
+			// Wait for the watch goroutine to finish before returning
+			<-watchDone
+			return false
+
 		case <-time.After(30 * time.Second):
 			// Send heartbeat to keep connection alive
 			ctx.SSEvent("ping", nil)
@@ -334,6 +491,24 @@ func (c *SlideController) StreamSlideStatus(ctx *gin.Context) {
 	})
 }
 
+// parseLastEventID returns the sequence number of the last event a client saw, from the
+// Last-Event-ID header or, for clients that can't set headers, the lastEventId query parameter
+func parseLastEventID(ctx *gin.Context) int64 {
+	value := ctx.GetHeader("Last-Event-ID")
+	if value == "" {
+		value = ctx.Query("lastEventId")
+	}
+	if value == "" {
+		return 0
+	}
+	seq, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seq < 0 {
+		slog.DebugContext(ctx.Request.Context(), "Ignoring invalid Last-Event-ID", "value", value)
+		return 0
+	}
+	return seq
+}
+
 // GetSlideResult handles retrieving and serving the presentation result
 func (c *SlideController) GetSlideResult(ctx *gin.Context) {
 	id := ctx.Param("id")
@@ -344,8 +519,22 @@ func (c *SlideController) GetSlideResult(ctx *gin.Context) {
 		return
 	}
 
+	// A valid share link grants access to a result on behalf of its owner
+	ownerID := middleware.OwnerID(ctx)
+	if shareID := ctx.Query("share"); shareID != "" {
+		link, ok := c.authorizeShare(ctx, id, shareID)
+		if !ok {
+			return
+		}
+		ownerID = link.OwnerID
+
+		// Keep the signed URL out of Referer headers and shared caches
+		ctx.Header("Referrer-Policy", "no-referrer")
+		ctx.Header("Cache-Control", "private, no-store")
+	}
+
 	// Retrieve the result from Firestore
-	result, err := c.queueService.GetResult(ctx, id)
+	result, err := c.queueService.GetResult(ctx, id, ownerID)
 	if err != nil {
 		ctx.JSON(http.StatusNotFound, gin.H{
 			"error": fmt.Sprintf("Result not found: %v", err),
@@ -353,6 +542,30 @@ func (c *SlideController) GetSlideResult(ctx *gin.Context) {
 		return
 	}
 
+	// Browsers fetch <img> URLs without credentials, so owned results carry their images inline.
+	// So do results deleted on their first read, as their images are gone once the page loads.
+	htmlData := result.HTMLData
+	if (result.OwnerID != "" || result.DeleteAfterDownload) && ctx.Query("download") != "true" {
+		htmlData, err = c.inlineResultImages(ctx, id, htmlData)
+		if err != nil {
+			ctx.JSON(http.StatusInternalServerError, gin.H{
+				"error": fmt.Sprintf("Failed to load result images: %v", err),
+			})
+			return
+		}
+	}
+
+	// Results that may only be read once are deleted before either format is sent, as the HTML
+	// deck carries the same content as the PDF
+	if result.DeleteAfterDownload {
+		if err := c.queueService.ConsumeResult(ctx, id); err != nil {
+			ctx.JSON(http.StatusNotFound, gin.H{
+				"error": fmt.Sprintf("Result not found: %v", err),
+			})
+			return
+		}
+	}
+
 	download := ctx.Query("download")
 
 	if download == "true" {
@@ -360,7 +573,108 @@ func (c *SlideController) GetSlideResult(ctx *gin.Context) {
 		ctx.Data(http.StatusOK, "application/pdf", result.PDFData)
 	} else {
 		ctx.Header("Content-Type", "text/html")
-		ctx.Data(http.StatusOK, "text/html", result.HTMLData)
+		ctx.Data(http.StatusOK, "text/html", htmlData)
 	}
 	return
-}
\ No newline at end of file
+}
+
+// authorizeShare validates a share link and its password, writing an error response or password
+// form and returning false if the request may not see the result
+func (c *SlideController) authorizeShare(ctx *gin.Context, id, shareID string) (*share.FirestoreShare, bool) {
+	link, err := c.shareService.Validate(ctx, id, shareID, ctx.Query("expires"), ctx.Query("sig"))
+	if err != nil {
+		status := http.StatusInternalServerError
+		switch {
+		case errors.Is(err, share.ErrDisabled):
+			status = http.StatusServiceUnavailable
+		case errors.Is(err, share.ErrExpired), errors.Is(err, share.ErrRevoked):
+			status = http.StatusGone
+		case errors.Is(err, share.ErrInvalidLink):
+			status = http.StatusForbidden
+		case errors.Is(err, share.ErrNotFound):
+			status = http.StatusNotFound
+		}
+		ctx.JSON(status, gin.H{
+			"error": err.Error(),
+		})
+		return nil, false
+	}
+
+	if !link.HasPassword() {
+		return link, true
+	}
+
+	// Passwords come from the form below or a header, never the URL, so they stay out of logs
+	password := ctx.PostForm("password")
+	if password == "" {
+		password = ctx.GetHeader("X-Share-Password")
+	}
+	if password != "" && c.shareService.CheckPassword(link, password) {
+		return link, true
+	}
+
+	message := ""
+	if password != "" {
+		message = "Incorrect password, please try again."
+	}
+	ctx.Header("Cache-Control", "no-store")
+	ctx.Header("Content-Type", "text/html; charset=utf-8")
+	ctx.Status(http.StatusUnauthorized)
+	if err := sharePasswordForm.Execute(ctx.Writer, message); err != nil {
+		slog.ErrorContext(ctx.Request.Context(), "Failed to render share password form", "error", err)
+	}
+	return nil, false
+}
+
+// sharePasswordForm asks for the password of a protected share link and posts it back to the same URL
+var sharePasswordForm = template.Must(template.New("share-password").Parse(`<!DOCTYPE html>
+<html>
+<head><meta charset="utf-8"><title>Protected presentation</title></head>
+<body style="font-family: sans-serif; max-width: 24rem; margin: 4rem auto;">
+<h1>This presentation is password protected</h1>
+{{if .}}<p style="color: #b91c1c;">{{.}}</p>{{end}}
+<form method="post">
+<input type="password" name="password" placeholder="Password" autofocus required>
+<button type="submit">View</button>
+</form>
+</body>
+</html>
+`))
+
+// inlineResultImages replaces the relative image URLs in a result's HTML with data URIs
+func (c *SlideController) inlineResultImages(ctx *gin.Context, id string, htmlData []byte) ([]byte, error) {
+	images, err := c.queueService.GetResultImages(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	for _, image := range images {
+		imageURL := []byte(id + "/images/" + image.ID)
+		dataURI := []byte("data:" + image.ContentType + ";base64," + base64.StdEncoding.EncodeToString(image.Data))
+		htmlData = bytes.ReplaceAll(htmlData, imageURL, dataURI)
+	}
+	return htmlData, nil
+}
+
+// GetSlideResultImage serves an image referenced by a generated presentation
+func (c *SlideController) GetSlideResultImage(ctx *gin.Context) {
+	id := ctx.Param("id")
+	imageID := ctx.Param("imageId")
+	if id == "" || imageID == "" {
+		ctx.JSON(http.StatusBadRequest, gin.H{
+			"error": "Missing result or image ID",
+		})
+		return
+	}
+
+	image, err := c.queueService.GetResultImage(ctx, id, imageID, middleware.OwnerID(ctx))
+	if err != nil {
+		ctx.JSON(http.StatusNotFound, gin.H{
+			"error": fmt.Sprintf("Image not found: %v", err),
+		})
+		return
+	}
+
+	// Images never change once stored, so let browsers cache them until the result expires
+	ctx.Header("Cache-Control", "private, max-age=3600")
+	ctx.Data(http.StatusOK, image.ContentType, image.Data)
+}
@@ -0,0 +1,68 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/martin226/slideitin/backend/api/middleware"
+	"github.com/martin226/slideitin/backend/api/services/usage"
+)
+
+// UsageController handles the usage API endpoint
+type UsageController struct {
+	usageService *usage.Service
+}
+
+// NewUsageController creates a new usage controller
+func NewUsageController(usageService *usage.Service) *UsageController {
+	return &UsageController{
+		usageService: usageService,
+	}
+}
+
+// GetUsage handles retrieving the caller's usage and quotas
+func (c *UsageController) GetUsage(ctx *gin.Context) {
+	response, err := c.usageService.GetUsage(ctx, middleware.UsageKey(ctx))
+	if err != nil {
+		ctx.JSON(http.StatusInternalServerError, gin.H{
+			"error": err.Error(),
+		})
+		return
+	}
+	ctx.JSON(http.StatusOK, response)
+}
+
+// reserveQuota counts n jobs against the caller's quotas, writing a 429 or 503 response and
+// returning false if they can't be started
+func reserveQuota(ctx *gin.Context, usageService *usage.Service, n int) (usage.Reservation, bool) {
+	reservation, err := usageService.ReserveJobs(ctx, middleware.UsageKey(ctx), n)
+	if err == nil {
+		return reservation, true
+	}
+
+	var quotaErr *usage.QuotaError
+	if errors.As(err, &quotaErr) {
+		middleware.RetryAfter(ctx, quotaErr.RetryAfter)
+		ctx.JSON(http.StatusTooManyRequests, gin.H{
+			"error": fmt.Sprintf("Quota exceeded: %v", quotaErr),
+		})
+		return usage.Reservation{}, false
+	}
+
+	slog.ErrorContext(ctx.Request.Context(), "Failed to reserve quota", "error", err)
+	ctx.JSON(http.StatusServiceUnavailable, gin.H{
+		"error": "Failed to check usage quota",
+	})
+	return usage.Reservation{}, false
+}
+
+// releaseQuota gives back n jobs counted by reserveQuota that couldn't be started
+func releaseQuota(ctx *gin.Context, usageService *usage.Service, reservation usage.Reservation, n int) {
+	if err := usageService.ReleaseJobs(context.Background(), reservation, n); err != nil {
+		slog.ErrorContext(ctx.Request.Context(), "Failed to release quota", "error", err)
+	}
+}
@@ -0,0 +1,203 @@
+package controllers
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/martin226/slideitin/backend/api/middleware"
+	"github.com/martin226/slideitin/backend/api/services/hub"
+	"github.com/martin226/slideitin/backend/api/services/queue"
+)
+
+// WebSocket connection timings and limits
+const (
+	wsWriteTimeout          = 10 * time.Second
+	wsPongTimeout           = 60 * time.Second
+	wsPingPeriod            = 30 * time.Second
+	wsMaxMessageBytes       = 16 << 10
+	defaultWSMaxSubscribers = 100
+)
+
+// wsClientMessage is a subscribe or unsubscribe request sent by a client
+type wsClientMessage struct {
+	Action string   `json:"action"` // subscribe or unsubscribe
+	JobIDs []string `json:"jobIds"`
+}
+
+// wsServerMessage is sent to clients: job updates, subscription acknowledgements and errors
+type wsServerMessage struct {
+	Type  string           `json:"type"` // update, subscribed, unsubscribed or error
+	JobID string           `json:"jobId,omitempty"`
+	Job   *queue.JobUpdate `json:"job,omitempty"`
+	Error string           `json:"error,omitempty"`
+}
+
+// WebSocketController handles the multiplexed job status WebSocket endpoint
+type WebSocketController struct {
+	hub              *hub.Hub
+	upgrader         websocket.Upgrader
+	maxSubscriptions int
+
+	// shutdown is closed when the server shuts down so connections close and clients reconnect
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
+}
+
+// NewWebSocketController creates a new WebSocket controller that accepts browser connections from frontendURL
+func NewWebSocketController(statusHub *hub.Hub, frontendURL string) (*WebSocketController, error) {
+	maxSubscriptions := defaultWSMaxSubscribers
+	if value := os.Getenv("WS_MAX_SUBSCRIPTIONS"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid WS_MAX_SUBSCRIPTIONS: %q", value)
+		}
+		maxSubscriptions = parsed
+	}
+
+	return &WebSocketController{
+		hub: statusHub,
+		upgrader: websocket.Upgrader{
+			// Browsers must come from the frontend; other clients don't send an Origin
+			CheckOrigin: func(r *http.Request) bool {
+				origin := r.Header.Get("Origin")
+				return origin == "" || origin == frontendURL
+			},
+		},
+		maxSubscriptions: maxSubscriptions,
+		shutdown:         make(chan struct{}),
+	}, nil
+}
+
+// CloseConnections closes every WebSocket connection with a service restart close code so clients
+// reconnect and resubscribe against another instance
+func (c *WebSocketController) CloseConnections() {
+	c.shutdownOnce.Do(func() { close(c.shutdown) })
+}
+
+// HandleWebSocket upgrades the connection and streams updates for the jobs the client subscribes to
+func (c *WebSocketController) HandleWebSocket(ctx *gin.Context) {
+	conn, err := c.upgrader.Upgrade(ctx.Writer, ctx.Request, nil)
+	if err != nil {
+		// The upgrader has already written an error response
+		slog.WarnContext(ctx.Request.Context(), "Failed to upgrade WebSocket connection", "error", err)
+		return
+	}
+	defer conn.Close()
+
+	ownerID := middleware.OwnerID(ctx)
+	sub := hub.NewSubscriber()
+	defer c.hub.UnsubscribeAll(sub)
+	defer sub.Close()
+
+	// Only this goroutine writes to the connection, the reader hands its replies over here
+	replies := make(chan wsServerMessage, 16)
+	readerDone := make(chan struct{})
+	go func() {
+		defer close(readerDone)
+		c.readMessages(conn, sub, ownerID, replies)
+	}()
+
+	ping := time.NewTicker(wsPingPeriod)
+	defer ping.Stop()
+
+	for {
+		var message wsServerMessage
+		select {
+		case update := <-sub.Updates():
+			message = wsServerMessage{Type: "update", JobID: update.ID, Job: &update}
+		case message = <-replies:
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+			continue
+		case <-sub.Done():
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.ClosePolicyViolation, "client too slow"),
+				time.Now().Add(wsWriteTimeout))
+			return
+		case <-readerDone:
+			return
+		case <-c.shutdown:
+			conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseServiceRestart, "server restarting"),
+				time.Now().Add(wsWriteTimeout))
+			return
+		}
+
+		conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+		if err := conn.WriteJSON(message); err != nil {
+			slog.Warn("Failed to write WebSocket message", "error", err)
+			return
+		}
+	}
+}
+
+// readMessages handles subscribe and unsubscribe requests until the connection closes
+func (c *WebSocketController) readMessages(conn *websocket.Conn, sub *hub.Subscriber, ownerID string, replies chan<- wsServerMessage) {
+	conn.SetReadLimit(wsMaxMessageBytes)
+	conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+	})
+
+	reply := func(message wsServerMessage) bool {
+		select {
+		case replies <- message:
+			return true
+		case <-sub.Done():
+			return false
+		}
+	}
+
+	for {
+		var message wsClientMessage
+		if err := conn.ReadJSON(&message); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+				slog.Warn("WebSocket read error", "error", err)
+			}
+			return
+		}
+		// Any message from the client also proves it's alive
+		conn.SetReadDeadline(time.Now().Add(wsPongTimeout))
+
+		for _, jobID := range message.JobIDs {
+			var response wsServerMessage
+			switch message.Action {
+			case "subscribe":
+				response = c.subscribe(sub, jobID, ownerID)
+			case "unsubscribe":
+				c.hub.Unsubscribe(sub, jobID)
+				response = wsServerMessage{Type: "unsubscribed", JobID: jobID}
+			default:
+				response = wsServerMessage{Type: "error", JobID: jobID, Error: fmt.Sprintf("unknown action %q", message.Action)}
+			}
+			if !reply(response) {
+				return
+			}
+		}
+	}
+}
+
+// subscribe adds one subscription, enforcing the per-connection limit
+func (c *WebSocketController) subscribe(sub *hub.Subscriber, jobID, ownerID string) wsServerMessage {
+	if sub.Count() >= c.maxSubscriptions {
+		return wsServerMessage{Type: "error", JobID: jobID, Error: fmt.Sprintf("too many subscriptions (maximum is %d)", c.maxSubscriptions)}
+	}
+	if err := c.hub.Subscribe(sub, jobID, ownerID); err != nil {
+		if errors.Is(err, hub.ErrJobNotFound) {
+			return wsServerMessage{Type: "error", JobID: jobID, Error: "Job not found"}
+		}
+		return wsServerMessage{Type: "error", JobID: jobID, Error: err.Error()}
+	}
+	return wsServerMessage{Type: "subscribed", JobID: jobID}
+}
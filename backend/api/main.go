@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/firestore"
@@ -11,52 +15,80 @@ import (
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"github.com/martin226/slideitin/backend/api/controllers"
+	"github.com/martin226/slideitin/backend/api/middleware"
+	"github.com/martin226/slideitin/backend/api/services/batch"
+	"github.com/martin226/slideitin/backend/api/services/health"
+	"github.com/martin226/slideitin/backend/api/services/hub"
+	"github.com/martin226/slideitin/backend/api/services/ingest"
+	"github.com/martin226/slideitin/backend/api/services/logging"
 	"github.com/martin226/slideitin/backend/api/services/queue"
+	"github.com/martin226/slideitin/backend/api/services/share"
+	"github.com/martin226/slideitin/backend/api/services/telemetry"
+	"github.com/martin226/slideitin/backend/api/services/usage"
+	"github.com/martin226/slideitin/backend/api/services/webhook"
 	"google.golang.org/api/option" // Add option package
 )
 
 func main() {
 	err := godotenv.Load()
+
+	// Set up structured logging first so everything after it is logged consistently
+	if err := logging.Setup("slideitin-api"); err != nil {
+		logging.Fatal("Failed to initialize logging", "error", err)
+	}
+	if err != nil {
+		slog.Warn(".env file not found, using system environment variables")
+	}
+
+	// Initialize tracing before anything that makes outgoing calls
+	shutdownTracing, err := telemetry.InitTracing(context.Background(), "slideitin-api")
 	if err != nil {
-		log.Println("Warning: .env file not found, using system environment variables")
+		logging.Fatal("Failed to initialize tracing", "error", err)
 	}
+	defer shutdownTracing(context.Background())
 
-// Initialize the router
-router := gin.Default()
+	// Initialize the router
+	router := gin.Default()
 
-// Trust proxy headers for Docker
-router.SetTrustedProxies([]string{"172.18.0.0/16"}) // Docker's default network
+	// Trust proxy headers for Docker
+	router.SetTrustedProxies([]string{"172.18.0.0/16"}) // Docker's default network
 
-// Get frontend URL from environment variable
+	// Get frontend URL from environment variable
 	frontendURL := os.Getenv("FRONTEND_URL")
 	if frontendURL == "" {
 		frontendURL = "http://localhost:3000" // Fallback for local development
-		log.Println("Warning: FRONTEND_URL not set, using default:", frontendURL)
-	}
-
-// Configure CORS
-router.Use(cors.New(cors.Config{
-AllowOrigins:     []string{frontendURL, "http://172.18.0.1"}, // Allow both frontend URL and Docker internal IP
-AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-AllowHeaders:     []string{
-    "Origin",
-    "Content-Type",
-    "Accept",
-    "Cache-Control",
-    "Connection",
-    "Authorization",
-    "X-Requested-With",
-}, 
-ExposeHeaders:    []string{"Content-Length", "Content-Type", "Cache-Control", "Content-Encoding", "Transfer-Encoding"},
-AllowCredentials: true,
-MaxAge:           12 * time.Hour,
+		slog.Warn("FRONTEND_URL not set, using default", "frontend_url", frontendURL)
+	}
+
+	// Configure CORS
+	router.Use(cors.New(cors.Config{
+		AllowOrigins: []string{frontendURL, "http://172.18.0.1"}, // Allow both frontend URL and Docker internal IP
+		AllowMethods: []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
+		AllowHeaders: []string{
+			"Origin",
+			"Content-Type",
+			"Accept",
+			"Cache-Control",
+			"Connection",
+			"Authorization",
+			"X-API-Key",
+			"X-Share-Password",
+			"Last-Event-ID",
+			"X-Requested-With",
+		},
+		ExposeHeaders:    []string{"Content-Length", "Content-Type", "Cache-Control", "Content-Encoding", "Transfer-Encoding", "Retry-After"},
+		AllowCredentials: true,
+		MaxAge:           12 * time.Hour,
 	}))
 
+	// Trace every request, continuing traces started by callers
+	router.Use(telemetry.TracingMiddleware())
+
 	// Initialize Firestore client
 	ctx := context.Background()
 	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
 	if projectID == "" {
-		log.Println("Warning: GOOGLE_CLOUD_PROJECT not set, using default")
+		slog.Warn("GOOGLE_CLOUD_PROJECT not set, using default")
 		projectID = "slideitin"
 	}
 
@@ -67,59 +99,215 @@ MaxAge:           12 * time.Hour,
 	// Note: 'err' is already declared by godotenv.Load() above, so no need to redeclare with :=
 
 	if emulatorHost != "" {
-		log.Printf("Using Firestore emulator at %s\n", emulatorHost)
+		slog.Info("Using Firestore emulator", "host", emulatorHost)
 		// Connect to the emulator
-		firestoreClient, err = firestore.NewClient(ctx, projectID,
+		firestoreClient, err = firestore.NewClient(ctx, projectID, append([]option.ClientOption{
 			option.WithEndpoint(emulatorHost),
 			option.WithoutAuthentication(), // No credentials needed for emulator
 			// option.WithGRPCDialOption(grpc.WithInsecure()), // Might be needed depending on emulator setup, try without first
-		)
+		}, telemetry.FirestoreClientOptions()...)...)
 	} else {
-		log.Println("Connecting to live Firestore")
+		slog.Info("Connecting to live Firestore")
 		// Connect to live Firestore
-		firestoreClient, err = firestore.NewClient(ctx, projectID)
+		firestoreClient, err = firestore.NewClient(ctx, projectID, telemetry.FirestoreClientOptions()...)
 	}
 
-
 	if err != nil {
-		log.Fatalf("Failed to initialize Firestore: %v", err)
+		logging.Fatal("Failed to initialize Firestore", "error", err)
 	}
 	defer firestoreClient.Close()
 
-	// Initialize queue service with Firestore
-	queueService, err := queue.NewService(firestoreClient)
+	// Initialize usage service
+	usageService, err := usage.NewService(firestoreClient)
+	if err != nil {
+		logging.Fatal("Failed to initialize usage service", "error", err)
+	}
+
+	// Initialize queue service with Firestore; it charges the tokens jobs use to their callers
+	queueService, err := queue.NewService(firestoreClient, usageService)
+	if err != nil {
+		logging.Fatal("Failed to initialize queue service", "error", err)
+	}
+
+	// Initialize URL ingestion service
+	ingestService, err := ingest.NewService()
+	if err != nil {
+		logging.Fatal("Failed to initialize URL ingestion service", "error", err)
+	}
+
+	// Initialize batch service
+	batchService, err := batch.NewService(firestoreClient, queueService, usageService)
+	if err != nil {
+		logging.Fatal("Failed to initialize batch service", "error", err)
+	}
+
+	// Initialize share link service
+	shareService, err := share.NewService(firestoreClient)
+	if err != nil {
+		logging.Fatal("Failed to initialize share service", "error", err)
+	}
+
+	// Initialize webhook service
+	webhookService, err := webhook.NewService(firestoreClient, queueService)
+	if err != nil {
+		logging.Fatal("Failed to initialize webhook service", "error", err)
+	}
+
+	// Initialize the job status hub shared by WebSocket connections
+	jobHub := hub.NewHub(queueService)
+
+	// Initialize authentication
+	authenticator, err := middleware.NewAuthenticator()
+	if err != nil {
+		logging.Fatal("Failed to initialize authentication", "error", err)
+	}
+
+	// Initialize rate limiting
+	rateLimiter, err := middleware.NewRateLimiter()
 	if err != nil {
-		log.Fatalf("Failed to initialize queue service: %v", err)
+		logging.Fatal("Failed to initialize rate limiting", "error", err)
+	}
+	ipRateLimiter, err := middleware.NewIPRateLimiter()
+	if err != nil {
+		logging.Fatal("Failed to initialize rate limiting", "error", err)
 	}
 
 	// Initialize controllers
-	slideController := controllers.NewSlideController(queueService)
+	slideController := controllers.NewSlideController(queueService, ingestService, usageService, shareService, webhookService)
+	batchController := controllers.NewBatchController(batchService, ingestService, usageService)
+	usageController := controllers.NewUsageController(usageService)
+	shareController := controllers.NewShareController(queueService, shareService)
+	wsController, err := controllers.NewWebSocketController(jobHub, frontendURL)
+	if err != nil {
+		logging.Fatal("Failed to initialize WebSocket controller", "error", err)
+	}
 
 	// API routes
-	v1 := router.Group("/v1")
+	// Limit by IP before checking credentials so guessing them is limited too, then by caller
+	v1 := router.Group("/v1", ipRateLimiter.Middleware(), authenticator.Middleware(), rateLimiter.Middleware())
 	{
 		// Slide generation endpoint - adds job to queue and returns immediately
 		v1.POST("/generate", slideController.GenerateSlides)
-		
+
 		// Streaming status endpoint - combines status checking and streaming
 		v1.GET("/slides/:id", slideController.StreamSlideStatus)
-        
-		// Result retrieval endpoint - serves the generated presentation
-		v1.GET("/results/:id", slideController.GetSlideResult)
+
+		// WebSocket endpoint - subscribe to the status of many jobs over a single connection
+		v1.GET("/ws", wsController.HandleWebSocket)
+
+		// Share link endpoints - create signed, expiring links to a result and revoke them
+		v1.POST("/results/:id/share", shareController.CreateShare)
+		v1.DELETE("/results/:id/share/:shareId", shareController.RevokeShare)
+
+		// Batch endpoints - create many jobs at once, aggregate their status and download all PDFs
+		v1.POST("/batches", batchController.CreateBatch)
+		v1.GET("/batches/:id", batchController.GetBatchStatus)
+		v1.GET("/batches/:id/download", batchController.DownloadBatch)
+
+		// Usage endpoint - reports the caller's usage against their daily and monthly quotas
+		v1.GET("/usage", usageController.GetUsage)
+	}
+
+	// Liveness and readiness probes, outside /v1. Uploads are handed to the slides-service
+	// through the shared volume, so the API isn't ready without it.
+	healthService, err := health.NewService()
+	if err != nil {
+		logging.Fatal("Failed to initialize health checks", "error", err)
 	}
+	healthService.Register(health.FirestoreCheck(firestoreClient))
+	healthService.Register(health.DirWritableCheck("shared_volume", "/shared"))
+	router.GET("/healthz", healthService.LivenessHandler())
+	router.GET("/readyz", healthService.ReadinessHandler())
+
+	// Result routes are registered both with and without the /v1 prefix for backward compatibility.
+	// They accept share links in place of credentials, which GetSlideResult validates.
+	for _, prefix := range []string{"/v1/results", "/results"} {
+		results := router.Group(prefix, authenticator.ShareLinkMiddleware(), rateLimiter.Middleware())
+
+		// Result retrieval endpoint - serves the generated presentation
+		results.GET("/:id", slideController.GetSlideResult)
 
-	// Add additional routes outside the v1 group to handle requests without the /v1 prefix
-	// This ensures backward compatibility or handles frontend requests that don't include the prefix
-	router.GET("/results/:id", slideController.GetSlideResult)
+		// Password form submissions for protected share links
+		results.POST("/:id", slideController.GetSlideResult)
+
+		// Image retrieval endpoint - serves images embedded in the HTML presentation
+		results.GET("/:id/images/:imageId", slideController.GetSlideResultImage)
+	}
 
 	// Start the server
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
-	
-	log.Printf("Starting server on port %s\n", port)
-	if err := router.Run(":" + port); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+
+	// Requests and jobs get this long to finish after a termination signal
+	shutdownTimeout := 25 * time.Second
+	if value := os.Getenv("SHUTDOWN_TIMEOUT"); value != "" {
+		shutdownTimeout, err = time.ParseDuration(value)
+		if err != nil || shutdownTimeout <= 0 {
+			logging.Fatal("Invalid SHUTDOWN_TIMEOUT", "value", value)
+		}
+	}
+
+	// Prometheus metrics get their own port, which isn't exposed publicly, so callers can't read them
+	metricsPort := os.Getenv("METRICS_PORT")
+	if metricsPort == "" {
+		metricsPort = "9090"
+	}
+	metricsServer := telemetry.MetricsServer(":" + metricsPort)
+	go func() {
+		slog.Info("Starting metrics server", "port", metricsPort)
+		if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatal("Failed to start metrics server", "error", err)
+		}
+	}()
+
+	// Send jobs interrupted by a slides-service restart again
+	requeueCtx, stopRequeuer := context.WithCancel(context.Background())
+	defer stopRequeuer()
+	if err := queueService.RunRequeuer(requeueCtx); err != nil {
+		logging.Fatal("Failed to start requeuer", "error", err)
+	}
+
+	// Deliver the webhooks of finished jobs, including any a previous instance left pending
+	webhookCtx, stopWebhooks := context.WithCancel(context.Background())
+	defer stopWebhooks()
+	webhookService.Run(webhookCtx)
+
+	// Streams never finish on their own, so end them as soon as the shutdown starts
+	server := &http.Server{Addr: ":" + port, Handler: router}
+	server.RegisterOnShutdown(slideController.CloseStreams)
+	server.RegisterOnShutdown(wsController.CloseConnections)
+	go func() {
+		slog.Info("Starting server", "port", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatal("Failed to start server", "error", err)
+		}
+	}()
+
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	<-signalCtx.Done()
+	stopSignals()
+
+	// Stop taking requests and wait for the running jobs. Jobs still running at the deadline are
+	// finished by the slides-service or handed back to be retried.
+	slog.Info("Shutting down, draining running jobs", "timeout", shutdownTimeout)
+	healthService.SetDraining()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Shutdown deadline passed with requests still open", "error", err)
+	}
+	if err := queueService.Drain(shutdownCtx); err != nil {
+		slog.Warn("Shutdown deadline passed with jobs still running", "error", err)
+	}
+	stopRequeuer()
+
+	// Finish the webhook attempts in progress; pending ones are delivered by another instance
+	stopWebhooks()
+	if err := webhookService.Drain(shutdownCtx); err != nil {
+		slog.Warn("Shutdown deadline passed with webhooks still being delivered", "error", err)
 	}
+	metricsServer.Close()
+	slog.Info("API stopped")
 }
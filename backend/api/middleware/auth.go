@@ -0,0 +1,171 @@
+package middleware
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// ownerIDKey is the gin context key holding the authenticated owner ID
+const ownerIDKey = "ownerID"
+
+// Authenticator validates API keys and JWT bearer tokens and records the caller's owner ID
+type Authenticator struct {
+	apiKeys          map[[32]byte]string // SHA-256 of the key -> owner ID
+	jwt              *jwtVerifier
+	allowAnonymous   bool
+	anonymousOrigins map[string]bool
+}
+
+// NewAuthenticator creates an authenticator configured from environment variables.
+//
+// API_KEYS is a comma-separated list of key:ownerID pairs. JWT_SECRET enables HS256 bearer
+// tokens whose "sub" claim is the owner ID, optionally checked against JWT_ISSUER and
+// JWT_AUDIENCE. AUTH_ALLOW_ANONYMOUS=true lets requests without credentials through
+// with an empty owner ID. AUTH_ANONYMOUS_ORIGINS does the same only for browser requests from the
+// listed comma-separated origins and from the API's own origin, for a first-party web app without
+// accounts. Other clients can forge the headers this relies on, so it only keeps casual anonymous
+// use to the web app; rate limits and quotas still apply.
+func NewAuthenticator() (*Authenticator, error) {
+	apiKeys := make(map[[32]byte]string)
+	for _, entry := range strings.Split(os.Getenv("API_KEYS"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		key, ownerID, found := strings.Cut(entry, ":")
+		if !found || key == "" || ownerID == "" {
+			return nil, fmt.Errorf("invalid API_KEYS entry: expected key:ownerID")
+		}
+		apiKeys[sha256.Sum256([]byte(key))] = ownerID
+	}
+
+	var verifier *jwtVerifier
+	if secret := os.Getenv("JWT_SECRET"); secret != "" {
+		verifier = &jwtVerifier{
+			secret:   []byte(secret),
+			issuer:   os.Getenv("JWT_ISSUER"),
+			audience: os.Getenv("JWT_AUDIENCE"),
+		}
+	}
+
+	anonymousOrigins := make(map[string]bool)
+	for _, origin := range strings.Split(os.Getenv("AUTH_ANONYMOUS_ORIGINS"), ",") {
+		origin = strings.TrimSuffix(strings.TrimSpace(origin), "/")
+		if origin == "" {
+			continue
+		}
+		parsed, err := url.Parse(origin)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" || parsed.Path != "" {
+			return nil, fmt.Errorf("invalid AUTH_ANONYMOUS_ORIGINS entry: %q", origin)
+		}
+		anonymousOrigins[origin] = true
+	}
+
+	allowAnonymous := os.Getenv("AUTH_ALLOW_ANONYMOUS") == "true"
+	if len(apiKeys) == 0 && verifier == nil && !allowAnonymous && len(anonymousOrigins) == 0 {
+		return nil, fmt.Errorf("no credentials configured: set API_KEYS or JWT_SECRET, AUTH_ANONYMOUS_ORIGINS or AUTH_ALLOW_ANONYMOUS=true")
+	}
+	if allowAnonymous {
+		slog.Warn("AUTH_ALLOW_ANONYMOUS is set, requests without credentials will be accepted")
+	}
+
+	return &Authenticator{
+		apiKeys:          apiKeys,
+		jwt:              verifier,
+		allowAnonymous:   allowAnonymous,
+		anonymousOrigins: anonymousOrigins,
+	}, nil
+}
+
+// Middleware returns a gin middleware that authenticates each request
+func (a *Authenticator) Middleware() gin.HandlerFunc {
+	return a.middleware(false)
+}
+
+// ShareLinkMiddleware is like Middleware but also lets through requests without credentials that
+// carry a share link. Handlers behind it must validate the link themselves.
+func (a *Authenticator) ShareLinkMiddleware() gin.HandlerFunc {
+	return a.middleware(true)
+}
+
+// middleware builds the authentication middleware, optionally accepting share links in place of credentials
+func (a *Authenticator) middleware(allowShareLinks bool) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		token := credentialFromRequest(ctx)
+		if token == "" {
+			if a.allowAnonymous || a.fromAnonymousOrigin(ctx) || (allowShareLinks && ctx.Query("share") != "") {
+				ctx.Set(ownerIDKey, "")
+				ctx.Next()
+				return
+			}
+			ctx.Header("WWW-Authenticate", `Bearer realm="slideitin"`)
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Missing API key or bearer token",
+			})
+			return
+		}
+
+		ownerID, err := a.authenticate(token)
+		if err != nil {
+			// Presented credentials are always checked, even when anonymous access is allowed
+			slog.WarnContext(ctx.Request.Context(), "Rejected credentials", "method", ctx.Request.Method, "route", ctx.FullPath(), "error", err)
+			ctx.Header("WWW-Authenticate", `Bearer realm="slideitin", error="invalid_token"`)
+			ctx.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+				"error": "Invalid API key or token",
+			})
+			return
+		}
+
+		ctx.Set(ownerIDKey, ownerID)
+		ctx.Next()
+	}
+}
+
+// fromAnonymousOrigin reports whether a request without credentials comes from a page of an origin
+// in AUTH_ANONYMOUS_ORIGINS. Browsers leave the Origin header out of same-origin GET requests such
+// as EventSource streams, but mark them with Sec-Fetch-Site.
+func (a *Authenticator) fromAnonymousOrigin(ctx *gin.Context) bool {
+	if len(a.anonymousOrigins) == 0 {
+		return false
+	}
+	if origin := ctx.GetHeader("Origin"); origin != "" {
+		return a.anonymousOrigins[origin]
+	}
+	return ctx.GetHeader("Sec-Fetch-Site") == "same-origin"
+}
+
+// authenticate resolves a credential to an owner ID
+func (a *Authenticator) authenticate(token string) (string, error) {
+	if ownerID, ok := a.apiKeys[sha256.Sum256([]byte(token))]; ok {
+		return ownerID, nil
+	}
+	if a.jwt != nil && strings.Count(token, ".") == 2 {
+		return a.jwt.verify(token)
+	}
+	return "", fmt.Errorf("unknown API key")
+}
+
+// credentialFromRequest extracts an API key or bearer token from the request headers.
+// Query parameters are deliberately not supported so credentials never end up in access logs.
+func credentialFromRequest(ctx *gin.Context) string {
+	if key := strings.TrimSpace(ctx.GetHeader("X-API-Key")); key != "" {
+		return key
+	}
+	authHeader := ctx.GetHeader("Authorization")
+	if scheme, token, found := strings.Cut(authHeader, " "); found && strings.EqualFold(scheme, "Bearer") {
+		return strings.TrimSpace(token)
+	}
+	return ""
+}
+
+// OwnerID returns the authenticated owner ID for the request, or an empty string for anonymous requests
+func OwnerID(ctx *gin.Context) string {
+	return ctx.GetString(ownerIDKey)
+}
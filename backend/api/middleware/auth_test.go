@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAnonymousOrigins(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("API_KEYS", "key-1:owner-1")
+	t.Setenv("AUTH_ANONYMOUS_ORIGINS", "https://app.example.com")
+
+	authenticator, err := NewAuthenticator()
+	if err != nil {
+		t.Fatalf("NewAuthenticator() error = %v", err)
+	}
+	router := gin.New()
+	router.GET("/", authenticator.Middleware(), func(ctx *gin.Context) {
+		ctx.String(http.StatusOK, OwnerID(ctx))
+	})
+
+	tests := []struct {
+		name       string
+		headers    map[string]string
+		wantStatus int
+		wantOwner  string
+	}{
+		{
+			name:       "listed origin",
+			headers:    map[string]string{"Origin": "https://app.example.com"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "other origin",
+			headers:    map[string]string{"Origin": "https://evil.example.com"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "other origin claiming same-origin",
+			headers:    map[string]string{"Origin": "https://evil.example.com", "Sec-Fetch-Site": "same-origin"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "same-origin without Origin",
+			headers:    map[string]string{"Sec-Fetch-Site": "same-origin"},
+			wantStatus: http.StatusOK,
+		},
+		{
+			name:       "cross-site without Origin",
+			headers:    map[string]string{"Sec-Fetch-Site": "cross-site"},
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "no browser headers",
+			wantStatus: http.StatusUnauthorized,
+		},
+		{
+			name:       "listed origin with API key",
+			headers:    map[string]string{"Origin": "https://app.example.com", "X-API-Key": "key-1"},
+			wantStatus: http.StatusOK,
+			wantOwner:  "owner-1",
+		},
+		{
+			name:       "listed origin with bad API key",
+			headers:    map[string]string{"Origin": "https://app.example.com", "X-API-Key": "key-2"},
+			wantStatus: http.StatusUnauthorized,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for key, value := range tt.headers {
+				req.Header.Set(key, value)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			if rec.Code == http.StatusOK && rec.Body.String() != tt.wantOwner {
+				t.Errorf("owner = %q, want %q", rec.Body.String(), tt.wantOwner)
+			}
+		})
+	}
+}
+
+func TestNewAuthenticatorInvalidOrigin(t *testing.T) {
+	for _, origin := range []string{"app.example.com", "https://app.example.com/path", "https://"} {
+		t.Run(origin, func(t *testing.T) {
+			t.Setenv("AUTH_ANONYMOUS_ORIGINS", origin)
+			if _, err := NewAuthenticator(); err == nil {
+				t.Errorf("NewAuthenticator() accepted AUTH_ANONYMOUS_ORIGINS=%q", origin)
+			}
+		})
+	}
+}
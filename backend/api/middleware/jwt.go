@@ -0,0 +1,119 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// clockSkew is the leeway allowed when checking exp and nbf
+const clockSkew = 30 * time.Second
+
+// jwtVerifier verifies HS256-signed JWT bearer tokens
+type jwtVerifier struct {
+	secret   []byte
+	issuer   string
+	audience string
+}
+
+// jwtHeader is the decoded JOSE header of a token
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Typ string `json:"typ"`
+}
+
+// jwtClaims are the registered claims we check
+type jwtClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"` // Either a string or an array of strings
+	ExpiresAt int64           `json:"exp"`
+	NotBefore int64           `json:"nbf"`
+}
+
+// verify checks the token's signature and claims and returns its subject
+func (v *jwtVerifier) verify(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed token")
+	}
+
+	headerBytes, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", fmt.Errorf("malformed token header: %v", err)
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerBytes, &header); err != nil {
+		return "", fmt.Errorf("malformed token header: %v", err)
+	}
+	// Only accept the algorithm we sign with, never "none" or an asymmetric algorithm
+	if header.Alg != "HS256" {
+		return "", fmt.Errorf("unsupported token algorithm: %s", header.Alg)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", fmt.Errorf("malformed token signature: %v", err)
+	}
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return "", errors.New("invalid token signature")
+	}
+
+	claimsBytes, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", fmt.Errorf("malformed token claims: %v", err)
+	}
+	var claims jwtClaims
+	if err := json.Unmarshal(claimsBytes, &claims); err != nil {
+		return "", fmt.Errorf("malformed token claims: %v", err)
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt == 0 {
+		return "", errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(claims.ExpiresAt, 0).Add(clockSkew)) {
+		return "", errors.New("token has expired")
+	}
+	if claims.NotBefore != 0 && now.Add(clockSkew).Before(time.Unix(claims.NotBefore, 0)) {
+		return "", errors.New("token is not valid yet")
+	}
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return "", fmt.Errorf("unexpected token issuer: %s", claims.Issuer)
+	}
+	if v.audience != "" && !audienceContains(claims.Audience, v.audience) {
+		return "", errors.New("token audience does not match")
+	}
+	if claims.Subject == "" {
+		return "", errors.New("token has no subject")
+	}
+
+	return claims.Subject, nil
+}
+
+// audienceContains reports whether the aud claim, a string or array of strings, contains want
+func audienceContains(raw json.RawMessage, want string) bool {
+	if len(raw) == 0 {
+		return false
+	}
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return single == want
+	}
+	var many []string
+	if err := json.Unmarshal(raw, &many); err == nil {
+		for _, aud := range many {
+			if aud == want {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signToken builds a token with the given header and claims, signed with secret
+func signToken(t *testing.T, secret string, header, claims map[string]any) string {
+	t.Helper()
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTVerify(t *testing.T) {
+	const secret = "test-secret"
+	now := time.Now()
+	hs256 := map[string]any{"alg": "HS256", "typ": "JWT"}
+	// claims returns valid claims with overrides applied, dropping keys overridden with nil
+	claims := func(overrides map[string]any) map[string]any {
+		c := map[string]any{
+			"sub": "owner-1",
+			"iss": "slideitin",
+			"aud": "api",
+			"exp": now.Add(time.Hour).Unix(),
+		}
+		for key, value := range overrides {
+			if value == nil {
+				delete(c, key)
+			} else {
+				c[key] = value
+			}
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		wantErr string
+	}{
+		{
+			name:  "valid",
+			token: signToken(t, secret, hs256, claims(nil)),
+		},
+		{
+			name:    "alg none",
+			token:   signToken(t, secret, map[string]any{"alg": "none"}, claims(nil)),
+			wantErr: "unsupported token algorithm",
+		},
+		{
+			name:    "alg HS512",
+			token:   signToken(t, secret, map[string]any{"alg": "HS512"}, claims(nil)),
+			wantErr: "unsupported token algorithm",
+		},
+		{
+			name:    "wrong secret",
+			token:   signToken(t, "other-secret", hs256, claims(nil)),
+			wantErr: "invalid token signature",
+		},
+		{
+			name:    "missing exp",
+			token:   signToken(t, secret, hs256, claims(map[string]any{"exp": nil})),
+			wantErr: "token has no expiry",
+		},
+		{
+			name:    "expired",
+			token:   signToken(t, secret, hs256, claims(map[string]any{"exp": now.Add(-time.Hour).Unix()})),
+			wantErr: "token has expired",
+		},
+		{
+			name:  "expired within clock skew",
+			token: signToken(t, secret, hs256, claims(map[string]any{"exp": now.Add(-clockSkew / 2).Unix()})),
+		},
+		{
+			name:    "not valid yet",
+			token:   signToken(t, secret, hs256, claims(map[string]any{"nbf": now.Add(time.Hour).Unix()})),
+			wantErr: "token is not valid yet",
+		},
+		{
+			name:  "nbf within clock skew",
+			token: signToken(t, secret, hs256, claims(map[string]any{"nbf": now.Add(clockSkew / 2).Unix()})),
+		},
+		{
+			name:    "wrong issuer",
+			token:   signToken(t, secret, hs256, claims(map[string]any{"iss": "someone-else"})),
+			wantErr: "unexpected token issuer",
+		},
+		{
+			name:    "wrong audience",
+			token:   signToken(t, secret, hs256, claims(map[string]any{"aud": "other"})),
+			wantErr: "token audience does not match",
+		},
+		{
+			name:  "audience array",
+			token: signToken(t, secret, hs256, claims(map[string]any{"aud": []string{"other", "api"}})),
+		},
+		{
+			name:    "audience array without ours",
+			token:   signToken(t, secret, hs256, claims(map[string]any{"aud": []string{"other"}})),
+			wantErr: "token audience does not match",
+		},
+		{
+			name:    "missing audience",
+			token:   signToken(t, secret, hs256, claims(map[string]any{"aud": nil})),
+			wantErr: "token audience does not match",
+		},
+		{
+			name:    "missing subject",
+			token:   signToken(t, secret, hs256, claims(map[string]any{"sub": nil})),
+			wantErr: "token has no subject",
+		},
+		{
+			name:    "malformed",
+			token:   "not.a-token",
+			wantErr: "malformed token",
+		},
+	}
+
+	verifier := &jwtVerifier{secret: []byte(secret), issuer: "slideitin", audience: "api"}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			subject, err := verifier.verify(tt.token)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatalf("verify() error = %v, want nil", err)
+				}
+				if subject != "owner-1" {
+					t.Errorf("verify() subject = %q, want %q", subject, "owner-1")
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("verify() error = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestJWTVerifyTamperedClaims(t *testing.T) {
+	const secret = "test-secret"
+	token := signToken(t, secret, map[string]any{"alg": "HS256"}, map[string]any{
+		"sub": "owner-1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	forged := signToken(t, "other-secret", map[string]any{"alg": "HS256"}, map[string]any{
+		"sub": "owner-2",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+
+	// Swap in another owner's claims while keeping the original signature
+	parts := strings.Split(token, ".")
+	parts[1] = strings.Split(forged, ".")[1]
+	verifier := &jwtVerifier{secret: []byte(secret)}
+	if _, err := verifier.verify(strings.Join(parts, ".")); err == nil {
+		t.Fatal("verify() accepted a token with tampered claims")
+	}
+}
@@ -0,0 +1,163 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// Default limits applied when the corresponding environment variables are not set
+const (
+	defaultRateLimitRPS   = 2
+	defaultRateLimitBurst = 20
+	// Several callers can share an IP, so its bucket is larger
+	defaultIPRateLimitRPS   = 10
+	defaultIPRateLimitBurst = 100
+
+	// idleLimiterTTL is how long a caller's bucket is kept after their last request
+	idleLimiterTTL = 10 * time.Minute
+)
+
+// visitor is one caller's token bucket
+type visitor struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimiter applies a token bucket per key, such as the caller or the client IP
+type RateLimiter struct {
+	mu       sync.Mutex
+	visitors map[string]*visitor
+	rps      rate.Limit
+	burst    int
+	key      func(ctx *gin.Context) string
+}
+
+// NewRateLimiter creates a rate limiter per API key, token owner or client IP configured from
+// environment variables.
+//
+// RATE_LIMIT_RPS is the sustained number of requests per second allowed per caller and
+// RATE_LIMIT_BURST the size of the bucket. RATE_LIMIT_RPS=0 disables rate limiting.
+func NewRateLimiter() (*RateLimiter, error) {
+	return newRateLimiter("RATE_LIMIT_RPS", "RATE_LIMIT_BURST", defaultRateLimitRPS, defaultRateLimitBurst, UsageKey)
+}
+
+// NewIPRateLimiter creates a rate limiter per client IP configured from environment variables. It
+// runs before authentication, so requests with bad credentials are limited too.
+//
+// RATE_LIMIT_IP_RPS is the sustained number of requests per second allowed per IP and
+// RATE_LIMIT_IP_BURST the size of the bucket. RATE_LIMIT_IP_RPS=0 disables it.
+func NewIPRateLimiter() (*RateLimiter, error) {
+	return newRateLimiter("RATE_LIMIT_IP_RPS", "RATE_LIMIT_IP_BURST", defaultIPRateLimitRPS, defaultIPRateLimitBurst, func(ctx *gin.Context) string {
+		return ctx.ClientIP()
+	})
+}
+
+// newRateLimiter creates a rate limiter keyed by key with its limits read from the rpsVar and
+// burstVar environment variables
+func newRateLimiter(rpsVar, burstVar string, defaultRPS float64, defaultBurst int, key func(ctx *gin.Context) string) (*RateLimiter, error) {
+	rps := defaultRPS
+	if value := os.Getenv(rpsVar); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid %s: %q", rpsVar, value)
+		}
+		rps = parsed
+	}
+
+	burst := defaultBurst
+	if value := os.Getenv(burstVar); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid %s: %q", burstVar, value)
+		}
+		burst = parsed
+	}
+
+	limiter := &RateLimiter{
+		visitors: make(map[string]*visitor),
+		rps:      rate.Limit(rps),
+		burst:    burst,
+		key:      key,
+	}
+	if rps > 0 {
+		go limiter.cleanup()
+	}
+	return limiter, nil
+}
+
+// Middleware returns a gin middleware that rejects callers who have emptied their bucket. A limiter
+// created by NewRateLimiter must run after the authentication middleware so callers are keyed by
+// owner.
+func (l *RateLimiter) Middleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		if l.rps == 0 {
+			ctx.Next()
+			return
+		}
+
+		reservation := l.limiter(l.key(ctx)).Reserve()
+		if delay := reservation.Delay(); delay > 0 {
+			// Don't consume a token for a request we're rejecting
+			reservation.Cancel()
+			RetryAfter(ctx, delay)
+			ctx.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{
+				"error": "Rate limit exceeded, please slow down",
+			})
+			return
+		}
+
+		ctx.Next()
+	}
+}
+
+// limiter returns the token bucket for a caller, creating it if needed
+func (l *RateLimiter) limiter(key string) *rate.Limiter {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	v, ok := l.visitors[key]
+	if !ok {
+		v = &visitor{limiter: rate.NewLimiter(l.rps, l.burst)}
+		l.visitors[key] = v
+	}
+	v.lastSeen = time.Now()
+	return v.limiter
+}
+
+// cleanup periodically forgets callers who haven't made a request recently
+func (l *RateLimiter) cleanup() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		l.mu.Lock()
+		for key, v := range l.visitors {
+			if time.Since(v.lastSeen) > idleLimiterTTL {
+				delete(l.visitors, key)
+			}
+		}
+		l.mu.Unlock()
+	}
+}
+
+// UsageKey returns the key requests are rate limited and metered by: the authenticated owner,
+// or the client IP for anonymous requests
+func UsageKey(ctx *gin.Context) string {
+	if ownerID := OwnerID(ctx); ownerID != "" {
+		return "owner:" + ownerID
+	}
+	return "ip:" + ctx.ClientIP()
+}
+
+// RetryAfter sets the Retry-After header, rounding up to whole seconds
+func RetryAfter(ctx *gin.Context, delay time.Duration) {
+	ctx.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+}
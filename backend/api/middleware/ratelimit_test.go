@@ -0,0 +1,69 @@
+package middleware
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRateLimiter(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	// A bucket that barely refills during the test
+	t.Setenv("RATE_LIMIT_IP_RPS", "0.001")
+	t.Setenv("RATE_LIMIT_IP_BURST", "2")
+
+	limiter, err := NewIPRateLimiter()
+	if err != nil {
+		t.Fatalf("NewIPRateLimiter() error = %v", err)
+	}
+	router := gin.New()
+	router.GET("/", limiter.Middleware(), func(ctx *gin.Context) {
+		ctx.Status(http.StatusOK)
+	})
+
+	tests := []struct {
+		name       string
+		ip         string
+		wantStatus int
+	}{
+		{name: "first request", ip: "192.0.2.1", wantStatus: http.StatusOK},
+		{name: "second request", ip: "192.0.2.1", wantStatus: http.StatusOK},
+		{name: "bucket empty", ip: "192.0.2.1", wantStatus: http.StatusTooManyRequests},
+		{name: "rejected requests don't use tokens", ip: "192.0.2.1", wantStatus: http.StatusTooManyRequests},
+		{name: "other IP has its own bucket", ip: "192.0.2.2", wantStatus: http.StatusOK},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = tt.ip + ":1234"
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+
+		if rec.Code != tt.wantStatus {
+			t.Errorf("%s: status = %d, want %d", tt.name, rec.Code, tt.wantStatus)
+		}
+		if rec.Code == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+			t.Errorf("%s: missing Retry-After", tt.name)
+		}
+	}
+}
+
+func TestNewRateLimiterInvalidConfig(t *testing.T) {
+	tests := []struct {
+		name, rps, burst string
+	}{
+		{name: "negative rps", rps: "-1", burst: "1"},
+		{name: "non-numeric rps", rps: "fast", burst: "1"},
+		{name: "zero burst", rps: "1", burst: "0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("RATE_LIMIT_RPS", tt.rps)
+			t.Setenv("RATE_LIMIT_BURST", tt.burst)
+			if _, err := NewRateLimiter(); err == nil {
+				t.Error("NewRateLimiter() accepted invalid config")
+			}
+		})
+	}
+}
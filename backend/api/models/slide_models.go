@@ -4,38 +4,139 @@ package models
 var (
 	// Valid themes
 	ValidThemes = []string{"default", "beam", "rose_pine", "gaia", "uncover", "graph_paper"}
-	
+
 	// Valid slide detail levels
 	ValidSlideDetails = []string{"minimal", "medium", "detailed"}
-	
+
 	// Valid audience types
 	ValidAudiences = []string{"general", "academic", "technical", "professional", "executive"}
 )
 
 // SlideSettings represents the settings for slide generation
 type SlideSettings struct {
-	SlideDetail string `json:"slideDetail"` // Values: minimal, medium, detailed
-	Audience    string `json:"audience"`    // Values: general, academic, technical, professional, executive
+	SlideDetail string `json:"slideDetail"`     // Values: minimal, medium, detailed
+	Audience    string `json:"audience"`        // Values: general, academic, technical, professional, executive
+	Math        bool   `json:"math,omitempty"`  // Render $...$ formulas; only supported for the academic audience
+	Debug       bool   `json:"debug,omitempty"` // Log the job's document and deck content; only honoured where LOG_ALLOW_JOB_DEBUG is set
 }
 
 type File struct {
 	Filename string `json:"filename"`
-	Data []byte `json:"data"`
-	Type string `json:"type"`
+	Data     []byte `json:"data"`
+	Type     string `json:"type"`
 }
 
 // SlideRequest represents the incoming request for slide generation
 type SlideRequest struct {
-	Theme    string       `json:"theme" binding:"required"`
-	Settings SlideSettings `json:"settings" binding:"required"`
+	Theme          string        `json:"theme" binding:"required"`
+	Settings       SlideSettings `json:"settings" binding:"required"`
+	URLs           []string      `json:"urls,omitempty"`           // Web pages fetched and converted to markdown alongside uploaded files
+	CallbackURL    string        `json:"callbackUrl,omitempty"`    // Receives a signed POST when the job completes or fails
+	CallbackSecret string        `json:"callbackSecret,omitempty"` // Key used to sign callback payloads
+	NoCache        bool          `json:"noCache,omitempty"`        // Generate the deck again even if an identical one is cached
 	// Files will be handled separately through multipart form
 }
 
 // SlideResponse represents the response for a slide generation request
 type SlideResponse struct {
-	ID         string `json:"id"`
-	Status     string `json:"status"`
-	Message    string `json:"message"`
-	CreatedAt  int64  `json:"createdAt"`
-	UpdatedAt  int64  `json:"updatedAt"`
-} 
\ No newline at end of file
+	ID        string           `json:"id"`
+	Status    string           `json:"status"`
+	Message   string           `json:"message"`
+	CreatedAt int64            `json:"createdAt"`
+	UpdatedAt int64            `json:"updatedAt"`
+	Retention *RetentionPolicy `json:"retention,omitempty"`
+	Cache     string           `json:"cache,omitempty"` // hit if the result was reused from the cache, otherwise miss or skipped
+}
+
+// RetentionPolicy controls how long a job and its result are kept
+type RetentionPolicy struct {
+	JobTTL              int64 `json:"jobTtl"`    // Seconds a finished job's status is kept
+	ResultTTL           int64 `json:"resultTtl"` // Seconds the result is kept, unless KeepForever is set
+	KeepForever         bool  `json:"keepForever,omitempty"`
+	DeleteAfterDownload bool  `json:"deleteAfterDownload,omitempty"` // Delete the result once it's first viewed or downloaded
+}
+
+// BatchGroup represents one group of documents in a batch request, generated as a single deck
+type BatchGroup struct {
+	Name     string        `json:"name,omitempty"` // Optional label used in status and download file names
+	Theme    string        `json:"theme" binding:"required"`
+	Settings SlideSettings `json:"settings" binding:"required"`
+	Files    []string      `json:"files,omitempty"` // Filenames of uploaded files belonging to this group
+	URLs     []string      `json:"urls,omitempty"`
+	NoCache  bool          `json:"noCache,omitempty"` // Generate the deck again even if an identical one is cached
+}
+
+// BatchRequest represents the incoming request for batch slide generation
+type BatchRequest struct {
+	Groups []BatchGroup `json:"groups" binding:"required"`
+	// Files will be handled separately through multipart form
+}
+
+// BatchJobStatus represents the status of one job in a batch
+type BatchJobStatus struct {
+	ID        string `json:"id"`
+	Name      string `json:"name,omitempty"`
+	Status    string `json:"status"`
+	Message   string `json:"message"`
+	ResultURL string `json:"resultUrl,omitempty"`
+}
+
+// BatchResponse represents the aggregated status of a batch
+type BatchResponse struct {
+	ID          string           `json:"id"`
+	Status      string           `json:"status"`
+	Total       int              `json:"total"`
+	Counts      map[string]int   `json:"counts"`
+	Jobs        []BatchJobStatus `json:"jobs"`
+	DownloadURL string           `json:"downloadUrl,omitempty"`
+	CreatedAt   int64            `json:"createdAt"`
+}
+
+// UsageCounts holds job and Gemini token counts for a quota window
+type UsageCounts struct {
+	Jobs         int64 `json:"jobs"`
+	InputTokens  int64 `json:"inputTokens"`
+	OutputTokens int64 `json:"outputTokens"`
+}
+
+// UsagePeriod represents a caller's usage in the current day or month
+type UsagePeriod struct {
+	Window   string      `json:"window"` // e.g. 2025-04-01 or 2025-04
+	Used     UsageCounts `json:"used"`
+	Limits   UsageCounts `json:"limits"` // 0 means unlimited
+	ResetsAt int64       `json:"resetsAt"`
+}
+
+// UsageResponse represents the response of the usage endpoint
+type UsageResponse struct {
+	Daily   UsagePeriod `json:"daily"`
+	Monthly UsagePeriod `json:"monthly"`
+}
+
+// ShareRequest represents a request to create a share link for a result
+type ShareRequest struct {
+	TTL      string `json:"ttl,omitempty"`      // Go duration such as "48h"; defaults to SHARE_DEFAULT_TTL
+	Password string `json:"password,omitempty"` // Optional password viewers must enter
+}
+
+// ShareResponse represents a created share link
+type ShareResponse struct {
+	ID          string `json:"id"`
+	URL         string `json:"url"`
+	DownloadURL string `json:"downloadUrl"`
+	Protected   bool   `json:"protected"`
+	ExpiresAt   int64  `json:"expiresAt"`
+}
+
+// WebhookPayload is the body POSTed to a job's callback URL once it completes or fails
+type WebhookPayload struct {
+	Event           string `json:"event"` // job.completed or job.failed
+	DeliveryID      string `json:"deliveryId"`
+	JobID           string `json:"jobId"`
+	Status          string `json:"status"`
+	Message         string `json:"message"`
+	ResultURL       string `json:"resultUrl,omitempty"`
+	DownloadURL     string `json:"downloadUrl,omitempty"`
+	ResultExpiresAt int64  `json:"resultExpiresAt,omitempty"`
+	Timestamp       int64  `json:"timestamp"`
+}
@@ -0,0 +1,326 @@
+package batch
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/martin226/slideitin/backend/api/models"
+	"github.com/martin226/slideitin/backend/api/services/queue"
+	"github.com/martin226/slideitin/backend/api/services/usage"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Batch-level statuses derived from the statuses of the child jobs
+const (
+	StatusProcessing = "processing"
+	StatusCompleted  = "completed"
+	StatusPartial    = "partial"
+	StatusFailed     = "failed"
+
+	// statusExpired is reported for jobs whose job and result documents have both expired
+	statusExpired = "expired"
+)
+
+// Default limits applied when the corresponding environment variables are not set
+const (
+	defaultConcurrency = 3
+	defaultMaxGroups   = 50
+	batchTTL           = 24 * time.Hour
+)
+
+// FirestoreBatchJob is the Firestore representation of one job in a batch
+type FirestoreBatchJob struct {
+	JobID string `firestore:"jobId"`
+	Name  string `firestore:"name"`
+}
+
+// FirestoreBatch is the Firestore representation of a batch
+type FirestoreBatch struct {
+	ID        string              `firestore:"id"`
+	OwnerID   string              `firestore:"ownerId,omitempty"`
+	Jobs      []FirestoreBatchJob `firestore:"jobs"`
+	CreatedAt int64               `firestore:"createdAt"`
+	ExpiresAt int64               `firestore:"expiresAt"`
+}
+
+// Group is one validated document group ready to be turned into a job
+type Group struct {
+	Name     string
+	Theme    string
+	Settings models.SlideSettings
+	Files    []models.File
+	NoCache  bool
+}
+
+// Service manages batches of slide generation jobs
+type Service struct {
+	client       *firestore.Client
+	queueService *queue.Service
+	usageService *usage.Service
+	concurrency  int
+	maxGroups    int
+}
+
+// NewService creates a new batch service configured from environment variables
+func NewService(client *firestore.Client, queueService *queue.Service, usageService *usage.Service) (*Service, error) {
+	concurrency := defaultConcurrency
+	if value := os.Getenv("BATCH_CONCURRENCY"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid BATCH_CONCURRENCY: %q", value)
+		}
+		concurrency = parsed
+	}
+
+	maxGroups := defaultMaxGroups
+	if value := os.Getenv("BATCH_MAX_GROUPS"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 || parsed > queue.MaxReservedJobs {
+			return nil, fmt.Errorf("invalid BATCH_MAX_GROUPS: %q (must be between 1 and %d)", value, queue.MaxReservedJobs)
+		}
+		maxGroups = parsed
+	}
+
+	return &Service{
+		client:       client,
+		queueService: queueService,
+		usageService: usageService,
+		concurrency:  concurrency,
+		maxGroups:    maxGroups,
+	}, nil
+}
+
+// MaxGroups returns the maximum number of groups accepted in a single batch
+func (s *Service) MaxGroups() int {
+	return s.maxGroups
+}
+
+// Collection returns the Firestore collection reference for batches
+func (s *Service) Collection() *firestore.CollectionRef {
+	return s.client.Collection("batches")
+}
+
+// CreateBatch stores a batch and starts one job per group in the background.
+// jobIDs must contain one ID per group; token usage is recorded against the caller of the
+// reservation the batch's jobs were counted in, and failed jobs are given back to it.
+func (s *Service) CreateBatch(ctx context.Context, id, ownerID string, reservation usage.Reservation, jobIDs []string, groups []Group) (*FirestoreBatch, error) {
+	if len(jobIDs) != len(groups) {
+		return nil, fmt.Errorf("expected %d job IDs, got %d", len(groups), len(jobIDs))
+	}
+
+	now := time.Now()
+	batch := FirestoreBatch{
+		ID:        id,
+		OwnerID:   ownerID,
+		Jobs:      make([]FirestoreBatchJob, 0, len(groups)),
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(batchTTL).Unix(),
+	}
+	for i, group := range groups {
+		batch.Jobs = append(batch.Jobs, FirestoreBatchJob{JobID: jobIDs[i], Name: group.Name})
+	}
+
+	// Reserve every job up front so the batch status is complete before the jobs start
+	if err := s.queueService.ReserveJobs(ctx, jobIDs, ownerID, "Waiting for a batch slot"); err != nil {
+		return nil, err
+	}
+
+	if _, err := s.Collection().Doc(id).Set(ctx, batch); err != nil {
+		slog.ErrorContext(ctx, "Failed to add batch to Firestore", "batch_id", id, "error", err)
+		// Nothing will run the reserved jobs, so don't leave them queued
+		s.queueService.FailReservedJobs(context.WithoutCancel(ctx), jobIDs, "Failed to store batch")
+		return nil, fmt.Errorf("failed to store batch: %v", err)
+	}
+
+	slog.InfoContext(ctx, "Added batch to Firestore", "batch_id", id, "jobs", len(groups))
+
+	// The request returns immediately, so jobs keep its trace but not its cancellation
+	go s.runJobs(context.WithoutCancel(ctx), id, ownerID, reservation, jobIDs, groups)
+
+	return &batch, nil
+}
+
+// runJobs adds each group's job to the queue, running at most s.concurrency at a time
+func (s *Service) runJobs(ctx context.Context, batchID, ownerID string, reservation usage.Reservation, jobIDs []string, groups []Group) {
+	sem := make(chan struct{}, s.concurrency)
+	var wg sync.WaitGroup
+
+	// Keep the jobs waiting for a slot alive so they aren't reaped as stuck; once a job starts,
+	// the slides-service keeps it alive
+	var waitingMu sync.Mutex
+	waiting := make(map[string]bool, len(jobIDs))
+	for _, jobID := range jobIDs {
+		waiting[jobID] = true
+	}
+	keepAliveCtx, stopKeepAlive := context.WithCancel(ctx)
+	defer stopKeepAlive()
+	go s.queueService.KeepAlive(keepAliveCtx, func() []string {
+		waitingMu.Lock()
+		defer waitingMu.Unlock()
+		ids := make([]string, 0, len(waiting))
+		for jobID := range waiting {
+			ids = append(ids, jobID)
+		}
+		return ids
+	})
+
+	for i, group := range groups {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(jobID string, group Group) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			waitingMu.Lock()
+			delete(waiting, jobID)
+			waitingMu.Unlock()
+
+			// AddJobAndWait marks the job as failed itself when it can't be processed, and charges
+			// the tokens it used
+			if _, err := s.queueService.AddJobAndWait(ctx, jobID, ownerID, reservation, group.Theme, group.Files, group.Settings, group.NoCache); err != nil {
+				slog.ErrorContext(ctx, "Batch job failed", "batch_id", batchID, "job_id", jobID, "error", err)
+				// The job was counted against the caller's quota when the batch was accepted
+				if err := s.usageService.ReleaseJobs(context.Background(), reservation, 1); err != nil {
+					slog.ErrorContext(ctx, "Failed to release quota for batch job", "batch_id", batchID, "job_id", jobID, "error", err)
+				}
+			}
+		}(jobIDs[i], group)
+	}
+
+	wg.Wait()
+	slog.InfoContext(ctx, "All batch jobs have been processed", "batch_id", batchID)
+}
+
+// GetBatch retrieves a batch by its ID from Firestore, returning an error if the owner may not read it
+func (s *Service) GetBatch(ctx context.Context, id, ownerID string) (*FirestoreBatch, error) {
+	doc, err := s.Collection().Doc(id).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, fmt.Errorf("batch not found")
+		}
+		return nil, fmt.Errorf("error retrieving batch: %v", err)
+	}
+
+	var batch FirestoreBatch
+	if err := doc.DataTo(&batch); err != nil {
+		return nil, fmt.Errorf("error parsing batch data: %v", err)
+	}
+
+	// Report batches owned by someone else as not found so IDs can't be probed
+	if batch.OwnerID != "" && batch.OwnerID != ownerID {
+		return nil, fmt.Errorf("batch not found")
+	}
+
+	// Check if batch has expired
+	now := time.Now().Unix()
+	if batch.ExpiresAt > 0 && now > batch.ExpiresAt {
+		if _, err := s.Collection().Doc(id).Delete(ctx); err != nil {
+			slog.Error("Failed to delete expired batch", "batch_id", id, "error", err)
+		} else {
+			slog.Info("Deleted expired batch", "batch_id", id)
+		}
+		return nil, fmt.Errorf("batch has expired")
+	}
+
+	return &batch, nil
+}
+
+// GetStatus aggregates the statuses of all jobs in a batch
+func (s *Service) GetStatus(ctx context.Context, batch *FirestoreBatch) *models.BatchResponse {
+	response := &models.BatchResponse{
+		ID:        batch.ID,
+		Total:     len(batch.Jobs),
+		Counts:    make(map[string]int),
+		Jobs:      make([]models.BatchJobStatus, 0, len(batch.Jobs)),
+		CreatedAt: batch.CreatedAt,
+	}
+
+	for _, batchJob := range batch.Jobs {
+		jobStatus := models.BatchJobStatus{
+			ID:   batchJob.JobID,
+			Name: batchJob.Name,
+		}
+
+		if job := s.queueService.GetJob(batchJob.JobID, batch.OwnerID); job != nil {
+			jobStatus.Status = string(job.Status)
+			jobStatus.Message = job.Message
+			jobStatus.ResultURL = job.ResultURL
+		} else if result, err := s.queueService.GetResult(ctx, batchJob.JobID, batch.OwnerID); err == nil {
+			// Completed jobs expire before their results do
+			jobStatus.Status = string(queue.StatusCompleted)
+			jobStatus.Message = "Slides generated successfully"
+			jobStatus.ResultURL = result.ResultURL
+		} else {
+			jobStatus.Status = statusExpired
+			jobStatus.Message = "Job and result are no longer available"
+		}
+
+		response.Counts[jobStatus.Status]++
+		response.Jobs = append(response.Jobs, jobStatus)
+	}
+
+	completed := response.Counts[string(queue.StatusCompleted)]
+	switch {
+	case response.Counts[string(queue.StatusQueued)]+response.Counts[string(queue.StatusProcessing)] > 0:
+		response.Status = StatusProcessing
+	case completed == response.Total:
+		response.Status = StatusCompleted
+	case completed == 0:
+		response.Status = StatusFailed
+	default:
+		response.Status = StatusPartial
+	}
+
+	return response
+}
+
+var unsafeZipNameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// WriteZip writes a zip archive of the PDFs of all finished jobs in a batch and returns how many were included
+func (s *Service) WriteZip(ctx context.Context, batch *FirestoreBatch, w io.Writer) (int, error) {
+	archive := zip.NewWriter(w)
+	count := 0
+
+	for i, batchJob := range batch.Jobs {
+		result, err := s.queueService.GetResult(ctx, batchJob.JobID, batch.OwnerID)
+		if err != nil {
+			continue
+		}
+		// Adding a PDF to the archive counts as its download
+		if result.DeleteAfterDownload {
+			if err := s.queueService.ConsumeResult(ctx, batchJob.JobID); err != nil {
+				continue
+			}
+		}
+
+		name := batchJob.Name
+		if name == "" {
+			name = batchJob.JobID
+		}
+		name = unsafeZipNameChars.ReplaceAllString(name, "-")
+
+		entry, err := archive.Create(fmt.Sprintf("%02d-%s.pdf", i+1, name))
+		if err != nil {
+			return count, fmt.Errorf("failed to add %s to archive: %v", batchJob.JobID, err)
+		}
+		if _, err := entry.Write(result.PDFData); err != nil {
+			return count, fmt.Errorf("failed to write %s to archive: %v", batchJob.JobID, err)
+		}
+		count++
+	}
+
+	if err := archive.Close(); err != nil {
+		return count, fmt.Errorf("failed to finish archive: %v", err)
+	}
+	return count, nil
+}
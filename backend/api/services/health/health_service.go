@@ -0,0 +1,221 @@
+package health
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Defaults for health checks
+const (
+	defaultTimeout  = 5 * time.Second
+	defaultCacheTTL = 5 * time.Minute
+)
+
+// Check statuses
+const (
+	StatusOK       = "ok"
+	StatusError    = "error"
+	StatusDraining = "draining"
+)
+
+// Check is a single dependency check
+type Check struct {
+	Name string
+	Run  func(ctx context.Context) error
+	// Liveness checks are also run by /healthz; they should only cover this instance, since a
+	// failing liveness probe restarts the container
+	Liveness bool
+	// Cached checks are expensive or rate limited, so their result is reused for HEALTH_CACHE_TTL
+	Cached bool
+}
+
+// Result is the outcome of a check
+type Result struct {
+	Status    string `json:"status"`
+	LatencyMs int64  `json:"latencyMs"`
+	Error     string `json:"error,omitempty"`
+	CheckedAt int64  `json:"checkedAt"`
+	Cached    bool   `json:"cached,omitempty"`
+}
+
+// Report is the response of the health endpoints
+type Report struct {
+	Status string            `json:"status"`
+	Checks map[string]Result `json:"checks"`
+}
+
+// entry is a registered check with its last result
+type entry struct {
+	check Check
+	mu    sync.Mutex // Held while the check runs so concurrent probes share one run
+	last  *Result
+}
+
+// Service runs dependency checks for the liveness and readiness endpoints
+type Service struct {
+	timeout  time.Duration
+	cacheTTL time.Duration
+	entries  []*entry
+	draining atomic.Bool
+}
+
+// NewService creates a health service configured by HEALTH_CHECK_TIMEOUT and HEALTH_CACHE_TTL
+func NewService() (*Service, error) {
+	timeout := defaultTimeout
+	if value := os.Getenv("HEALTH_CHECK_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid HEALTH_CHECK_TIMEOUT: %q", value)
+		}
+		timeout = parsed
+	}
+
+	cacheTTL := defaultCacheTTL
+	if value := os.Getenv("HEALTH_CACHE_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid HEALTH_CACHE_TTL: %q", value)
+		}
+		cacheTTL = parsed
+	}
+
+	return &Service{timeout: timeout, cacheTTL: cacheTTL}, nil
+}
+
+// SetDraining makes readiness fail during a shutdown so no new traffic is routed here
+func (s *Service) SetDraining() {
+	s.draining.Store(true)
+}
+
+// Register adds a check to the service
+func (s *Service) Register(check Check) {
+	s.entries = append(s.entries, &entry{check: check})
+}
+
+// Run runs the checks concurrently and reports the overall status, which is ok only if every
+// check passed. Readiness runs all checks, liveness only the liveness checks.
+func (s *Service) Run(ctx context.Context, readiness bool) Report {
+	report := Report{Status: StatusOK, Checks: make(map[string]Result)}
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for _, e := range s.entries {
+		if !readiness && !e.check.Liveness {
+			continue
+		}
+		wg.Add(1)
+		go func(e *entry) {
+			defer wg.Done()
+			result := s.run(ctx, e)
+			mu.Lock()
+			defer mu.Unlock()
+			report.Checks[e.check.Name] = result
+			if result.Status != StatusOK {
+				report.Status = StatusError
+			}
+		}(e)
+	}
+	wg.Wait()
+	return report
+}
+
+// run runs a single check, reusing a recent result for cached checks
+func (s *Service) run(ctx context.Context, e *entry) Result {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.check.Cached && e.last != nil && time.Since(time.Unix(e.last.CheckedAt, 0)) < s.cacheTTL {
+		result := *e.last
+		result.Cached = true
+		return result
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	start := time.Now()
+	err := e.check.Run(ctx)
+	result := Result{
+		Status:    StatusOK,
+		LatencyMs: time.Since(start).Milliseconds(),
+		CheckedAt: start.Unix(),
+	}
+	if err != nil {
+		result.Status = StatusError
+		result.Error = err.Error()
+	}
+	e.last = &result
+	return result
+}
+
+// LivenessHandler serves /healthz, which only checks this instance
+func (s *Service) LivenessHandler() gin.HandlerFunc {
+	return s.handler(false)
+}
+
+// ReadinessHandler serves /readyz, which checks every dependency needed to serve requests
+func (s *Service) ReadinessHandler() gin.HandlerFunc {
+	return s.handler(true)
+}
+
+func (s *Service) handler(readiness bool) gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		report := s.Run(ctx.Request.Context(), readiness)
+		if readiness && s.draining.Load() {
+			report.Status = StatusDraining
+		}
+		code := http.StatusOK
+		if report.Status != StatusOK {
+			code = http.StatusServiceUnavailable
+		}
+		ctx.Header("Cache-Control", "no-store")
+		ctx.JSON(code, report)
+	}
+}
+
+// FirestoreCheck checks that Firestore can be reached by reading a document that needn't exist
+func FirestoreCheck(client *firestore.Client) Check {
+	return Check{
+		Name: "firestore",
+		Run: func(ctx context.Context) error {
+			_, err := client.Collection("health").Doc("probe").Get(ctx)
+			if err != nil && status.Code(err) != codes.NotFound {
+				return err
+			}
+			return nil
+		},
+	}
+}
+
+// DirWritableCheck checks that a file can be written to and removed from dir
+func DirWritableCheck(name, dir string) Check {
+	return Check{
+		Name:     name,
+		Liveness: true,
+		Run: func(ctx context.Context) error {
+			file, err := os.CreateTemp(dir, ".healthcheck-")
+			if err != nil {
+				return fmt.Errorf("%s is not writable: %v", dir, err)
+			}
+			_, err = file.WriteString("ok")
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if removeErr := os.Remove(file.Name()); err == nil {
+				err = removeErr
+			}
+			if err != nil {
+				return fmt.Errorf("%s is not writable: %v", dir, err)
+			}
+			return nil
+		},
+	}
+}
@@ -0,0 +1,243 @@
+package hub
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+
+	"github.com/martin226/slideitin/backend/api/services/queue"
+)
+
+// ErrJobNotFound is returned when subscribing to a job that doesn't exist or belongs to someone else
+var ErrJobNotFound = errors.New("job not found")
+
+// subscriberBuffer is how many updates a subscriber may fall behind before it is disconnected
+const subscriberBuffer = 64
+
+// topicHistory is how many recent updates a topic keeps to replay to new subscribers whose
+// snapshot is older than the topic's latest update
+const topicHistory = 64
+
+// Subscriber receives updates for the jobs it has subscribed to
+type Subscriber struct {
+	updates   chan queue.JobUpdate
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu   sync.Mutex
+	jobs map[string]struct{}
+}
+
+// NewSubscriber creates a subscriber with no subscriptions
+func NewSubscriber() *Subscriber {
+	return &Subscriber{
+		updates: make(chan queue.JobUpdate, subscriberBuffer),
+		done:    make(chan struct{}),
+		jobs:    make(map[string]struct{}),
+	}
+}
+
+// Updates returns the channel updates are delivered on
+func (s *Subscriber) Updates() <-chan queue.JobUpdate {
+	return s.updates
+}
+
+// Done is closed when the subscriber has been closed, for example because it fell too far behind
+func (s *Subscriber) Done() <-chan struct{} {
+	return s.done
+}
+
+// Close marks the subscriber as closed. Callers should also call Hub.UnsubscribeAll.
+func (s *Subscriber) Close() {
+	s.closeOnce.Do(func() { close(s.done) })
+}
+
+// Count returns the number of jobs the subscriber is subscribed to
+func (s *Subscriber) Count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.jobs)
+}
+
+// send delivers an update without blocking the hub, closing subscribers that can't keep up
+func (s *Subscriber) send(update queue.JobUpdate) {
+	select {
+	case s.updates <- update:
+	case <-s.done:
+	default:
+		slog.Warn("Subscriber fell behind, disconnecting it", "job_id", update.ID)
+		s.Close()
+	}
+}
+
+// topic is the shared watch of a single job
+type topic struct {
+	subscribers map[*Subscriber]int64 // Each subscriber's snapshot seq, older updates aren't sent to it
+	cancel      context.CancelFunc
+
+	// Updates broadcast so far, all of them after replayFrom
+	history    []queue.JobUpdate
+	replayFrom int64
+}
+
+// record adds a broadcast update to the history, dropping the oldest one when it's full
+func (t *topic) record(update queue.JobUpdate) {
+	if len(t.history) == topicHistory {
+		t.replayFrom = t.history[0].Seq
+		t.history = append(t.history[:0], t.history[1:]...)
+	}
+	t.history = append(t.history, update)
+}
+
+// Hub fans out job updates so that one Firestore listener per job serves every subscriber
+type Hub struct {
+	queueService *queue.Service
+
+	mu     sync.Mutex
+	topics map[string]*topic
+}
+
+// NewHub creates a new hub
+func NewHub(queueService *queue.Service) *Hub {
+	return &Hub{
+		queueService: queueService,
+		topics:       make(map[string]*topic),
+	}
+}
+
+// Subscribe sends the job's current state to the subscriber and then every later update until
+// the job finishes or the subscriber unsubscribes
+func (h *Hub) Subscribe(sub *Subscriber, jobID, ownerID string) error {
+	for {
+		// Check the subscriber may read the job before sharing a listener with them
+		job := h.queueService.GetJob(jobID, ownerID)
+		if job == nil {
+			return ErrJobNotFound
+		}
+		if job.Finished() {
+			sub.send(job.Snapshot())
+			return nil
+		}
+		if h.subscribe(sub, job) {
+			return nil
+		}
+		// Too many updates were broadcast since the job was read to replay them, so read it again
+	}
+}
+
+// subscribe registers the subscriber with the job's topic and sends it the job's snapshot followed
+// by any updates the topic broadcast after the snapshot was read. It returns false without
+// subscribing if those updates are no longer in the topic's history.
+func (h *Hub) subscribe(sub *Subscriber, job *queue.Job) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	t, ok := h.topics[job.ID]
+	if !ok {
+		// Start the shared listener after the event the snapshot reflects
+		ctx, cancel := context.WithCancel(context.Background())
+		t = &topic{
+			subscribers: make(map[*Subscriber]int64),
+			cancel:      cancel,
+			replayFrom:  job.EventSeq,
+		}
+		h.topics[job.ID] = t
+		go h.watch(ctx, t, job.ID, job.OwnerID, job.EventSeq)
+	} else if job.EventSeq < t.replayFrom {
+		return false
+	}
+
+	// Holding h.mu keeps broadcasts out until the subscriber has caught up
+	sub.send(job.Snapshot())
+	seen := job.EventSeq
+	for _, update := range t.history {
+		if update.Seq > seen {
+			sub.send(update)
+			seen = update.Seq
+		}
+	}
+	t.subscribers[sub] = seen
+
+	sub.mu.Lock()
+	sub.jobs[job.ID] = struct{}{}
+	sub.mu.Unlock()
+	return true
+}
+
+// Unsubscribe stops sending a job's updates to the subscriber
+func (h *Hub) Unsubscribe(sub *Subscriber, jobID string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.unsubscribeLocked(sub, jobID)
+}
+
+// UnsubscribeAll removes every subscription of a subscriber
+func (h *Hub) UnsubscribeAll(sub *Subscriber) {
+	sub.mu.Lock()
+	jobIDs := make([]string, 0, len(sub.jobs))
+	for jobID := range sub.jobs {
+		jobIDs = append(jobIDs, jobID)
+	}
+	sub.mu.Unlock()
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, jobID := range jobIDs {
+		h.unsubscribeLocked(sub, jobID)
+	}
+}
+
+// unsubscribeLocked removes a subscription, stopping the job's listener when nobody is left.
+// h.mu must be held.
+func (h *Hub) unsubscribeLocked(sub *Subscriber, jobID string) {
+	sub.mu.Lock()
+	delete(sub.jobs, jobID)
+	sub.mu.Unlock()
+
+	t, ok := h.topics[jobID]
+	if !ok {
+		return
+	}
+	delete(t.subscribers, sub)
+	if len(t.subscribers) == 0 {
+		t.cancel()
+		delete(h.topics, jobID)
+	}
+}
+
+// watch runs the shared listener for a job and broadcasts its updates until the job finishes
+func (h *Hub) watch(ctx context.Context, t *topic, jobID, ownerID string, afterSeq int64) {
+	updates := make(chan queue.JobUpdate, 16)
+	go func() {
+		defer close(updates)
+		if err := h.queueService.WatchJob(ctx, jobID, ownerID, afterSeq, updates); err != nil && !errors.Is(err, context.Canceled) {
+			slog.ErrorContext(ctx, "Error watching job for subscribers", "job_id", jobID, "error", err)
+		}
+	}()
+
+	for update := range updates {
+		h.mu.Lock()
+		t.record(update)
+		for sub, seen := range t.subscribers {
+			// Subscribers whose snapshot is newer than the update already have its state
+			if update.Seq > seen {
+				sub.send(update)
+			}
+		}
+		h.mu.Unlock()
+	}
+
+	// The job finished or the watch failed, so drop the topic and its subscriptions
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.topics[jobID] == t {
+		delete(h.topics, jobID)
+	}
+	for sub := range t.subscribers {
+		sub.mu.Lock()
+		delete(sub.jobs, jobID)
+		sub.mu.Unlock()
+	}
+	t.cancel()
+}
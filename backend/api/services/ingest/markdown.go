@@ -0,0 +1,342 @@
+package ingest
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/atom"
+)
+
+// skippedElements never contain readable article content
+var skippedElements = map[atom.Atom]bool{
+	atom.Script:   true,
+	atom.Style:    true,
+	atom.Noscript: true,
+	atom.Nav:      true,
+	atom.Header:   true,
+	atom.Footer:   true,
+	atom.Aside:    true,
+	atom.Form:     true,
+	atom.Iframe:   true,
+	atom.Svg:      true,
+	atom.Button:   true,
+	atom.Template: true,
+	atom.Img:      true,
+}
+
+var (
+	whitespaceRun = regexp.MustCompile(`[ \t\r\n]+`)
+	blankLineRun  = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToMarkdown extracts the readable content of an HTML page and converts it to markdown
+func htmlToMarkdown(data []byte, base *url.URL) (string, error) {
+	doc, err := html.Parse(bytes.NewReader(data))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse HTML: %v", err)
+	}
+
+	root := findContentRoot(doc)
+	if root == nil {
+		return "", fmt.Errorf("no readable content found")
+	}
+
+	c := &markdownConverter{base: base}
+	c.convertChildren(root)
+	body := c.String()
+
+	// Use the page title as a heading when the article doesn't provide its own
+	if !strings.HasPrefix(body, "# ") {
+		if title := findTitle(doc); title != "" {
+			body = "# " + title + "\n\n" + body
+		}
+	}
+	return body, nil
+}
+
+// findContentRoot picks the element most likely to contain the article body
+func findContentRoot(doc *html.Node) *html.Node {
+	if n := findFirst(doc, func(n *html.Node) bool { return n.DataAtom == atom.Article }); n != nil {
+		return n
+	}
+	if n := findFirst(doc, func(n *html.Node) bool {
+		return n.DataAtom == atom.Main || attr(n, "role") == "main"
+	}); n != nil {
+		return n
+	}
+	return findFirst(doc, func(n *html.Node) bool { return n.DataAtom == atom.Body })
+}
+
+// findTitle returns the text of the document's <title> element
+func findTitle(doc *html.Node) string {
+	n := findFirst(doc, func(n *html.Node) bool { return n.DataAtom == atom.Title })
+	if n == nil {
+		return ""
+	}
+	return strings.TrimSpace(whitespaceRun.ReplaceAllString(textContent(n), " "))
+}
+
+// findFirst performs a depth-first search for the first element matching the predicate
+func findFirst(n *html.Node, match func(*html.Node) bool) *html.Node {
+	if n.Type == html.ElementNode && match(n) {
+		return n
+	}
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		if found := findFirst(child, match); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// attr returns the value of the named attribute, or an empty string
+func attr(n *html.Node, name string) string {
+	for _, a := range n.Attr {
+		if a.Key == name {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// textContent returns the concatenated text of a node and its descendants
+func textContent(n *html.Node) string {
+	var sb strings.Builder
+	var walk func(*html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			sb.WriteString(n.Data)
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(n)
+	return sb.String()
+}
+
+// markdownConverter walks an HTML tree and writes a markdown rendering of it
+type markdownConverter struct {
+	sb        strings.Builder
+	base      *url.URL
+	listStack []int // -1 for unordered lists, otherwise the next ordered item number
+}
+
+// String returns the converted markdown with normalized blank lines
+func (c *markdownConverter) String() string {
+	lines := strings.Split(c.sb.String(), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t")
+	}
+	out := blankLineRun.ReplaceAllString(strings.Join(lines, "\n"), "\n\n")
+	return strings.TrimSpace(out) + "\n"
+}
+
+// block ensures the next output starts on a fresh paragraph
+func (c *markdownConverter) block() {
+	c.sb.WriteString("\n\n")
+}
+
+func (c *markdownConverter) convertChildren(n *html.Node) {
+	for child := n.FirstChild; child != nil; child = child.NextSibling {
+		c.convert(child)
+	}
+}
+
+func (c *markdownConverter) convert(n *html.Node) {
+	switch n.Type {
+	case html.TextNode:
+		c.sb.WriteString(whitespaceRun.ReplaceAllString(n.Data, " "))
+		return
+	case html.ElementNode:
+	default:
+		c.convertChildren(n)
+		return
+	}
+
+	if skippedElements[n.DataAtom] || attr(n, "hidden") != "" || attr(n, "aria-hidden") == "true" {
+		return
+	}
+
+	switch n.DataAtom {
+	case atom.H1, atom.H2, atom.H3, atom.H4, atom.H5, atom.H6:
+		level := int(n.Data[1] - '0')
+		text := strings.TrimSpace(whitespaceRun.ReplaceAllString(textContent(n), " "))
+		if text != "" {
+			c.block()
+			c.sb.WriteString(strings.Repeat("#", level) + " " + text)
+			c.block()
+		}
+	case atom.P, atom.Div, atom.Section, atom.Figure, atom.Figcaption, atom.Dl, atom.Dt, atom.Dd:
+		c.block()
+		c.convertChildren(n)
+		c.block()
+	case atom.Br:
+		c.sb.WriteString("\n")
+	case atom.Hr:
+		c.block()
+		c.sb.WriteString("***")
+		c.block()
+	case atom.Ul, atom.Ol:
+		start := -1
+		if n.DataAtom == atom.Ol {
+			start = 1
+		}
+		c.listStack = append(c.listStack, start)
+		if len(c.listStack) == 1 {
+			c.block()
+		}
+		c.convertChildren(n)
+		c.listStack = c.listStack[:len(c.listStack)-1]
+		if len(c.listStack) == 0 {
+			c.block()
+		}
+	case atom.Li:
+		c.writeListItem(n)
+	case atom.Pre:
+		c.block()
+		c.sb.WriteString("```\n")
+		c.sb.WriteString(strings.Trim(textContent(n), "\n"))
+		c.sb.WriteString("\n```")
+		c.block()
+	case atom.Code:
+		if text := textContent(n); strings.TrimSpace(text) != "" {
+			c.sb.WriteString("`" + strings.ReplaceAll(text, "`", "'") + "`")
+		}
+	case atom.Strong, atom.B:
+		c.wrapInline(n, "**")
+	case atom.Em, atom.I:
+		c.wrapInline(n, "*")
+	case atom.A:
+		c.writeLink(n)
+	case atom.Blockquote:
+		inner := &markdownConverter{base: c.base}
+		inner.convertChildren(n)
+		c.block()
+		for _, line := range strings.Split(strings.TrimSpace(inner.String()), "\n") {
+			c.sb.WriteString("> " + line + "\n")
+		}
+		c.block()
+	case atom.Table:
+		c.writeTable(n)
+	default:
+		c.convertChildren(n)
+	}
+}
+
+// wrapInline surrounds the inline content of a node with a markdown marker
+func (c *markdownConverter) wrapInline(n *html.Node, marker string) {
+	inner := &markdownConverter{base: c.base}
+	inner.convertChildren(n)
+	text := strings.TrimSpace(inner.sb.String())
+	if text == "" {
+		return
+	}
+	c.sb.WriteString(marker + text + marker)
+}
+
+// writeLink renders an anchor as a markdown link, resolving relative URLs against the page
+func (c *markdownConverter) writeLink(n *html.Node) {
+	inner := &markdownConverter{base: c.base}
+	inner.convertChildren(n)
+	text := strings.TrimSpace(inner.sb.String())
+	if text == "" {
+		return
+	}
+
+	href, err := url.Parse(attr(n, "href"))
+	if err != nil || attr(n, "href") == "" {
+		c.sb.WriteString(text)
+		return
+	}
+	if c.base != nil {
+		href = c.base.ResolveReference(href)
+	}
+	if href.Scheme != "http" && href.Scheme != "https" {
+		c.sb.WriteString(text)
+		return
+	}
+	c.sb.WriteString("[" + text + "](" + href.String() + ")")
+}
+
+// writeListItem renders a list item with the bullet style and indentation of its list
+func (c *markdownConverter) writeListItem(n *html.Node) {
+	depth := len(c.listStack)
+	marker := "- "
+	if depth > 0 && c.listStack[depth-1] > 0 {
+		marker = fmt.Sprintf("%d. ", c.listStack[depth-1])
+		c.listStack[depth-1]++
+	}
+	indent := ""
+	if depth > 1 {
+		indent = strings.Repeat("  ", depth-1)
+	}
+
+	inner := &markdownConverter{base: c.base, listStack: c.listStack}
+	inner.convertChildren(n)
+	lines := strings.Split(strings.TrimSpace(inner.String()), "\n")
+
+	c.sb.WriteString("\n" + indent + marker + strings.TrimSpace(lines[0]))
+	for _, line := range lines[1:] {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		// Nested list lines already carry their own indentation
+		if strings.HasPrefix(line, "  ") || strings.HasPrefix(strings.TrimSpace(line), "- ") {
+			c.sb.WriteString("\n" + line)
+		} else {
+			c.sb.WriteString("\n" + indent + "  " + line)
+		}
+	}
+}
+
+// writeTable renders a table as a markdown pipe table, treating the first row as the header
+func (c *markdownConverter) writeTable(n *html.Node) {
+	rows := make([][]string, 0)
+	var collect func(*html.Node)
+	collect = func(node *html.Node) {
+		if node.Type == html.ElementNode && node.DataAtom == atom.Tr {
+			cells := make([]string, 0)
+			for cell := node.FirstChild; cell != nil; cell = cell.NextSibling {
+				if cell.DataAtom == atom.Td || cell.DataAtom == atom.Th {
+					text := strings.TrimSpace(whitespaceRun.ReplaceAllString(textContent(cell), " "))
+					cells = append(cells, strings.ReplaceAll(text, "|", "\\|"))
+				}
+			}
+			if len(cells) > 0 {
+				rows = append(rows, cells)
+			}
+			return
+		}
+		for child := node.FirstChild; child != nil; child = child.NextSibling {
+			collect(child)
+		}
+	}
+	collect(n)
+	if len(rows) == 0 {
+		return
+	}
+
+	columns := 0
+	for _, row := range rows {
+		if len(row) > columns {
+			columns = len(row)
+		}
+	}
+
+	c.block()
+	for i, row := range rows {
+		for len(row) < columns {
+			row = append(row, "")
+		}
+		c.sb.WriteString("| " + strings.Join(row, " | ") + " |\n")
+		if i == 0 {
+			c.sb.WriteString("|" + strings.Repeat(" --- |", columns) + "\n")
+		}
+	}
+	c.block()
+}
@@ -0,0 +1,262 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/martin226/slideitin/backend/api/models"
+)
+
+// Default limits applied when the corresponding environment variables are not set
+const (
+	defaultMaxBytes = 5 << 20 // 5 MB per URL
+	defaultTimeout  = 15 * time.Second
+	defaultMaxURLs  = 5
+	maxRedirects    = 5
+)
+
+var (
+	// ErrDisabled is returned when URL ingestion has not been configured
+	ErrDisabled = errors.New("URL ingestion is not enabled on this server")
+	// ErrNotAllowed is returned when a URL's host is not in the allowlist
+	ErrNotAllowed = errors.New("URL host is not in the allowlist")
+	// ErrInvalidURL is returned when a URL can't be parsed
+	ErrInvalidURL = errors.New("invalid URL")
+	// ErrUnsupportedScheme is returned when a URL is not http or https
+	ErrUnsupportedScheme = errors.New("unsupported URL scheme")
+	// ErrTooManyURLs is returned when a request has more URLs than the configured maximum
+	ErrTooManyURLs = errors.New("too many URLs")
+	// ErrNoContent is returned when a fetched page has no readable content
+	ErrNoContent = errors.New("no readable content found")
+	// ErrTooLarge is returned when a fetched document exceeds the size limit
+	ErrTooLarge = errors.New("document exceeds the maximum allowed size")
+	// ErrUnsupportedContent is returned when the fetched document cannot be converted
+	ErrUnsupportedContent = errors.New("unsupported content type")
+)
+
+// Service fetches remote documents and converts them into files for the slide pipeline
+type Service struct {
+	allowlist  []string
+	maxBytes   int64
+	maxURLs    int
+	httpClient *http.Client
+}
+
+// NewService creates a new URL ingestion service configured from environment variables
+func NewService() (*Service, error) {
+	allowlist := make([]string, 0)
+	for _, host := range strings.Split(os.Getenv("URL_FETCH_ALLOWLIST"), ",") {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host != "" {
+			allowlist = append(allowlist, host)
+		}
+	}
+	if len(allowlist) == 0 {
+		slog.Warn("URL_FETCH_ALLOWLIST not set, URL ingestion is disabled")
+	}
+
+	maxBytes := int64(defaultMaxBytes)
+	if value := os.Getenv("URL_FETCH_MAX_BYTES"); value != "" {
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid URL_FETCH_MAX_BYTES: %q", value)
+		}
+		maxBytes = parsed
+	}
+
+	timeout := defaultTimeout
+	if value := os.Getenv("URL_FETCH_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid URL_FETCH_TIMEOUT: %q", value)
+		}
+		timeout = parsed
+	}
+
+	maxURLs := defaultMaxURLs
+	if value := os.Getenv("URL_FETCH_MAX_URLS"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid URL_FETCH_MAX_URLS: %q", value)
+		}
+		maxURLs = parsed
+	}
+
+	s := &Service{
+		allowlist: allowlist,
+		maxBytes:  maxBytes,
+		maxURLs:   maxURLs,
+	}
+	s.httpClient = &http.Client{
+		Timeout: timeout,
+		// Re-check the allowlist on every redirect so an allowed host can't bounce us elsewhere
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return fmt.Errorf("stopped after %d redirects", maxRedirects)
+			}
+			return s.checkURL(req.URL)
+		},
+	}
+	return s, nil
+}
+
+// MaxURLs returns the maximum number of URLs accepted in a single request
+func (s *Service) MaxURLs() int {
+	return s.maxURLs
+}
+
+// checkURL validates the scheme and host of a URL against the allowlist
+func (s *Service) checkURL(u *url.URL) error {
+	if len(s.allowlist) == 0 {
+		return ErrDisabled
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("%w: %s", ErrUnsupportedScheme, u.Scheme)
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, allowed := range s.allowlist {
+		// Entries like "*.example.com" allow any subdomain of example.com
+		if strings.HasPrefix(allowed, "*.") {
+			if strings.HasSuffix(host, allowed[1:]) {
+				return nil
+			}
+			continue
+		}
+		if host == allowed {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s", ErrNotAllowed, host)
+}
+
+// FetchFiles fetches each URL and converts it into a file for the slide pipeline
+func (s *Service) FetchFiles(ctx context.Context, rawURLs []string) ([]models.File, error) {
+	if len(rawURLs) > s.maxURLs {
+		return nil, fmt.Errorf("%w: %d (maximum is %d)", ErrTooManyURLs, len(rawURLs), s.maxURLs)
+	}
+
+	files := make([]models.File, 0, len(rawURLs))
+	for i, rawURL := range rawURLs {
+		file, err := s.FetchFile(ctx, rawURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch %s: %w", rawURL, err)
+		}
+		// Prefix with the index so two URLs with the same path don't collide on disk
+		file.Filename = fmt.Sprintf("url-%d-%s", i+1, file.Filename)
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// FetchFile downloads a single URL and converts its readable content to markdown
+func (s *Service) FetchFile(ctx context.Context, rawURL string) (models.File, error) {
+	u, err := url.Parse(strings.TrimSpace(rawURL))
+	if err != nil {
+		return models.File{}, fmt.Errorf("%w: %v", ErrInvalidURL, err)
+	}
+	if err := s.checkURL(u); err != nil {
+		return models.File{}, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return models.File{}, fmt.Errorf("failed to create http request: %v", err)
+	}
+	req.Header.Set("Accept", "text/html, text/markdown, text/plain, application/pdf;q=0.9")
+	req.Header.Set("User-Agent", "SlideItIn-Fetcher/1.0")
+
+	// Only the host is logged, paths and query strings can carry tokens or document names
+	slog.InfoContext(ctx, "Fetching document", "host", u.Host)
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return models.File{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return models.File{}, fmt.Errorf("server returned status %d", resp.StatusCode)
+	}
+	if resp.ContentLength > s.maxBytes {
+		return models.File{}, ErrTooLarge
+	}
+
+	// Read one byte past the limit so we can tell a truncated body from an exact fit
+	data, err := io.ReadAll(io.LimitReader(resp.Body, s.maxBytes+1))
+	if err != nil {
+		return models.File{}, fmt.Errorf("failed to read response body: %v", err)
+	}
+	if int64(len(data)) > s.maxBytes {
+		return models.File{}, ErrTooLarge
+	}
+
+	mimeType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if err != nil || mimeType == "" || mimeType == "application/octet-stream" {
+		mimeType, _, _ = mime.ParseMediaType(http.DetectContentType(data))
+	}
+
+	// Use the final URL after redirects for naming and resolving relative links
+	finalURL := resp.Request.URL
+	baseName := filenameFromURL(finalURL)
+
+	switch {
+	case mimeType == "text/html" || mimeType == "application/xhtml+xml":
+		markdown, err := htmlToMarkdown(data, finalURL)
+		if err != nil {
+			return models.File{}, err
+		}
+		if strings.TrimSpace(markdown) == "" {
+			return models.File{}, ErrNoContent
+		}
+		return models.File{
+			Filename: baseName + ".md",
+			Data:     []byte(markdown),
+			Type:     "text/plain",
+		}, nil
+	case mimeType == "application/pdf":
+		return models.File{
+			Filename: baseName + ".pdf",
+			Data:     data,
+			Type:     "application/pdf",
+		}, nil
+	case strings.HasPrefix(mimeType, "text/"):
+		// Plain text and markdown are passed through unchanged
+		return models.File{
+			Filename: baseName + ".md",
+			Data:     data,
+			Type:     "text/plain",
+		}, nil
+	default:
+		return models.File{}, fmt.Errorf("%w: %s", ErrUnsupportedContent, mimeType)
+	}
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]+`)
+
+// filenameFromURL derives a safe file name from the host and last path segment of a URL
+func filenameFromURL(u *url.URL) string {
+	name := u.Hostname()
+	if base := path.Base(u.Path); base != "/" && base != "." {
+		name += "-" + strings.TrimSuffix(base, path.Ext(base))
+	}
+	name = strings.Trim(unsafeFilenameChars.ReplaceAllString(name, "-"), "-.")
+	if len(name) > 80 {
+		name = name[:80]
+	}
+	if name == "" {
+		name = "document"
+	}
+	return name
+}
@@ -0,0 +1,84 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Setup installs the default structured logger, configured from environment variables.
+//
+// LOG_LEVEL is debug, info (the default), warn or error and LOG_FORMAT is json (the default) or
+// text. Anything still written through the standard log package goes through the same handler.
+func Setup(service string) error {
+	var level slog.Level
+	if value := os.Getenv("LOG_LEVEL"); value != "" {
+		if err := level.UnmarshalText([]byte(value)); err != nil {
+			return fmt.Errorf("invalid LOG_LEVEL: %q", value)
+		}
+	}
+
+	options := &slog.HandlerOptions{Level: level}
+	var handler slog.Handler
+	switch format := strings.ToLower(os.Getenv("LOG_FORMAT")); format {
+	case "", "json":
+		handler = slog.NewJSONHandler(os.Stderr, options)
+	case "text":
+		handler = slog.NewTextHandler(os.Stderr, options)
+	default:
+		return fmt.Errorf("invalid LOG_FORMAT: %q", format)
+	}
+
+	slog.SetDefault(slog.New(&contextHandler{Handler: handler}).With("service", service))
+	return nil
+}
+
+// Fatal logs an error and exits
+func Fatal(msg string, args ...any) {
+	slog.Error(msg, args...)
+	os.Exit(1)
+}
+
+// jobKey is the context key for the job a request or goroutine is working on
+type jobKey struct{}
+
+// jobFields are added to every record logged with a context carrying them
+type jobFields struct {
+	jobID   string
+	ownerID string
+}
+
+// WithJob returns ctx tagged with a job, so records logged with it carry job_id and tenant fields
+func WithJob(ctx context.Context, jobID, ownerID string) context.Context {
+	return context.WithValue(ctx, jobKey{}, jobFields{jobID: jobID, ownerID: ownerID})
+}
+
+// contextHandler adds the job and trace from the context to each record
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h *contextHandler) Handle(ctx context.Context, record slog.Record) error {
+	if fields, ok := ctx.Value(jobKey{}).(jobFields); ok {
+		record.AddAttrs(slog.String("job_id", fields.jobID))
+		if fields.ownerID != "" {
+			record.AddAttrs(slog.String("tenant", fields.ownerID))
+		}
+	}
+	if spanContext := trace.SpanContextFromContext(ctx); spanContext.HasTraceID() {
+		record.AddAttrs(slog.String("trace_id", spanContext.TraceID().String()))
+	}
+	return h.Handler.Handle(ctx, record)
+}
+
+func (h *contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithAttrs(attrs)}
+}
+
+func (h *contextHandler) WithGroup(name string) slog.Handler {
+	return &contextHandler{Handler: h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,309 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/martin226/slideitin/backend/api/models"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Cache outcomes reported on jobs
+const (
+	CacheHit     = "hit"
+	CacheMiss    = "miss"
+	CacheSkipped = "skipped" // The request set noCache, the cache is disabled or it couldn't be checked
+)
+
+const (
+	// How long the slides-service's model and prompt version are trusted before asking again
+	generatorRefreshInterval = time.Minute
+	generatorFetchTimeout    = 5 * time.Second
+	// Bumped whenever the key is computed differently, so old entries are never matched
+	cacheKeyVersion = "2"
+	cachedMessage   = "Slides generated successfully (reused a cached result)"
+)
+
+// FirestoreCacheEntry points a cache key at the job whose result is reused for it
+type FirestoreCacheEntry struct {
+	Key           string `firestore:"key"`
+	JobID         string `firestore:"jobId"`
+	Model         string `firestore:"model"`
+	PromptVersion string `firestore:"promptVersion"`
+	CreatedAt     int64  `firestore:"createdAt"`
+	ExpiresAt     int64  `firestore:"expiresAt"` // Same as the result's, 0 means it's kept forever
+}
+
+// generator identifies the model and prompts the slides-service generates decks with
+type generator struct {
+	Model         string `json:"model"`
+	PromptVersion string `json:"promptVersion"`
+}
+
+// resultCache reuses the results of earlier jobs for identical input
+type resultCache struct {
+	enabled bool
+
+	mu        sync.Mutex
+	current   generator
+	fetchedAt time.Time
+}
+
+// loadResultCache reads RESULT_CACHE_ENABLED, which defaults to true
+func loadResultCache() (*resultCache, error) {
+	cache := &resultCache{enabled: true}
+	if value := os.Getenv("RESULT_CACHE_ENABLED"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RESULT_CACHE_ENABLED: %q", value)
+		}
+		cache.enabled = enabled
+	}
+	return cache, nil
+}
+
+// CacheCollection returns the Firestore collection reference for cached results
+func (s *Service) CacheCollection() *firestore.CollectionRef {
+	return s.client.Collection("resultCache")
+}
+
+// cacheKey hashes everything that determines a generated deck: the content and type of each input
+// file in order, the theme, the settings, the model and the prompt version. The owner is included
+// so results are only ever reused for the caller that generated them.
+func cacheKey(ownerID, theme string, files []models.File, settings models.SlideSettings, gen generator) string {
+	// Debug only changes what is logged
+	settings.Debug = false
+	settingsJSON, _ := json.Marshal(settings)
+
+	h := sha256.New()
+	for _, field := range []string{cacheKeyVersion, ownerID, theme, string(settingsJSON), gen.Model, gen.PromptVersion} {
+		writeField(h, []byte(field))
+	}
+	for _, file := range files {
+		writeField(h, []byte(file.Type))
+		writeField(h, file.Data)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// writeField writes a length-prefixed field so adjacent fields can't run into each other
+func writeField(h hash.Hash, data []byte) {
+	binary.Write(h, binary.BigEndian, uint64(len(data)))
+	h.Write(data)
+}
+
+// generator returns the model and prompt version the slides-service currently generates with,
+// asking it again once generatorRefreshInterval has passed
+func (s *Service) generator(ctx context.Context) (generator, error) {
+	s.cache.mu.Lock()
+	defer s.cache.mu.Unlock()
+	if s.cache.current.Model != "" && time.Since(s.cache.fetchedAt) < generatorRefreshInterval {
+		return s.cache.current, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, generatorFetchTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.serviceURL+"/tasks/generator", nil)
+	if err != nil {
+		return generator{}, err
+	}
+	resp, err := s.httpClient.Do(req)
+	if err != nil {
+		return generator{}, fmt.Errorf("failed to reach slides service: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return generator{}, fmt.Errorf("slides service returned status %d", resp.StatusCode)
+	}
+
+	var gen generator
+	if err := json.NewDecoder(resp.Body).Decode(&gen); err != nil || gen.Model == "" {
+		return generator{}, fmt.Errorf("invalid generator response: %v", err)
+	}
+	s.cache.current = gen
+	s.cache.fetchedAt = time.Now()
+	return gen, nil
+}
+
+// cachedResult returns the result cached under key, or nil if there is none or it has expired.
+// Entries whose result has gone, e.g. because it expired or was downloaded once, are removed.
+func (s *Service) cachedResult(ctx context.Context, key string) (*FirestoreResult, error) {
+	entryRef := s.CacheCollection().Doc(key)
+	doc, err := entryRef.Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("error retrieving cache entry: %v", err)
+	}
+	var entry FirestoreCacheEntry
+	if err := doc.DataTo(&entry); err != nil {
+		return nil, fmt.Errorf("error parsing cache entry: %v", err)
+	}
+
+	now := time.Now().Unix()
+	if entry.ExpiresAt == 0 || now <= entry.ExpiresAt {
+		resultDoc, err := s.ResultsCollection().Doc(entry.JobID).Get(ctx)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return nil, fmt.Errorf("error retrieving cached result: %v", err)
+		}
+		if err == nil {
+			var result FirestoreResult
+			if err := resultDoc.DataTo(&result); err != nil {
+				return nil, fmt.Errorf("error parsing cached result: %v", err)
+			}
+			if result.ExpiresAt == 0 || now <= result.ExpiresAt {
+				return &result, nil
+			}
+		}
+	}
+
+	if _, err := entryRef.Delete(ctx); err != nil {
+		slog.WarnContext(ctx, "Failed to delete stale cache entry", "key", key, "error", err)
+	}
+	return nil, nil
+}
+
+// reuseCachedResult completes job with the cached result of an identical earlier job, if there is
+// one, and returns the job's cache outcome. Failing to check the cache only means the deck is
+// generated again.
+func (s *Service) reuseCachedResult(ctx context.Context, job *Job) string {
+	gen, err := s.generator(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to get slides service generator, skipping cache", "error", err)
+		return CacheSkipped
+	}
+	key := cacheKey(job.OwnerID, job.Theme, job.Files, job.Settings, gen)
+	source, err := s.cachedResult(ctx, key)
+	if err != nil {
+		slog.WarnContext(ctx, "Failed to look up cached result", "error", err)
+		return CacheSkipped
+	}
+	if source == nil {
+		return CacheMiss
+	}
+
+	if err := s.copyCachedResult(ctx, job, source); err != nil {
+		slog.ErrorContext(ctx, "Failed to reuse cached result", "source_job_id", source.ID, "error", err)
+		return CacheSkipped
+	}
+	slog.InfoContext(ctx, "Reused cached result", "source_job_id", source.ID)
+
+	// The copy may outlive the result it was made from
+	if err := s.storeCacheEntry(ctx, key, job.ID, gen); err != nil {
+		slog.WarnContext(ctx, "Failed to update cache entry", "error", err)
+	}
+	return CacheHit
+}
+
+// copyCachedResult stores a copy of a cached result and its images as the result of job, kept
+// according to the job owner's retention policy, and marks the job as completed
+func (s *Service) copyCachedResult(ctx context.Context, job *Job, source *FirestoreResult) error {
+	images, err := s.GetResultImages(ctx, source.ID)
+	if err != nil {
+		return err
+	}
+
+	retention := s.RetentionPolicy(job.OwnerID)
+	now := time.Now().Unix()
+	var expiresAt int64
+	if !retention.KeepForever {
+		expiresAt = now + retention.ResultTTL
+	}
+
+	// Image URLs in the HTML are relative paths that start with the job ID
+	resultRef := s.ResultsCollection().Doc(job.ID)
+	result := FirestoreResult{
+		ID:                  job.ID,
+		OwnerID:             job.OwnerID,
+		ResultURL:           "/results/" + job.ID,
+		PDFData:             source.PDFData,
+		HTMLData:            bytes.ReplaceAll(source.HTMLData, []byte(source.ID+"/images/"), []byte(job.ID+"/images/")),
+		CreatedAt:           now,
+		ExpiresAt:           expiresAt,
+		DeleteAfterDownload: retention.DeleteAfterDownload,
+	}
+	if _, err := resultRef.Set(ctx, result); err != nil {
+		return fmt.Errorf("failed to store result: %v", err)
+	}
+	for _, image := range images {
+		image.OwnerID = job.OwnerID
+		image.CreatedAt = now
+		image.ExpiresAt = expiresAt
+		if _, err := resultRef.Collection("images").Doc(image.ID).Set(ctx, image); err != nil {
+			return fmt.Errorf("failed to store image %s: %v", image.ID, err)
+		}
+	}
+
+	jobExpiresAt := now + retention.JobTTL
+	if _, err := s.updateJobStateIf(ctx, job.ID, StatusCompleted, cachedMessage,
+		&JobProgress{Stage: StageCompleted, Percent: 100}, nil,
+		firestore.Update{Path: "expiresAt", Value: jobExpiresAt},
+		firestore.Update{Path: "cache", Value: CacheHit}); err != nil {
+		return fmt.Errorf("failed to complete job: %v", err)
+	}
+
+	job.Status = StatusCompleted
+	job.Message = cachedMessage
+	job.UpdatedAt = now
+	job.ResultURL = result.ResultURL
+	job.ResultExpiresAt = expiresAt
+	job.Progress = &JobProgress{Stage: StageCompleted, Percent: 100}
+	return nil
+}
+
+// storeCacheEntry points key at a job's result so later jobs with the same input reuse it. Results
+// deleted on their first download are left out, as they'd be gone before they could be reused.
+func (s *Service) storeCacheEntry(ctx context.Context, key, jobID string, gen generator) error {
+	doc, err := s.ResultsCollection().Doc(jobID).Get(ctx)
+	if err != nil {
+		return fmt.Errorf("error retrieving result: %v", err)
+	}
+	var result FirestoreResult
+	if err := doc.DataTo(&result); err != nil {
+		return fmt.Errorf("error parsing result data: %v", err)
+	}
+	if result.DeleteAfterDownload {
+		return nil
+	}
+
+	entryRef := s.CacheCollection().Doc(key)
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// Keep whichever result stays around longer
+		doc, err := tx.Get(entryRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			var existing FirestoreCacheEntry
+			if err := doc.DataTo(&existing); err != nil {
+				return err
+			}
+			if existing.ExpiresAt == 0 || (result.ExpiresAt != 0 && existing.ExpiresAt >= result.ExpiresAt) {
+				return nil
+			}
+		}
+		return tx.Set(entryRef, FirestoreCacheEntry{
+			Key:           key,
+			JobID:         jobID,
+			Model:         gen.Model,
+			PromptVersion: gen.PromptVersion,
+			CreatedAt:     time.Now().Unix(),
+			ExpiresAt:     result.ExpiresAt,
+		})
+	})
+}
@@ -0,0 +1,88 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/martin226/slideitin/backend/api/models"
+)
+
+func TestCacheKey(t *testing.T) {
+	gen := generator{Model: "gemini", PromptVersion: "v1"}
+	files := []models.File{{Filename: "notes.md", Type: "text/markdown", Data: []byte("# Notes")}}
+	settings := models.SlideSettings{SlideDetail: "medium", Audience: "general"}
+	base := cacheKey("owner-1", "default", files, settings, gen)
+
+	debug := settings
+	debug.Debug = true
+	renamed := []models.File{{Filename: "other.md", Type: "text/markdown", Data: []byte("# Notes")}}
+
+	tests := []struct {
+		name string
+		key  string
+		same bool
+	}{
+		{name: "identical input", key: cacheKey("owner-1", "default", files, settings, gen), same: true},
+		{name: "debug setting", key: cacheKey("owner-1", "default", files, debug, gen), same: true},
+		{name: "file name", key: cacheKey("owner-1", "default", renamed, settings, gen), same: true},
+		{name: "other owner", key: cacheKey("owner-2", "default", files, settings, gen)},
+		{name: "anonymous owner", key: cacheKey("", "default", files, settings, gen)},
+		{name: "other theme", key: cacheKey("owner-1", "gaia", files, settings, gen)},
+		{name: "other settings", key: cacheKey("owner-1", "default", files, models.SlideSettings{SlideDetail: "high", Audience: "general"}, gen)},
+		{name: "other model", key: cacheKey("owner-1", "default", files, settings, generator{Model: "gemini-2", PromptVersion: "v1"})},
+		{name: "other prompt version", key: cacheKey("owner-1", "default", files, settings, generator{Model: "gemini", PromptVersion: "v2"})},
+		{name: "other file data", key: cacheKey("owner-1", "default", []models.File{{Type: "text/markdown", Data: []byte("# Other")}}, settings, gen)},
+		{name: "other file type", key: cacheKey("owner-1", "default", []models.File{{Type: "text/plain", Data: []byte("# Notes")}}, settings, gen)},
+		{name: "no files", key: cacheKey("owner-1", "default", nil, settings, gen)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.key == base; got != tt.same {
+				t.Errorf("key matches the base key: %v, want %v", got, tt.same)
+			}
+		})
+	}
+}
+
+// TestCacheKeyFieldBoundaries checks that moving bytes between adjacent fields changes the key
+func TestCacheKeyFieldBoundaries(t *testing.T) {
+	settings := models.SlideSettings{}
+	gen := generator{Model: "gemini", PromptVersion: "v1"}
+
+	tests := []struct {
+		name string
+		a, b string
+	}{
+		{
+			name: "owner and theme",
+			a:    cacheKey("owner-1", "default", nil, settings, gen),
+			b:    cacheKey("owner-1d", "efault", nil, settings, gen),
+		},
+		{
+			name: "model and prompt version",
+			a:    cacheKey("owner-1", "default", nil, settings, generator{Model: "gemini", PromptVersion: "v1"}),
+			b:    cacheKey("owner-1", "default", nil, settings, generator{Model: "geminiv", PromptVersion: "1"}),
+		},
+		{
+			name: "file type and data",
+			a:    cacheKey("owner-1", "default", []models.File{{Type: "text/markdown", Data: []byte("abc")}}, settings, gen),
+			b:    cacheKey("owner-1", "default", []models.File{{Type: "text/markdowna", Data: []byte("bc")}}, settings, gen),
+		},
+		{
+			name: "split file",
+			a:    cacheKey("owner-1", "default", []models.File{{Type: "t", Data: []byte("abcd")}}, settings, gen),
+			b:    cacheKey("owner-1", "default", []models.File{{Type: "t", Data: []byte("ab")}, {Type: "t", Data: []byte("cd")}}, settings, gen),
+		},
+		{
+			name: "file order",
+			a:    cacheKey("owner-1", "default", []models.File{{Type: "t", Data: []byte("a")}, {Type: "t", Data: []byte("b")}}, settings, gen),
+			b:    cacheKey("owner-1", "default", []models.File{{Type: "t", Data: []byte("b")}, {Type: "t", Data: []byte("a")}}, settings, gen),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.a == tt.b {
+				t.Error("different input produced the same key")
+			}
+		})
+	}
+}
@@ -0,0 +1,133 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// FirestoreJobEvent is one entry in a job's ordered event log, stored in jobs/{id}/events
+type FirestoreJobEvent struct {
+	Seq      int64         `firestore:"seq"`
+	Status   string        `firestore:"status"`
+	Message  string        `firestore:"message"`
+	At       int64         `firestore:"at"`
+	Progress *JobProgress  `firestore:"progress,omitempty"`
+	Preview  *SlidePreview `firestore:"preview,omitempty"` // Written by the slides-service as slides are generated
+}
+
+// EventsCollection returns the event log collection of a job
+func (s *Service) EventsCollection(jobID string) *firestore.CollectionRef {
+	return s.Collection().Doc(jobID).Collection("events")
+}
+
+// eventID returns the document ID of an event, zero-padded so IDs sort in sequence order
+func eventID(seq int64) string {
+	return fmt.Sprintf("%010d", seq)
+}
+
+// putJob writes a whole job document and appends its status to the event log. If the job
+// already exists, for example because it was reserved, its event log is continued.
+func (s *Service) putJob(ctx context.Context, job FirestoreJob) error {
+	jobRef := s.Collection().Doc(job.ID)
+	return s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		var seq int64
+		doc, err := tx.Get(jobRef)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return err
+		}
+		if err == nil {
+			var existing FirestoreJob
+			if err := doc.DataTo(&existing); err != nil {
+				return err
+			}
+			seq = existing.EventSeq
+		}
+
+		job.EventSeq = seq + 1
+		if err := tx.Set(jobRef, job); err != nil {
+			return err
+		}
+		return tx.Create(s.EventsCollection(job.ID).Doc(eventID(job.EventSeq)), FirestoreJobEvent{
+			Seq:      job.EventSeq,
+			Status:   job.Status,
+			Message:  job.Message,
+			At:       job.UpdatedAt,
+			Progress: job.Progress,
+		})
+	})
+}
+
+// updateJobState updates a job's status and message and appends the change to its event log
+func (s *Service) updateJobState(ctx context.Context, jobID string, jobStatus JobStatus, message string) error {
+	_, err := s.updateJobStateIf(ctx, jobID, jobStatus, message, nil, nil)
+	return err
+}
+
+// updateJobStateIf updates a job's status, message and progress, plus any extra fields, if cond
+// accepts the job's current state, and appends the change to its event log. A nil cond always
+// updates and a nil progress leaves the job's progress in place. It reports whether the job was
+// updated.
+func (s *Service) updateJobStateIf(ctx context.Context, jobID string, jobStatus JobStatus, message string, progress *JobProgress, cond func(FirestoreJob) bool, extra ...firestore.Update) (bool, error) {
+	jobRef := s.Collection().Doc(jobID)
+	updated := false
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		updated = false
+		doc, err := tx.Get(jobRef)
+		if err != nil {
+			return err
+		}
+		var job FirestoreJob
+		if err := doc.DataTo(&job); err != nil {
+			return err
+		}
+		if cond != nil && !cond(job) {
+			return nil
+		}
+
+		now := time.Now().Unix()
+		seq := job.EventSeq + 1
+		updates := append([]firestore.Update{
+			{Path: "status", Value: string(jobStatus)},
+			{Path: "message", Value: message},
+			{Path: "updatedAt", Value: now},
+			{Path: "eventSeq", Value: seq},
+		}, extra...)
+		if progress != nil {
+			updates = append(updates, firestore.Update{Path: "progress", Value: *progress})
+		}
+		if err := tx.Update(jobRef, updates); err != nil {
+			return err
+		}
+		updated = true
+		return tx.Create(s.EventsCollection(jobID).Doc(eventID(seq)), FirestoreJobEvent{
+			Seq:      seq,
+			Status:   string(jobStatus),
+			Message:  message,
+			At:       now,
+			Progress: progress,
+		})
+	})
+	return updated, err
+}
+
+// deleteJob deletes a job and its event log
+func (s *Service) deleteJob(ctx context.Context, jobID string) error {
+	// Firestore doesn't delete subcollections with their parent, so remove events first
+	eventRefs, err := s.EventsCollection(jobID).DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to list job events: %v", err)
+	}
+	for _, eventRef := range eventRefs {
+		if _, err := eventRef.Delete(ctx); err != nil {
+			return fmt.Errorf("failed to delete job event %s: %v", eventRef.ID, err)
+		}
+	}
+
+	_, err = s.Collection().Doc(jobID).Delete(ctx)
+	return err
+}
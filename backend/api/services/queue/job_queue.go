@@ -4,16 +4,24 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
 	"path/filepath"
+	"sort"
+	"sync"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/firestore"
 	"github.com/martin226/slideitin/backend/api/models"
+	"github.com/martin226/slideitin/backend/api/services/logging"
+	"github.com/martin226/slideitin/backend/api/services/telemetry"
+	"github.com/martin226/slideitin/backend/api/services/usage"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
 )
@@ -31,79 +39,234 @@ const (
 // FirestoreJob is the Firestore representation of a job
 // Simplified to contain only essential fields
 type FirestoreJob struct {
-	ID        string `firestore:"id"`
-	Status    string `firestore:"status"`
-	Message   string `firestore:"message"`
-	CreatedAt int64  `firestore:"createdAt"`
-	UpdatedAt int64  `firestore:"updatedAt"`
-	ExpiresAt int64  `firestore:"expiresAt,omitempty"`
+	ID             string           `firestore:"id"`
+	OwnerID        string           `firestore:"ownerId,omitempty"`
+	Status         string           `firestore:"status"`
+	Message        string           `firestore:"message"`
+	CreatedAt      int64            `firestore:"createdAt"`
+	UpdatedAt      int64            `firestore:"updatedAt"`
+	ExpiresAt      int64            `firestore:"expiresAt,omitempty"`
+	Metrics        *JobMetrics      `firestore:"metrics,omitempty"` // Written by the slides-service once generation finishes
+	Webhook        *WebhookDelivery `firestore:"webhook,omitempty"`
+	EventSeq       int64            `firestore:"eventSeq"` // Sequence number of the latest entry in the event log
+	Progress       *JobProgress     `firestore:"progress,omitempty"`
+	Task           *TaskPayload     `firestore:"task,omitempty"`           // Kept so an interrupted job can be sent again
+	Requeue        bool             `firestore:"requeue,omitempty"`        // Set by the slides-service when it interrupts a job
+	Attempts       int              `firestore:"attempts,omitempty"`       // Number of times the job has been sent to the slides-service
+	Refusals       int              `firestore:"refusals,omitempty"`       // Attempts the slides-service refused because it was busy
+	RetryAt        int64            `firestore:"retryAt,omitempty"`        // A requeued job isn't sent again before this, from the slides-service's Retry-After
+	HeartbeatAt    int64            `firestore:"heartbeatAt,omitempty"`    // Last time whoever holds the job reported it as alive
+	Cache          string           `firestore:"cache,omitempty"`          // Whether the result was reused from the cache: hit, miss or skipped
+	UsageKey       string           `firestore:"usageKey,omitempty"`       // Caller the job's tokens are charged to
+	ChargedAttempt int              `firestore:"chargedAttempt,omitempty"` // Latest attempt whose tokens have been charged
+}
+
+// Webhook delivery statuses
+const (
+	WebhookPending   = "pending"
+	WebhookDelivered = "delivered"
+	WebhookFailed    = "failed"
+)
+
+// WebhookDelivery records the completion callback for a job and every attempt to deliver it. It's
+// kept on the job so pending deliveries survive restarts of the API.
+type WebhookDelivery struct {
+	URL           string           `json:"url" firestore:"url"`
+	Secret        string           `json:"-" firestore:"secret"`
+	DeliveryID    string           `json:"deliveryId" firestore:"deliveryId"` // Same for every retry so receivers can deduplicate
+	Status        string           `json:"status" firestore:"status"`
+	Attempts      []WebhookAttempt `json:"attempts" firestore:"attempts"`
+	NextAttemptAt int64            `json:"nextAttemptAt,omitempty" firestore:"nextAttemptAt,omitempty"` // Retries wait until then
+	LeaseUntil    int64            `json:"-" firestore:"leaseUntil,omitempty"`                          // Set while an instance is delivering it
+}
+
+// WebhookAttempt records a single delivery attempt
+type WebhookAttempt struct {
+	Attempt    int    `json:"attempt" firestore:"attempt"`
+	At         int64  `json:"at" firestore:"at"`
+	StatusCode int    `json:"statusCode,omitempty" firestore:"statusCode,omitempty"`
+	Error      string `json:"error,omitempty" firestore:"error,omitempty"`
+	DurationMs int64  `json:"durationMs" firestore:"durationMs"`
+}
+
+// JobMetrics records the model usage and render times of a job so it can be charged back
+type JobMetrics struct {
+	Model            string  `json:"model" firestore:"model"`
+	CountedTokens    int64   `json:"countedTokens" firestore:"countedTokens"` // Input estimate from CountTokens
+	InputTokens      int64   `json:"inputTokens" firestore:"inputTokens"`
+	OutputTokens     int64   `json:"outputTokens" firestore:"outputTokens"`
+	GenerationMs     int64   `json:"generationMs" firestore:"generationMs"`
+	PDFRenderMs      int64   `json:"pdfRenderMs" firestore:"pdfRenderMs"`
+	HTMLRenderMs     int64   `json:"htmlRenderMs" firestore:"htmlRenderMs"`
+	EstimatedCostUSD float64 `json:"estimatedCostUsd" firestore:"estimatedCostUsd"`
+}
+
+// StageQueued is the progress stage of a job that hasn't reached the slides-service yet; the
+// slides-service reports the later stages, except for jobs completed from the cache
+const (
+	StageQueued    = "queued"
+	StageCompleted = "completed"
+)
+
+// JobProgress is the structured progress of a job: its stage, percent complete, the file being
+// processed and an estimate of the time remaining
+type JobProgress struct {
+	Stage         string `json:"stage" firestore:"stage"`
+	Percent       int    `json:"percent" firestore:"percent"`
+	FileIndex     int    `json:"fileIndex,omitempty" firestore:"fileIndex,omitempty"` // 1-based index of the file being processed
+	FileCount     int    `json:"fileCount,omitempty" firestore:"fileCount,omitempty"`
+	ETASeconds    int64  `json:"etaSeconds,omitempty" firestore:"etaSeconds,omitempty"`       // Estimated time remaining, unset until known
+	QueuePosition int    `json:"queuePosition,omitempty" firestore:"queuePosition,omitempty"` // 1-based position while waiting for a slides-service worker
+}
+
+// SlidePreview is the rendered HTML of a single slide, published while the rest of the deck is
+// still being generated
+type SlidePreview struct {
+	Index int    `json:"index" firestore:"index"` // 1-based position of the slide in the deck
+	HTML  string `json:"html" firestore:"html"`
 }
 
 // FirestoreResult is the Firestore representation of a job result
 type FirestoreResult struct {
+	ID                  string `firestore:"id"`
+	OwnerID             string `firestore:"ownerId,omitempty"`
+	ResultURL           string `firestore:"resultUrl"`
+	PDFData             []byte `firestore:"pdfData"`
+	HTMLData            []byte `firestore:"htmlData"`
+	CreatedAt           int64  `firestore:"createdAt"`
+	ExpiresAt           int64  `firestore:"expiresAt"` // 0 means the result is kept forever
+	DeleteAfterDownload bool   `firestore:"deleteAfterDownload,omitempty"`
+}
+
+// FirestoreResultImage is the Firestore representation of an image referenced by a result
+type FirestoreResultImage struct {
 	ID          string `firestore:"id"`
-	ResultURL   string `firestore:"resultUrl"`
-	PDFData     []byte `firestore:"pdfData"`
-	HTMLData    []byte `firestore:"htmlData"`
+	OwnerID     string `firestore:"ownerId,omitempty"`
+	ContentType string `firestore:"contentType"`
+	Data        []byte `firestore:"data"`
 	CreatedAt   int64  `firestore:"createdAt"`
 	ExpiresAt   int64  `firestore:"expiresAt"`
 }
 
 // Job represents a single slide generation job with runtime features
 type Job struct {
-	ID        string
-	Theme     string
-	Files     []models.File
-	Settings  models.SlideSettings
-	Status    JobStatus
-	Message   string
-	ResultURL string
-	CreatedAt int64
-	UpdatedAt int64
+	ID              string
+	OwnerID         string
+	Theme           string
+	Files           []models.File
+	Settings        models.SlideSettings
+	Status          JobStatus
+	Message         string
+	ResultURL       string
+	ResultExpiresAt int64
+	CreatedAt       int64
+	UpdatedAt       int64
+	EventSeq        int64
+	Metrics         *JobMetrics
+	Progress        *JobProgress
+	Webhook         *WebhookDelivery
+	Cache           string // Whether the result was reused from the cache: hit, miss or skipped
+}
+
+// Finished reports whether the job has reached a terminal state
+func (job *Job) Finished() bool {
+	return job.Status == StatusCompleted || job.Status == StatusFailed
+}
+
+// Snapshot returns the job's current state as an update
+func (job *Job) Snapshot() JobUpdate {
+	return JobUpdate{
+		ID:              job.ID,
+		Seq:             job.EventSeq,
+		Status:          job.Status,
+		Message:         job.Message,
+		ResultURL:       job.ResultURL,
+		ResultExpiresAt: job.ResultExpiresAt,
+		UpdatedAt:       job.UpdatedAt,
+		Metrics:         job.Metrics,
+		Progress:        job.Progress,
+		Cache:           job.Cache,
+	}
+}
+
+// triggerResponse is the body the slides-service returns for a processed job
+type triggerResponse struct {
+	generator // What the deck was generated with, so its result can be cached
 }
 
 // JobUpdate represents an update to a job that can be sent to SSE clients
 type JobUpdate struct {
-	ID        string    `json:"id"`
-	Status    JobStatus `json:"status"`
-	Message   string    `json:"message"`
-	ResultURL string    `json:"resultUrl,omitempty"`
-	UpdatedAt int64     `json:"updatedAt"`
+	ID              string        `json:"id"`
+	Seq             int64         `json:"seq"` // Position in the job's event log, sent as the SSE event ID
+	Status          JobStatus     `json:"status"`
+	Message         string        `json:"message"`
+	ResultURL       string        `json:"resultUrl,omitempty"`
+	ResultExpiresAt int64         `json:"resultExpiresAt,omitempty"` // Unset for results that are kept forever
+	UpdatedAt       int64         `json:"updatedAt"`
+	Metrics         *JobMetrics   `json:"metrics,omitempty"`
+	Progress        *JobProgress  `json:"progress,omitempty"`
+	Preview         *SlidePreview `json:"preview,omitempty"` // Set on updates for a newly generated slide
+	Cache           string        `json:"cache,omitempty"`   // hit if the result was reused from the cache, otherwise miss or skipped
 }
 
 // FileReference represents a reference to a file stored locally
 type FileReference struct {
-	Filename string `json:"filename"`
-	Type     string `json:"type"`
-	LocalPath string `json:"localPath"` // Changed from GCSPath
+	Filename  string `json:"filename" firestore:"filename"`
+	Type      string `json:"type" firestore:"type"`
+	LocalPath string `json:"localPath" firestore:"localPath"` // Changed from GCSPath
 }
 
 // TaskPayload represents the data structure to be sent in a Cloud Task
 type TaskPayload struct {
-	JobID     string            `json:"jobID"`
-	Theme     string            `json:"theme"`
-	Files     []FileReference   `json:"files"`
-	Settings  models.SlideSettings `json:"settings"`
+	JobID     string                 `json:"jobID" firestore:"jobId"`
+	OwnerID   string                 `json:"ownerID,omitempty" firestore:"ownerId,omitempty"`
+	Theme     string                 `json:"theme" firestore:"theme"`
+	Files     []FileReference        `json:"files" firestore:"files"`
+	Settings  models.SlideSettings   `json:"settings" firestore:"settings"`
+	Retention models.RetentionPolicy `json:"retention" firestore:"retention"`
 }
 
+// defaultAttemptTimeout is how long an attempt at a job waits for the slides-service by default
+const defaultAttemptTimeout = 30 * time.Minute
+
 // Service manages jobs using Firestore and direct HTTP calls
 type Service struct {
-	client     *firestore.Client
+	client *firestore.Client
 	// Removed taskClient, storageClient
-	projectID  string
+	projectID string
 	// Removed region, queueID
 	serviceURL string
 	// Removed bucketName
 	httpClient *http.Client // Add http client
+	retention  *retentionPolicies
+	usage      *usage.Service // Charged with the tokens each job uses
+
+	// How long each attempt at a job may wait for the slides-service to finish it
+	attemptTimeout time.Duration
+
+	// Jobs being sent to the slides-service, tracked so a shutdown can wait for them
+	mu       sync.Mutex
+	inflight sync.WaitGroup
+	draining bool
+
+	// Told when a refused job may be retried, so the requeuer can wake up for it
+	retryWake chan time.Time
+
+	// Jobs whose heartbeat is older than heartbeatTimeout are considered stuck
+	heartbeatInterval time.Duration
+	heartbeatTimeout  time.Duration
+
+	cache *resultCache
 }
 
-// NewService creates a new queue service using Firestore and HTTP client
-func NewService(client *firestore.Client) (*Service, error) {
+// NewService creates a new queue service using Firestore and HTTP client, charging the tokens used
+// by jobs to usageService
+func NewService(client *firestore.Client, usageService *usage.Service) (*Service, error) {
 	// Get environment variables
 	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
 	if projectID == "" {
 		// Use a default for local if not set, but it's better if set in .env/docker-compose
-		log.Println("Warning: GOOGLE_CLOUD_PROJECT not set, using default 'local-slideitin'")
+		slog.Warn("GOOGLE_CLOUD_PROJECT not set, using default", "project", "local-slideitin")
 		projectID = "local-slideitin"
 	}
 
@@ -115,14 +278,53 @@ func NewService(client *firestore.Client) (*Service, error) {
 	// Removed Cloud Tasks and Storage client creation
 	// Removed region, queueID, bucketName checks
 
+	retention, err := loadRetentionPolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	heartbeatInterval, heartbeatTimeout, err := loadHeartbeatConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	cache, err := loadResultCache()
+	if err != nil {
+		return nil, err
+	}
+
+	attemptTimeout := defaultAttemptTimeout
+	if value := os.Getenv("SLIDES_SERVICE_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid SLIDES_SERVICE_TIMEOUT: %q", value)
+		}
+		attemptTimeout = parsed
+	}
+
 	return &Service{
 		client:     client,
 		projectID:  projectID,
 		serviceURL: serviceURL,
-		httpClient: &http.Client{Timeout: time.Second * 180}, // Increased HTTP client timeout to 90 seconds
+		// The transport propagates the trace context to the slides-service. There's no client
+		// timeout, as jobs can wait in the slides-service's queue for a while; each attempt is
+		// bounded by attemptTimeout instead, and watchJob stops waiting for jobs that stop responding.
+		httpClient:        &http.Client{Transport: otelhttp.NewTransport(http.DefaultTransport)},
+		attemptTimeout:    attemptTimeout,
+		retention:         retention,
+		usage:             usageService,
+		heartbeatInterval: heartbeatInterval,
+		heartbeatTimeout:  heartbeatTimeout,
+		cache:             cache,
+		retryWake:         make(chan time.Time, 1),
 	}, nil
 }
 
+// RetentionPolicy returns the retention policy applied to an owner's jobs
+func (s *Service) RetentionPolicy(ownerID string) models.RetentionPolicy {
+	return s.retention.forOwner(ownerID)
+}
+
 // Collection returns the Firestore collection reference for jobs
 func (s *Service) Collection() *firestore.CollectionRef {
 	return s.client.Collection("jobs")
@@ -150,37 +352,138 @@ func (s *Service) saveFileLocally(ctx context.Context, jobID string, file models
 		return "", fmt.Errorf("failed to write file to '%s': %v", localPath, err)
 	}
 
-	log.Printf("Saved file %s locally to: %s", file.Filename, localPath)
+	slog.DebugContext(ctx, "Saved file locally", "path", localPath)
 	return localPath, nil
 }
 
+// canRead reports whether the requesting owner may read a document owned by docOwner.
+// Documents created anonymously have no owner and stay readable by ID.
+func canRead(docOwner, ownerID string) bool {
+	return docOwner == "" || docOwner == ownerID
+}
+
+// MaxReservedJobs is the most jobs ReserveJobs accepts, as a Firestore transaction holds at most
+// 500 writes and each job takes two
+const MaxReservedJobs = 250
+
+// ReserveJobs creates placeholder jobs in Firestore so their status can be reported before AddJob
+// runs. The jobs are written in a single transaction, so either all of them are reserved or none.
+func (s *Service) ReserveJobs(ctx context.Context, ids []string, ownerID, message string) error {
+	if len(ids) > MaxReservedJobs {
+		return fmt.Errorf("cannot reserve more than %d jobs at once", MaxReservedJobs)
+	}
+
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		now := time.Now().Unix()
+		for _, id := range ids {
+			firestoreJob := FirestoreJob{
+				ID:        id,
+				OwnerID:   ownerID,
+				Status:    string(StatusQueued),
+				Message:   message,
+				CreatedAt: now,
+				UpdatedAt: now,
+				EventSeq:  1,
+				Progress:  &JobProgress{Stage: StageQueued},
+			}
+			if err := tx.Create(s.Collection().Doc(id), firestoreJob); err != nil {
+				return err
+			}
+			if err := tx.Create(s.EventsCollection(id).Doc(eventID(firestoreJob.EventSeq)), FirestoreJobEvent{
+				Seq:      firestoreJob.EventSeq,
+				Status:   firestoreJob.Status,
+				Message:  firestoreJob.Message,
+				At:       now,
+				Progress: firestoreJob.Progress,
+			}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to reserve jobs: %v", err)
+	}
+	return nil
+}
+
+// FailReservedJobs marks jobs reserved by ReserveJobs that will never be added as failed, so
+// they're not left queued until the reaper finds them
+func (s *Service) FailReservedJobs(ctx context.Context, ids []string, message string) {
+	stillQueued := func(job FirestoreJob) bool { return job.Status == string(StatusQueued) }
+	for _, id := range ids {
+		if _, err := s.updateJobStateIf(ctx, id, StatusFailed, message, nil, stillQueued); err != nil {
+			slog.ErrorContext(ctx, "Failed to fail reserved job", "job_id", id, "error", err)
+		}
+	}
+}
 
 // AddJob adds a new job to Firestore, saves files locally, and triggers the slides-service via HTTP
-func (s *Service) AddJob(ctx context.Context, id, theme string, fileData []models.File, settings models.SlideSettings) (*Job, error) {
+// in the background, returning once the job has been stored. A job whose input matches an earlier
+// job's is completed straight away with a copy of its result, unless noCache is set. The tokens
+// the job uses are charged to the reservation's caller, and a job that fails in the background is
+// given back to the reservation. A non-nil webhook is stored with the job, so it's delivered however the
+// job ends.
+func (s *Service) AddJob(ctx context.Context, id, ownerID string, reservation usage.Reservation, theme string, fileData []models.File, settings models.SlideSettings, noCache bool, webhook *WebhookDelivery) (*Job, error) {
+	return s.addJob(ctx, id, ownerID, reservation, theme, fileData, settings, noCache, webhook, false)
+}
+
+// AddJobAndWait adds a job like AddJob but waits for the slides-service to finish it. Callers
+// give a job that failed back to the job quota themselves.
+func (s *Service) AddJobAndWait(ctx context.Context, id, ownerID string, reservation usage.Reservation, theme string, fileData []models.File, settings models.SlideSettings, noCache bool) (*Job, error) {
+	return s.addJob(ctx, id, ownerID, reservation, theme, fileData, settings, noCache, nil, true)
+}
+
+// addJob stores a job and its task, then runs it in the background or, if wait is set, until the
+// slides-service has finished it
+func (s *Service) addJob(ctx context.Context, id, ownerID string, reservation usage.Reservation, theme string, fileData []models.File, settings models.SlideSettings, noCache bool, webhook *WebhookDelivery, wait bool) (job *Job, err error) {
+	// Refuse new jobs while draining; the caller can retry against another instance
+	if !s.begin() {
+		return nil, ErrShuttingDown
+	}
+	// Once the job runs, whatever runs it is tracked in s.inflight instead
+	running := false
+	defer func() {
+		if !running {
+			s.inflight.Done()
+		}
+	}()
+
+	ctx = logging.WithJob(ctx, id, ownerID)
+	ctx, span := telemetry.StartSpan(telemetry.WithJobID(ctx, id), "queue.AddJob")
+	defer func() { telemetry.EndSpan(span, err) }()
+
 	// Create the job
-	now := time.Now().Unix()
-	
+	started := time.Now()
+	now := started.Unix()
+
 	// Create a job record for Firestore (simplified)
 	firestoreJob := FirestoreJob{
 		ID:        id,
+		OwnerID:   ownerID,
 		Status:    string(StatusQueued),
 		Message:   "Job added to queue",
 		CreatedAt: now,
 		UpdatedAt: now,
+		Progress:  &JobProgress{Stage: StageQueued},
+		UsageKey:  reservation.Key,
+		Webhook:   webhook,
 	}
 
-	// Save to Firestore
-	_, err := s.Collection().Doc(id).Set(ctx, firestoreJob)
+	// Save to Firestore, continuing the event log of a reserved job
+	err = s.putJob(ctx, firestoreJob)
 	if err != nil {
-		log.Printf("Failed to add job to Firestore: %v", err)
+		slog.ErrorContext(ctx, "Failed to add job to Firestore", "error", err)
 		return nil, fmt.Errorf("failed to store job: %v", err)
 	}
 
-	log.Printf("Added job %s to Firestore", id)
+	slog.InfoContext(ctx, "Added job to Firestore")
+	telemetry.JobsTotal.WithLabelValues(string(StatusQueued)).Inc()
 
 	// Create in-memory job object
-	job := &Job{
+	job = &Job{
 		ID:        id,
+		OwnerID:   ownerID,
 		Theme:     theme,
 		Files:     fileData, // Keep original file data here if needed, or clear it
 		Settings:  settings,
@@ -188,54 +491,132 @@ func (s *Service) AddJob(ctx context.Context, id, theme string, fileData []model
 		Message:   "Job added to queue",
 		CreatedAt: now,
 		UpdatedAt: now,
+		Progress:  firestoreJob.Progress,
+	}
+
+	// Reuse the result of an identical earlier job rather than generating the deck again
+	cacheable := s.cache.enabled && !noCache
+	job.Cache = CacheSkipped
+	if cacheable {
+		job.Cache = s.reuseCachedResult(ctx, job)
+		telemetry.CacheLookups.WithLabelValues(job.Cache).Inc()
+		if job.Cache == CacheHit {
+			telemetry.JobFinished(string(StatusCompleted), started)
+			return job, nil
+		}
 	}
 
 	// Save files locally to shared volume
+	_, saveSpan := telemetry.StartSpan(ctx, "queue.SaveFiles")
 	fileRefs := make([]FileReference, 0, len(fileData))
 	for _, file := range fileData {
 		localPath, err := s.saveFileLocally(ctx, id, file)
 		if err != nil {
+			telemetry.EndSpan(saveSpan, err)
 			// Update job status to failed if file save fails
 			s.updateJobStatus(job, StatusFailed, fmt.Sprintf("Failed to save file %s locally: %v", file.Filename, err), "")
+			telemetry.JobFinished(string(StatusFailed), started)
 			return job, fmt.Errorf("failed to save file locally: %v", err)
 		}
 
 		// Create a file reference with the local path
 		fileRef := FileReference{
-			Filename: file.Filename,
-			Type:     file.Type,
+			Filename:  file.Filename,
+			Type:      file.Type,
 			LocalPath: localPath, // Use local path
 		}
 		fileRefs = append(fileRefs, fileRef)
 	}
-
-	// Trigger the slides-service directly via HTTP
-	err = s.triggerSlidesService(ctx, job, fileRefs)
-	if err != nil {
-		// Update job status to failed if triggering fails
-		s.updateJobStatus(job, StatusFailed, fmt.Sprintf("Failed to trigger slides service: %v", err), "")
-		return job, fmt.Errorf("failed to trigger slides service: %v", err)
+	saveSpan.End()
+
+	// Keep the task on the job so it can be sent again if the slides-service is interrupted
+	task := TaskPayload{
+		JobID:     job.ID,
+		OwnerID:   job.OwnerID,
+		Theme:     job.Theme,
+		Files:     fileRefs, // Contains local paths now
+		Settings:  job.Settings,
+		Retention: s.RetentionPolicy(job.OwnerID),
+	}
+	if _, err := s.Collection().Doc(id).Update(ctx, []firestore.Update{
+		{Path: "task", Value: task},
+		{Path: "attempts", Value: 1},
+		{Path: "cache", Value: job.Cache},
+	}); err != nil {
+		s.updateJobStatus(job, StatusFailed, fmt.Sprintf("Failed to store job: %v", err), "")
+		telemetry.JobFinished(string(StatusFailed), started)
+		return job, fmt.Errorf("failed to store job: %v", err)
 	}
 
-	// Optionally update status to processing immediately, or let slides-service do it
-	// s.updateJobStatus(job, StatusProcessing, "Sent job to slides service", "")
+	running = true
+	if wait {
+		defer s.inflight.Done()
+		return job, s.runJob(ctx, job, task, cacheable, started)
+	}
 
-	return job, nil
+	// The caller gets the job back straight away and follows it through its status; the job
+	// keeps the trace, but not the span, which ends here
+	snapshot := *job
+	go func() {
+		defer s.inflight.Done()
+		if err := s.runJob(ctx, job, task, cacheable, started); err != nil {
+			if err := s.usage.ReleaseJobs(context.Background(), reservation, 1); err != nil {
+				slog.ErrorContext(ctx, "Failed to release quota for failed job", "error", err)
+			}
+		}
+	}()
+	return &snapshot, nil
 }
 
+// runJob sends a stored job's task to the slides-service and waits for it to finish the job,
+// caching its result if it's cacheable. It returns an error if the job failed, but not if it's
+// going to be retried.
+func (s *Service) runJob(ctx context.Context, job *Job, task TaskPayload, cacheable bool, started time.Time) error {
+	// The slides-service responds once the job has finished, so the job is in the queue until then
+	telemetry.QueueDepth.Inc()
+	defer telemetry.QueueDepth.Dec()
+
+	// Trigger the slides-service directly via HTTP
+	triggerResp, err := s.triggerSlidesService(ctx, task)
+	// Charge whatever the attempt used, even if it failed
+	s.chargeTokens(ctx, job.ID)
+	if err != nil {
+		// Update job status to failed if triggering fails, unless it's going to be retried
+		if s.failJob(job, err) {
+			slog.ErrorContext(ctx, "Job failed", "error", err)
+			telemetry.JobFinished(string(StatusFailed), started)
+			return fmt.Errorf("failed to trigger slides service: %v", err)
+		}
+		return nil
+	}
 
-// triggerSlidesService sends the job details to the slides-service via HTTP POST
-func (s *Service) triggerSlidesService(ctx context.Context, job *Job, fileRefs []FileReference) error {
-	taskPayload := TaskPayload{
-		JobID:    job.ID,
-		Theme:    job.Theme,
-		Files:    fileRefs, // Contains local paths now
-		Settings: job.Settings,
+	// Cache the result under what it was actually generated with
+	if cacheable && triggerResp.Model != "" {
+		key := cacheKey(job.OwnerID, job.Theme, job.Files, job.Settings, triggerResp.generator)
+		if err := s.storeCacheEntry(ctx, key, job.ID, triggerResp.generator); err != nil {
+			slog.WarnContext(ctx, "Failed to cache result", "error", err)
+		}
 	}
 
+	telemetry.JobFinished(string(StatusCompleted), started)
+	return nil
+}
+
+// triggerSlidesService sends the job details to the slides-service via HTTP POST and waits for it
+// to finish the job. Errors wrap errSlidesServiceUnavailable if the slides-service couldn't take the
+// job, errSlidesServiceBusy if it refused it, errJobTakenOver if the job stopped responding, and
+// errAttemptTimedOut if it wasn't finished within attemptTimeout. Refusals carry the
+// slides-service's Retry-After, see retryAfter.
+func (s *Service) triggerSlidesService(ctx context.Context, taskPayload TaskPayload) (triggerResponse, error) {
+	var triggerResp triggerResponse
+	ctx, stop := context.WithTimeoutCause(ctx, s.attemptTimeout, fmt.Errorf("%w after %s", errAttemptTimedOut, s.attemptTimeout))
+	defer stop()
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	go s.watchJob(ctx, taskPayload.JobID, cancel)
 	payloadBytes, err := json.Marshal(taskPayload)
 	if err != nil {
-		return fmt.Errorf("failed to marshal trigger payload: %v", err)
+		return triggerResp, fmt.Errorf("failed to marshal trigger payload: %v", err)
 	}
 
 	// Define the target endpoint
@@ -244,15 +625,22 @@ func (s *Service) triggerSlidesService(ctx context.Context, job *Job, fileRefs [
 	// Create the HTTP request
 	req, err := http.NewRequestWithContext(ctx, "POST", targetURL, bytes.NewBuffer(payloadBytes))
 	if err != nil {
-		return fmt.Errorf("failed to create http request: %v", err)
+		return triggerResp, fmt.Errorf("failed to create http request: %v", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
 
 	// Send the request
-	log.Printf("Triggering slides service for job %s at %s", job.ID, targetURL)
+	slog.InfoContext(ctx, "Triggering slides service", "url", targetURL)
 	resp, err := s.httpClient.Do(req)
 	if err != nil {
-		return fmt.Errorf("failed to send http request to slides service: %v", err)
+		if cause := context.Cause(ctx); errors.Is(cause, errJobTakenOver) || errors.Is(cause, errAttemptTimedOut) {
+			return triggerResp, cause
+		}
+		// A refused connection means the slides-service is down or restarting, so the job can wait
+		if errors.Is(err, syscall.ECONNREFUSED) {
+			return triggerResp, fmt.Errorf("%w: %v", errSlidesServiceUnavailable, err)
+		}
+		return triggerResp, fmt.Errorf("failed to send http request to slides service: %v", err)
 	}
 	defer resp.Body.Close()
 
@@ -260,165 +648,189 @@ func (s *Service) triggerSlidesService(ctx context.Context, job *Job, fileRefs [
 	if resp.StatusCode >= 300 {
 		// Try to read body for more info
 		bodyBytes, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("slides service returned non-success status %d: %s", resp.StatusCode, string(bodyBytes))
+		if resp.StatusCode == http.StatusServiceUnavailable {
+			return triggerResp, refusal(resp, bodyBytes)
+		}
+		return triggerResp, fmt.Errorf("slides service returned non-success status %d: %s", resp.StatusCode, string(bodyBytes))
 	}
 
-	log.Printf("Successfully triggered slides service for job %s, status: %d", job.ID, resp.StatusCode)
-	return nil
+	if err := json.NewDecoder(resp.Body).Decode(&triggerResp); err != nil {
+		slog.WarnContext(ctx, "Failed to decode slides service response", "error", err)
+	}
+
+	slog.InfoContext(ctx, "Slides service finished job", "status", resp.StatusCode)
+	return triggerResp, nil
 }
 
-// GetJob retrieves a job by its ID from Firestore
-func (s *Service) GetJob(id string) *Job {
+// GetJob retrieves a job by its ID from Firestore, returning nil if the owner may not read it
+func (s *Service) GetJob(id, ownerID string) *Job {
 	ctx := context.Background()
 	doc, err := s.Collection().Doc(id).Get(ctx)
 	if err != nil {
 		if status.Code(err) == codes.NotFound {
-			log.Printf("Job %s not found in Firestore", id)
+			slog.Debug("Job not found in Firestore", "job_id", id)
 			return nil
 		}
-		log.Printf("Error retrieving job %s: %v", id, err)
+		slog.Error("Error retrieving job", "job_id", id, "error", err)
 		return nil
 	}
 
 	var firestoreJob FirestoreJob
 	if err := doc.DataTo(&firestoreJob); err != nil {
-		log.Printf("Error parsing job data: %v", err)
+		slog.Error("Error parsing job data", "job_id", id, "error", err)
+		return nil
+	}
+
+	// Report jobs owned by someone else as not found so IDs can't be probed
+	if !canRead(firestoreJob.OwnerID, ownerID) {
+		slog.Warn("Denied access to job", "job_id", id, "tenant", ownerID)
 		return nil
 	}
 
 	// Check if job has expired
 	now := time.Now().Unix()
 	if firestoreJob.ExpiresAt > 0 && now > firestoreJob.ExpiresAt {
-		// Job has expired, delete it
-		_, err := s.Collection().Doc(id).Delete(ctx)
+		// Job has expired, delete it along with its event log
+		err := s.deleteJob(ctx, id)
 		if err != nil {
-			log.Printf("Failed to delete expired job %s: %v", id, err)
+			slog.Error("Failed to delete expired job", "job_id", id, "error", err)
 		} else {
-			log.Printf("Deleted expired job %s", id)
+			slog.Info("Deleted expired job", "job_id", id)
 		}
 		return nil
 	}
 
 	// Get the result if available
 	var resultURL string
+	var resultExpiresAt int64
 	if firestoreJob.Status == string(StatusCompleted) {
 		resultDoc, err := s.ResultsCollection().Doc(id).Get(ctx)
 		if err == nil && resultDoc.Exists() {
 			var result FirestoreResult
 			if err := resultDoc.DataTo(&result); err == nil {
 				resultURL = result.ResultURL
+				resultExpiresAt = result.ExpiresAt
 			}
 		}
 	}
 
 	// Convert to job object
 	return &Job{
-		ID:        firestoreJob.ID,
-		Status:    JobStatus(firestoreJob.Status),
-		Message:   firestoreJob.Message,
-		ResultURL: resultURL,
-		CreatedAt: firestoreJob.CreatedAt,
-		UpdatedAt: firestoreJob.UpdatedAt,
+		ID:              firestoreJob.ID,
+		OwnerID:         firestoreJob.OwnerID,
+		Status:          JobStatus(firestoreJob.Status),
+		Message:         firestoreJob.Message,
+		ResultURL:       resultURL,
+		ResultExpiresAt: resultExpiresAt,
+		CreatedAt:       firestoreJob.CreatedAt,
+		UpdatedAt:       firestoreJob.UpdatedAt,
+		EventSeq:        firestoreJob.EventSeq,
+		Metrics:         firestoreJob.Metrics,
+		Progress:        firestoreJob.Progress,
+		Webhook:         firestoreJob.Webhook,
+		Cache:           firestoreJob.Cache,
 	}
 }
 
-// WatchJob watches a job for changes and sends updates to the provided channel
+// WatchJob streams a job's event log to the provided channel, starting after the event with
+// sequence number afterSeq so reconnecting clients only receive what they missed.
 // This function will run until the context is canceled or the job reaches a terminal state
-func (s *Service) WatchJob(ctx context.Context, jobID string, updates chan<- JobUpdate) error {
-	// Get initial job state
-	job := s.GetJob(jobID)
+func (s *Service) WatchJob(ctx context.Context, jobID, ownerID string, afterSeq int64, updates chan<- JobUpdate) error {
+	// Get initial job state, which also checks the owner may read it
+	job := s.GetJob(jobID, ownerID)
 	if job == nil {
 		return fmt.Errorf("job not found")
 	}
 
-	// Send initial status
-	updates <- JobUpdate{
-		ID:        job.ID,
-		Status:    job.Status,
-		Message:   job.Message,
-		ResultURL: job.ResultURL,
-		UpdatedAt: job.UpdatedAt,
-	}
-
-	// If job is already in terminal state, we're done
-	if job.Status == StatusCompleted || job.Status == StatusFailed {
-		close(updates)
-		return nil
-	}
-
-	// Set up Firestore snapshot listener for real-time updates
-	docRef := s.Collection().Doc(jobID)
-	snapshots := docRef.Snapshots(ctx)
+	// Listen to the event log; the first snapshot replays every event after afterSeq
+	query := s.EventsCollection(jobID).Where("seq", ">", afterSeq).OrderBy("seq", firestore.Asc)
+	snapshots := query.Snapshots(ctx)
+	defer snapshots.Stop()
 
-	// Watch for updates
+	first := true
 	for {
 		snapshot, err := snapshots.Next()
 		if err != nil {
-			log.Printf("Error watching job %s: %v", jobID, err)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			slog.ErrorContext(ctx, "Error watching job", "job_id", jobID, "error", err)
 			return err
 		}
 
-		if !snapshot.Exists() {
-			log.Printf("Job %s no longer exists", jobID)
-			return fmt.Errorf("job deleted")
-		}
-
-		var firestoreJob FirestoreJob
-		if err := snapshot.DataTo(&firestoreJob); err != nil {
-			log.Printf("Error parsing job data: %v", err)
-			continue
+		events := make([]FirestoreJobEvent, 0, len(snapshot.Changes))
+		for _, change := range snapshot.Changes {
+			if change.Kind != firestore.DocumentAdded {
+				continue
+			}
+			var event FirestoreJobEvent
+			if err := change.Doc.DataTo(&event); err != nil {
+				slog.ErrorContext(ctx, "Error parsing job event", "job_id", jobID, "error", err)
+				continue
+			}
+			events = append(events, event)
 		}
+		sort.Slice(events, func(i, j int) bool { return events[i].Seq < events[j].Seq })
+
+		for _, event := range events {
+			update := JobUpdate{
+				ID:        jobID,
+				Seq:       event.Seq,
+				Status:    JobStatus(event.Status),
+				Message:   event.Message,
+				UpdatedAt: event.At,
+				Progress:  event.Progress,
+				Preview:   event.Preview,
+			}
 
-		// Get result URL if job is completed
-		var resultURL string
-		if firestoreJob.Status == string(StatusCompleted) {
-			resultDoc, err := s.ResultsCollection().Doc(jobID).Get(ctx)
-			if err == nil && resultDoc.Exists() {
-				var result FirestoreResult
-				if err := resultDoc.DataTo(&result); err == nil {
-					resultURL = result.ResultURL
+			// Terminal events carry the result and metrics from the job itself
+			terminal := update.Status == StatusCompleted || update.Status == StatusFailed
+			if terminal {
+				if latest := s.GetJob(jobID, ownerID); latest != nil {
+					update.ResultURL = latest.ResultURL
+					update.ResultExpiresAt = latest.ResultExpiresAt
+					update.Metrics = latest.Metrics
+					update.Cache = latest.Cache
 				}
 			}
-		}
 
-		// Send update
-		update := JobUpdate{
-			ID:        firestoreJob.ID,
-			Status:    JobStatus(firestoreJob.Status),
-			Message:   firestoreJob.Message,
-			ResultURL: resultURL,
-			UpdatedAt: firestoreJob.UpdatedAt,
-		}
+			select {
+			case updates <- update:
+				// Successfully sent
+			case <-ctx.Done():
+				// Context was canceled
+				return ctx.Err()
+			}
 
-		select {
-		case updates <- update:
-			// Successfully sent
-		case <-ctx.Done():
-			// Context was canceled
-			return ctx.Err()
+			// If job is in terminal state, we're done
+			if terminal {
+				return nil
+			}
 		}
 
-		// If job is in terminal state, we're done
-		if update.Status == StatusCompleted || update.Status == StatusFailed {
+		// A finished job with nothing left to replay, e.g. a client reconnecting after the final
+		// event, gets its current state once so the stream can close
+		if first && job.Finished() {
+			select {
+			case updates <- job.Snapshot():
+			case <-ctx.Done():
+				return ctx.Err()
+			}
 			return nil
 		}
+		first = false
 	}
 }
+
 // updateJobStatus updates a job's status in Firestore
 func (s *Service) updateJobStatus(job *Job, status JobStatus, message, resultURL string) {
 	ctx := context.Background()
 	now := time.Now().Unix()
 
-	// Update job in Firestore
-	updates := []firestore.Update{
-		{Path: "status", Value: string(status)},
-		{Path: "message", Value: message},
-		{Path: "updatedAt", Value: now},
-	}
-
-	_, err := s.Collection().Doc(job.ID).Update(ctx, updates)
+	// Update job in Firestore and record the change in its event log
+	err := s.updateJobState(ctx, job.ID, status, message)
 	if err != nil {
-		log.Printf("Failed to update job status in Firestore: %v", err)
+		slog.Error("Failed to update job status in Firestore", "job_id", job.ID, "tenant", job.OwnerID, "error", err)
 	}
 
 	// Update the in-memory job
@@ -429,11 +841,11 @@ func (s *Service) updateJobStatus(job *Job, status JobStatus, message, resultURL
 		job.ResultURL = resultURL
 	}
 
-	log.Printf("Job %s updated: status=%s, message=%s", job.ID, status, message)
+	slog.Info("Job updated", "job_id", job.ID, "tenant", job.OwnerID, "status", status, "message", message)
 }
 
-// GetResult retrieves a job result from Firestore
-func (s *Service) GetResult(ctx context.Context, jobID string) (*FirestoreResult, error) {
+// GetResult retrieves a job result from Firestore, returning an error if the owner may not read it
+func (s *Service) GetResult(ctx context.Context, jobID, ownerID string) (*FirestoreResult, error) {
 	doc, err := s.ResultsCollection().Doc(jobID).Get(ctx)
 	if err != nil {
 		if status.Code(err) == codes.NotFound {
@@ -441,24 +853,125 @@ func (s *Service) GetResult(ctx context.Context, jobID string) (*FirestoreResult
 		}
 		return nil, fmt.Errorf("error retrieving result: %v", err)
 	}
-	
+
 	var result FirestoreResult
 	if err := doc.DataTo(&result); err != nil {
 		return nil, fmt.Errorf("error parsing result data: %v", err)
 	}
-	
+
+	// Report results owned by someone else as not found so IDs can't be probed
+	if !canRead(result.OwnerID, ownerID) {
+		slog.Warn("Denied access to result", "job_id", jobID, "tenant", ownerID)
+		return nil, fmt.Errorf("result not found")
+	}
+
 	// Check if result has expired
 	now := time.Now().Unix()
 	if result.ExpiresAt > 0 && now > result.ExpiresAt {
 		// Result has expired, delete it
-		_, err := s.ResultsCollection().Doc(jobID).Delete(ctx)
-		if err != nil {
-			log.Printf("Failed to delete expired result %s: %v", jobID, err)
+		if err := s.deleteResult(ctx, jobID); err != nil {
+			slog.Error("Failed to delete expired result", "job_id", jobID, "error", err)
 		} else {
-			log.Printf("Deleted expired result %s", jobID)
+			slog.Info("Deleted expired result", "job_id", jobID)
 		}
 		return nil, fmt.Errorf("result has expired")
 	}
-	
+
 	return &result, nil
 }
+
+// GetResultImage retrieves an image referenced by a job result from Firestore
+func (s *Service) GetResultImage(ctx context.Context, jobID, imageID, ownerID string) (*FirestoreResultImage, error) {
+	doc, err := s.ResultsCollection().Doc(jobID).Collection("images").Doc(imageID).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, fmt.Errorf("image not found")
+		}
+		return nil, fmt.Errorf("error retrieving image: %v", err)
+	}
+
+	var image FirestoreResultImage
+	if err := doc.DataTo(&image); err != nil {
+		return nil, fmt.Errorf("error parsing image data: %v", err)
+	}
+
+	if !canRead(image.OwnerID, ownerID) {
+		return nil, fmt.Errorf("image not found")
+	}
+
+	// Images share the expiry of their result
+	now := time.Now().Unix()
+	if image.ExpiresAt > 0 && now > image.ExpiresAt {
+		if err := s.deleteResult(ctx, jobID); err != nil {
+			slog.Error("Failed to delete expired result", "job_id", jobID, "error", err)
+		}
+		return nil, fmt.Errorf("image has expired")
+	}
+
+	return &image, nil
+}
+
+// GetResultImages retrieves all images referenced by a job result from Firestore.
+// Callers must have already checked the owner may read the result.
+func (s *Service) GetResultImages(ctx context.Context, jobID string) ([]FirestoreResultImage, error) {
+	docs, err := s.ResultsCollection().Doc(jobID).Collection("images").Documents(ctx).GetAll()
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving images: %v", err)
+	}
+
+	images := make([]FirestoreResultImage, 0, len(docs))
+	for _, doc := range docs {
+		var image FirestoreResultImage
+		if err := doc.DataTo(&image); err != nil {
+			return nil, fmt.Errorf("error parsing image data: %v", err)
+		}
+		images = append(images, image)
+	}
+	return images, nil
+}
+
+// ConsumeResult deletes a result that may only be read once. Only one caller can consume a
+// result, so it returns an error if the result was already deleted by a concurrent read.
+func (s *Service) ConsumeResult(ctx context.Context, jobID string) error {
+	resultRef := s.ResultsCollection().Doc(jobID)
+
+	// Delete the result document first so a concurrent read can't also succeed
+	if _, err := resultRef.Delete(ctx, firestore.Exists); err != nil {
+		if status.Code(err) == codes.NotFound {
+			return fmt.Errorf("result not found")
+		}
+		return fmt.Errorf("failed to delete result: %v", err)
+	}
+
+	imageRefs, err := resultRef.Collection("images").DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to list result images: %v", err)
+	}
+	for _, imageRef := range imageRefs {
+		if _, err := imageRef.Delete(ctx); err != nil {
+			slog.Error("Failed to delete image of consumed result", "job_id", jobID, "image_id", imageRef.ID, "error", err)
+		}
+	}
+
+	slog.Info("Deleted result after its first read", "job_id", jobID)
+	return nil
+}
+
+// deleteResult deletes a result document along with its images
+func (s *Service) deleteResult(ctx context.Context, jobID string) error {
+	resultRef := s.ResultsCollection().Doc(jobID)
+
+	// Firestore doesn't delete subcollections with their parent, so remove images first
+	imageRefs, err := resultRef.Collection("images").DocumentRefs(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to list result images: %v", err)
+	}
+	for _, imageRef := range imageRefs {
+		if _, err := imageRef.Delete(ctx); err != nil {
+			return fmt.Errorf("failed to delete result image %s: %v", imageRef.ID, err)
+		}
+	}
+
+	_, err = resultRef.Delete(ctx)
+	return err
+}
@@ -0,0 +1,161 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/martin226/slideitin/backend/api/services/telemetry"
+)
+
+// Heartbeat defaults
+const (
+	defaultHeartbeatInterval = 15 * time.Second
+	defaultHeartbeatTimeout  = 2 * time.Minute
+)
+
+// Messages of jobs recovered by the reaper
+const (
+	staleRequeuedMessage = "The slides service stopped responding, waiting to be retried"
+	staleFailedMessage   = "Failed to generate slides: the slides service stopped responding"
+	lostFailedMessage    = "Failed to generate slides: the job was lost before it started"
+)
+
+// loadHeartbeatConfig reads how often held jobs record a heartbeat and how old a heartbeat may get
+// before the job is considered stuck
+func loadHeartbeatConfig() (interval, timeout time.Duration, err error) {
+	interval, timeout = defaultHeartbeatInterval, defaultHeartbeatTimeout
+	if value := os.Getenv("JOB_HEARTBEAT_INTERVAL"); value != "" {
+		interval, err = time.ParseDuration(value)
+		if err != nil || interval <= 0 {
+			return 0, 0, fmt.Errorf("invalid JOB_HEARTBEAT_INTERVAL: %q", value)
+		}
+	}
+	if value := os.Getenv("JOB_HEARTBEAT_TIMEOUT"); value != "" {
+		timeout, err = time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return 0, 0, fmt.Errorf("invalid JOB_HEARTBEAT_TIMEOUT: %q", value)
+		}
+	}
+	// A few heartbeats have to be missed before a job is considered stuck
+	if timeout < 2*interval {
+		return 0, 0, fmt.Errorf("JOB_HEARTBEAT_TIMEOUT (%s) must be at least twice JOB_HEARTBEAT_INTERVAL (%s)", timeout, interval)
+	}
+	return interval, timeout, nil
+}
+
+// lastSeen returns the last time there was any sign of life from a job
+func (job FirestoreJob) lastSeen() int64 {
+	return max(job.HeartbeatAt, job.UpdatedAt)
+}
+
+// KeepAlive records a heartbeat on the jobs returned by jobIDs until ctx is done, so jobs held by
+// this instance without running, such as batch jobs waiting for a slot, aren't reaped as stuck
+func (s *Service) KeepAlive(ctx context.Context, jobIDs func() []string) {
+	ticker := time.NewTicker(s.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		now := time.Now().Unix()
+		for _, jobID := range jobIDs() {
+			_, err := s.Collection().Doc(jobID).Update(ctx, []firestore.Update{{Path: "heartbeatAt", Value: now}})
+			if err != nil && ctx.Err() == nil {
+				slog.WarnContext(ctx, "Failed to record job heartbeat", "job_id", jobID, "error", err)
+			}
+		}
+	}
+}
+
+// watchJob checks a job every heartbeat interval while this instance waits for the slides-service
+// to finish it, and cancels the wait with errJobTakenOver once the job has been requeued or failed
+// elsewhere, e.g. by the reaper because it stopped responding. It returns when ctx is done.
+func (s *Service) watchJob(ctx context.Context, jobID string, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(s.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		doc, err := s.Collection().Doc(jobID).Get(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.WarnContext(ctx, "Failed to check job", "error", err)
+			}
+			continue
+		}
+		var job FirestoreJob
+		if err := doc.DataTo(&job); err != nil {
+			slog.WarnContext(ctx, "Error parsing job data", "error", err)
+			continue
+		}
+		if job.Requeue || job.Status == string(StatusFailed) {
+			cancel(errJobTakenOver)
+			return
+		}
+	}
+}
+
+// reapStaleJobs finds queued and processing jobs nobody has reported as alive within the heartbeat
+// timeout, because the slides-service or the API instance holding them died. Jobs that can be sent
+// again are marked for requeue, the rest are failed. Either way the change is appended to the
+// job's event log, so SSE and WebSocket clients see it instead of hanging.
+func (s *Service) reapStaleJobs(ctx context.Context, maxAttempts int) error {
+	docs, err := s.Collection().Where("status", "in", []string{string(StatusQueued), string(StatusProcessing)}).Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to list unfinished jobs: %v", err)
+	}
+
+	cutoff := time.Now().Add(-s.heartbeatTimeout).Unix()
+	for _, doc := range docs {
+		var job FirestoreJob
+		if err := doc.DataTo(&job); err != nil {
+			slog.ErrorContext(ctx, "Error parsing job data", "job_id", doc.Ref.ID, "error", err)
+			continue
+		}
+		// Jobs already marked for requeue are the requeuer's
+		if job.Requeue || job.lastSeen() >= cutoff {
+			continue
+		}
+
+		// Only reap the job if nothing has happened to it since it was listed
+		stillStale := func(current FirestoreJob) bool {
+			return current.Status == job.Status && !current.Requeue && current.lastSeen() < cutoff
+		}
+		stale := time.Since(time.Unix(job.lastSeen(), 0)).Round(time.Second)
+
+		if job.Task != nil && job.countedAttempts() < maxAttempts {
+			requeued, err := s.updateJobStateIf(ctx, job.ID, StatusQueued, staleRequeuedMessage, &JobProgress{Stage: StageQueued},
+				stillStale, firestore.Update{Path: "requeue", Value: true})
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to requeue stuck job", "job_id", job.ID, "error", err)
+			} else if requeued {
+				slog.WarnContext(ctx, "Requeued stuck job", "job_id", job.ID, "tenant", job.OwnerID, "status", job.Status, "stale_for", stale)
+			}
+			continue
+		}
+
+		message := staleFailedMessage
+		if job.Task == nil {
+			message = lostFailedMessage
+		}
+		failed, err := s.updateJobStateIf(ctx, job.ID, StatusFailed, message, nil, stillStale)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to fail stuck job", "job_id", job.ID, "error", err)
+		} else if failed {
+			telemetry.JobsTotal.WithLabelValues(string(StatusFailed)).Inc()
+			slog.WarnContext(ctx, "Failed stuck job", "job_id", job.ID, "tenant", job.OwnerID, "status", job.Status, "stale_for", stale)
+		}
+	}
+	return nil
+}
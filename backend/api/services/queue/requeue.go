@@ -0,0 +1,344 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/martin226/slideitin/backend/api/services/logging"
+	"github.com/martin226/slideitin/backend/api/services/telemetry"
+)
+
+// Requeue defaults
+const (
+	defaultRequeueInterval    = 30 * time.Second
+	defaultRequeueMaxAttempts = 3
+)
+
+// Statuses of jobs waiting to be sent to the slides-service again
+const (
+	requeuedMessage = "Slides service unavailable, waiting to be retried"
+	refusedMessage  = "Slides service busy, waiting to be retried"
+)
+
+// ErrShuttingDown is returned for new jobs while the service drains before shutting down
+var ErrShuttingDown = errors.New("the service is shutting down, please try again shortly")
+
+// errSlidesServiceUnavailable is returned when the slides-service can't take a job right now, for
+// example because it's shutting down, so the job should be retried rather than failed
+var errSlidesServiceUnavailable = errors.New("slides service unavailable")
+
+// errSlidesServiceBusy is returned when the slides-service refused a job because too many jobs are
+// waiting. The job never started, so the attempt doesn't count towards REQUEUE_MAX_ATTEMPTS.
+var errSlidesServiceBusy = fmt.Errorf("%w: too many jobs waiting", errSlidesServiceUnavailable)
+
+// refusalReasonBusy is the reason the slides-service gives for a job it refused because too many
+// jobs are waiting; other reasons mean it can't run the job at all right now
+const refusalReasonBusy = "busy"
+
+// refusedError is a job the slides-service refused with a 503, wrapping errSlidesServiceBusy or
+// errSlidesServiceUnavailable
+type refusedError struct {
+	err        error
+	retryAfter time.Duration // From the Retry-After header, 0 if it didn't send one
+}
+
+func (e *refusedError) Error() string { return e.err.Error() }
+func (e *refusedError) Unwrap() error { return e.err }
+
+// refusal turns a 503 from the slides-service into a refusedError, telling a busy slides-service
+// from one that can't take the job by the reason in the body
+func refusal(resp *http.Response, body []byte) error {
+	var refused struct {
+		Error  string `json:"error"`
+		Reason string `json:"reason"`
+	}
+	json.Unmarshal(body, &refused)
+
+	err := fmt.Errorf("%w: %s", errSlidesServiceUnavailable, string(body))
+	if refused.Reason == refusalReasonBusy {
+		err = fmt.Errorf("%w: %s", errSlidesServiceBusy, refused.Error)
+	}
+	var retryAfter time.Duration
+	if seconds, parseErr := strconv.Atoi(resp.Header.Get("Retry-After")); parseErr == nil && seconds > 0 {
+		retryAfter = time.Duration(seconds) * time.Second
+	}
+	return &refusedError{err: err, retryAfter: retryAfter}
+}
+
+// retryAfter returns how long the slides-service asked to wait before a job is sent again
+func retryAfter(err error) time.Duration {
+	var refused *refusedError
+	if errors.As(err, &refused) {
+		return refused.retryAfter
+	}
+	return 0
+}
+
+// errJobTakenOver is returned when a job was requeued or failed elsewhere, usually by the reaper
+// after the job stopped responding, while this instance was still waiting for the slides-service
+// to finish it. The job is no longer this instance's to update.
+var errJobTakenOver = errors.New("the job stopped responding and was taken over")
+
+// errAttemptTimedOut is returned when the slides-service didn't finish a job within the attempt
+// timeout set by SLIDES_SERVICE_TIMEOUT
+var errAttemptTimedOut = errors.New("the slides service didn't finish the job in time")
+
+// begin registers a job being sent to the slides-service, returning false once draining has
+// started. Every successful call must be followed by a call to s.inflight.Done.
+func (s *Service) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.inflight.Add(1)
+	return true
+}
+
+// Drain stops accepting new jobs and waits for the jobs being processed until ctx is done. Jobs
+// still running at that point are left to the slides-service, which finishes them or hands them
+// back for a retry.
+func (s *Service) Drain(ctx context.Context) error {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// countedAttempts returns the number of attempts that count towards REQUEUE_MAX_ATTEMPTS, leaving
+// out the ones the slides-service refused because it was busy
+func (job FirestoreJob) countedAttempts() int {
+	return job.Attempts - job.Refusals
+}
+
+// failJob handles a job the slides-service couldn't finish because of err. The job is marked for
+// requeue if the slides-service was unavailable and failed otherwise, unless the slides-service has
+// already handed it back for a retry or the reaper has taken it over. It reports whether the job
+// failed.
+func (s *Service) failJob(job *Job, err error) bool {
+	if errors.Is(err, errJobTakenOver) {
+		slog.Warn("Stopped waiting for job", "job_id", job.ID, "tenant", job.OwnerID, "error", err)
+		return false
+	}
+
+	ctx := context.Background()
+	notRequeued := func(current FirestoreJob) bool { return !current.Requeue }
+
+	status, message, extra := StatusFailed, fmt.Sprintf("Failed to trigger slides service: %v", err), []firestore.Update(nil)
+	var retryAt time.Time
+	if errors.Is(err, errSlidesServiceUnavailable) {
+		status, message = StatusQueued, requeuedMessage
+		extra = append(extra, firestore.Update{Path: "requeue", Value: true})
+		if wait := retryAfter(err); wait > 0 {
+			retryAt = time.Now().Add(wait)
+			extra = append(extra, firestore.Update{Path: "retryAt", Value: retryAt.Unix()})
+		}
+	}
+	if errors.Is(err, errSlidesServiceBusy) {
+		message = refusedMessage
+		extra = append(extra, firestore.Update{Path: "refusals", Value: firestore.Increment(1)})
+	}
+	updated, err := s.updateJobStateIf(ctx, job.ID, status, message, nil, notRequeued, extra...)
+	if err != nil {
+		slog.Error("Failed to update job status in Firestore", "job_id", job.ID, "tenant", job.OwnerID, "error", err)
+	}
+	if !updated && err == nil {
+		status, message = StatusQueued, "Interrupted by a service restart, waiting to be retried"
+	}
+	if updated && !retryAt.IsZero() {
+		s.wakeRequeuer(retryAt)
+	}
+
+	job.Status = status
+	job.Message = message
+	job.UpdatedAt = time.Now().Unix()
+	slog.Info("Job updated", "job_id", job.ID, "tenant", job.OwnerID, "status", status, "message", message)
+	return status == StatusFailed
+}
+
+// RunRequeuer periodically recovers stuck jobs and sends jobs marked for requeue to the
+// slides-service again until ctx is canceled. The interval and the number of attempts per job are
+// set by REQUEUE_INTERVAL and REQUEUE_MAX_ATTEMPTS.
+func (s *Service) RunRequeuer(ctx context.Context) error {
+	interval := defaultRequeueInterval
+	if value := os.Getenv("REQUEUE_INTERVAL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("invalid REQUEUE_INTERVAL: %q", value)
+		}
+		interval = parsed
+	}
+	maxAttempts := defaultRequeueMaxAttempts
+	if value := os.Getenv("REQUEUE_MAX_ATTEMPTS"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return fmt.Errorf("invalid REQUEUE_MAX_ATTEMPTS: %q", value)
+		}
+		maxAttempts = parsed
+	}
+
+	go func() {
+		timer := time.NewTimer(interval)
+		defer timer.Stop()
+		next := time.Now()
+		for {
+			if !time.Now().Before(next) {
+				if err := s.reapStaleJobs(ctx, maxAttempts); err != nil && ctx.Err() == nil {
+					slog.ErrorContext(ctx, "Failed to reap stuck jobs", "error", err)
+				}
+				next = time.Now().Add(interval)
+			}
+			// Wake up early for a refused job whose Retry-After ends before the next interval
+			earliest, err := s.requeueJobs(ctx, maxAttempts)
+			if err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "Failed to requeue jobs", "error", err)
+			}
+			wake := next
+			if !earliest.IsZero() {
+				wake = minTime(wake, earliest)
+			}
+
+			for waiting := true; waiting; {
+				timer.Reset(time.Until(wake))
+				select {
+				case <-ctx.Done():
+					return
+				case <-timer.C:
+					waiting = false
+				case retryAt := <-s.retryWake:
+					wake = minTime(wake, retryAt)
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// minTime returns the earlier of two times
+func minTime(a, b time.Time) time.Time {
+	if b.Before(a) {
+		return b
+	}
+	return a
+}
+
+// wakeRequeuer tells the requeuer a refused job may be sent again at retryAt
+func (s *Service) wakeRequeuer(retryAt time.Time) {
+	select {
+	case s.retryWake <- retryAt:
+	default:
+		// A wake-up is already pending; the requeuer picks up every job due when it runs
+	}
+}
+
+// requeueJobs claims the jobs marked for requeue and sends each one to the slides-service again.
+// Jobs whose Retry-After hasn't passed are left for later; it returns the earliest time one of
+// them may be sent, or the zero time if there are none.
+func (s *Service) requeueJobs(ctx context.Context, maxAttempts int) (time.Time, error) {
+	docs, err := s.Collection().Where("requeue", "==", true).Documents(ctx).GetAll()
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to list jobs to requeue: %v", err)
+	}
+
+	var earliest time.Time
+	now := time.Now()
+	for _, doc := range docs {
+		var job FirestoreJob
+		if err := doc.DataTo(&job); err != nil {
+			slog.ErrorContext(ctx, "Error parsing job data", "job_id", doc.Ref.ID, "error", err)
+			continue
+		}
+
+		// Claim the job so only one API instance sends it, giving up once it has used its attempts.
+		// Jobs refused by a busy slides-service wait as long as it takes.
+		stillRequeued := func(current FirestoreJob) bool { return current.Requeue }
+		unmark := firestore.Update{Path: "requeue", Value: firestore.Delete}
+		if job.Task == nil || job.countedAttempts() >= maxAttempts {
+			message := fmt.Sprintf("Failed to generate slides: the job was interrupted %d times", job.countedAttempts())
+			if job.Task == nil {
+				message = "Failed to generate slides: the job was interrupted and can't be retried"
+			}
+			failed, err := s.updateJobStateIf(ctx, job.ID, StatusFailed, message, nil, stillRequeued, unmark)
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to fail requeued job", "job_id", job.ID, "error", err)
+			} else if failed {
+				telemetry.JobsTotal.WithLabelValues(string(StatusFailed)).Inc()
+				slog.WarnContext(ctx, "Gave up on interrupted job", "job_id", job.ID, "tenant", job.OwnerID, "attempts", job.countedAttempts())
+			}
+			continue
+		}
+
+		if retryAt := time.Unix(job.RetryAt, 0); job.RetryAt != 0 && retryAt.After(now) {
+			if earliest.IsZero() || retryAt.Before(earliest) {
+				earliest = retryAt
+			}
+			continue
+		}
+
+		// Leave the rest to another instance once this one is draining
+		if !s.begin() {
+			return time.Time{}, nil
+		}
+		// Charge the interrupted attempt, in case the instance that sent it didn't, and clear its
+		// metrics so they aren't taken for the next attempt's
+		s.chargeTokens(ctx, job.ID)
+		message := fmt.Sprintf("Retrying the job (attempt %d of %d)", job.countedAttempts()+1, maxAttempts)
+		claimed, err := s.updateJobStateIf(ctx, job.ID, StatusQueued, message, &JobProgress{Stage: StageQueued},
+			stillRequeued, unmark, firestore.Update{Path: "retryAt", Value: firestore.Delete},
+			firestore.Update{Path: "attempts", Value: firestore.Increment(1)},
+			firestore.Update{Path: "metrics", Value: firestore.Delete})
+		if err != nil || !claimed {
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to claim requeued job", "job_id", job.ID, "error", err)
+			}
+			s.inflight.Done()
+			continue
+		}
+		go s.retry(job)
+	}
+	return earliest, nil
+}
+
+// retry sends a claimed job to the slides-service again
+func (s *Service) retry(firestoreJob FirestoreJob) {
+	defer s.inflight.Done()
+
+	started := time.Now()
+	ctx := logging.WithJob(context.Background(), firestoreJob.ID, firestoreJob.OwnerID)
+	ctx, span := telemetry.StartSpan(telemetry.WithJobID(ctx, firestoreJob.ID), "queue.RetryJob")
+
+	telemetry.QueueDepth.Inc()
+	defer telemetry.QueueDepth.Dec()
+
+	job := &Job{ID: firestoreJob.ID, OwnerID: firestoreJob.OwnerID}
+	slog.InfoContext(ctx, "Sending requeued job to the slides service", "attempt", firestoreJob.countedAttempts()+1)
+	_, err := s.triggerSlidesService(ctx, *firestoreJob.Task)
+	telemetry.EndSpan(span, err)
+	s.chargeTokens(ctx, firestoreJob.ID)
+	if err != nil {
+		if s.failJob(job, err) {
+			telemetry.JobFinished(string(StatusFailed), started)
+		}
+		return
+	}
+	telemetry.JobFinished(string(StatusCompleted), started)
+}
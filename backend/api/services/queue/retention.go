@@ -0,0 +1,149 @@
+package queue
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/martin226/slideitin/backend/api/models"
+)
+
+// Default retention applied when the corresponding environment variables are not set
+const (
+	defaultJobTTL    = 5 * time.Minute
+	defaultResultTTL = time.Hour
+)
+
+// Retention values accepted in RESULT_RETENTION and TENANT_RETENTION besides a duration
+const (
+	retentionForever       = "forever"
+	retentionFirstDownload = "first-download"
+)
+
+// retentionPolicies holds the deployment's default retention and any per-tenant overrides
+type retentionPolicies struct {
+	defaults models.RetentionPolicy
+	tenants  map[string]models.RetentionPolicy
+}
+
+// loadRetentionPolicies reads retention configuration from environment variables.
+//
+// JOB_TTL is how long a finished job's status is kept. RESULT_RETENTION is the default result
+// retention and TENANT_RETENTION a comma-separated list of ownerID:retention overrides, where
+// retention is a duration such as 72h, "forever", or "first-download" to delete the result as
+// soon as it has been viewed or downloaded once (or once RESULT_RETENTION passes, whichever is first).
+// A tenant's job TTL is overridden with semicolon-separated fields, e.g. team-a:result=72h;job=1h.
+func loadRetentionPolicies() (*retentionPolicies, error) {
+	jobTTL := defaultJobTTL
+	if value := os.Getenv("JOB_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid JOB_TTL: %q", value)
+		}
+		jobTTL = parsed
+	}
+
+	base := models.RetentionPolicy{
+		JobTTL:    int64(jobTTL.Seconds()),
+		ResultTTL: int64(defaultResultTTL.Seconds()),
+	}
+
+	defaults := base
+	if value := os.Getenv("RESULT_RETENTION"); value != "" {
+		policy, err := parseRetention(value, base)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RESULT_RETENTION: %v", err)
+		}
+		defaults = policy
+	}
+
+	tenants := make(map[string]models.RetentionPolicy)
+	for _, entry := range strings.Split(os.Getenv("TENANT_RETENTION"), ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		// Owner IDs may contain colons, the retention never does
+		separator := strings.LastIndex(entry, ":")
+		if separator <= 0 {
+			return nil, fmt.Errorf("invalid TENANT_RETENTION entry %q: expected ownerID:retention", entry)
+		}
+		policy, err := parseTenantRetention(entry[separator+1:], defaults)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TENANT_RETENTION entry %q: %v", entry, err)
+		}
+		tenants[entry[:separator]] = policy
+	}
+
+	return &retentionPolicies{
+		defaults: defaults,
+		tenants:  tenants,
+	}, nil
+}
+
+// parseTenantRetention applies a TENANT_RETENTION value to base. The value is either a result
+// retention on its own or semicolon-separated result= and job= fields.
+func parseTenantRetention(value string, base models.RetentionPolicy) (models.RetentionPolicy, error) {
+	if !strings.Contains(value, "=") {
+		return parseRetention(value, base)
+	}
+
+	policy := base
+	seen := make(map[string]bool)
+	for _, field := range strings.Split(value, ";") {
+		name, fieldValue, ok := strings.Cut(strings.TrimSpace(field), "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !ok || seen[name] {
+			return policy, fmt.Errorf("expected result=retention;job=duration, got %q", value)
+		}
+		seen[name] = true
+
+		switch name {
+		case "result":
+			// Only the result fields come from the value, the job TTL may be set by its own field
+			result, err := parseRetention(fieldValue, base)
+			if err != nil {
+				return policy, err
+			}
+			policy.ResultTTL = result.ResultTTL
+			policy.KeepForever = result.KeepForever
+			policy.DeleteAfterDownload = result.DeleteAfterDownload
+		case "job":
+			ttl, err := time.ParseDuration(strings.TrimSpace(fieldValue))
+			if err != nil || ttl <= 0 {
+				return policy, fmt.Errorf("expected a duration for job, got %q", fieldValue)
+			}
+			policy.JobTTL = int64(ttl.Seconds())
+		default:
+			return policy, fmt.Errorf("unknown field %q, expected result or job", name)
+		}
+	}
+	return policy, nil
+}
+
+// parseRetention applies a retention value to base
+func parseRetention(value string, base models.RetentionPolicy) (models.RetentionPolicy, error) {
+	policy := models.RetentionPolicy{JobTTL: base.JobTTL, ResultTTL: base.ResultTTL}
+	switch value = strings.ToLower(strings.TrimSpace(value)); value {
+	case retentionForever:
+		policy.KeepForever = true
+	case retentionFirstDownload:
+		policy.DeleteAfterDownload = true
+	default:
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return policy, fmt.Errorf("expected a duration, %q or %q, got %q", retentionForever, retentionFirstDownload, value)
+		}
+		policy.ResultTTL = int64(ttl.Seconds())
+	}
+	return policy, nil
+}
+
+// forOwner returns the retention policy that applies to an owner's jobs
+func (p *retentionPolicies) forOwner(ownerID string) models.RetentionPolicy {
+	if policy, ok := p.tenants[ownerID]; ok && ownerID != "" {
+		return policy
+	}
+	return p.defaults
+}
@@ -0,0 +1,44 @@
+package queue
+
+import (
+	"context"
+	"log/slog"
+
+	"cloud.google.com/go/firestore"
+)
+
+// chargeTokens charges the Gemini tokens the slides-service recorded for a job's latest attempt to
+// the caller the job was created for. Each attempt is charged once, whether it completed, failed
+// or was interrupted, so retried jobs pay for every attempt.
+func (s *Service) chargeTokens(ctx context.Context, jobID string) {
+	jobRef := s.Collection().Doc(jobID)
+	var job FirestoreJob
+	charge := false
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		charge = false
+		doc, err := tx.Get(jobRef)
+		if err != nil {
+			return err
+		}
+		if err := doc.DataTo(&job); err != nil {
+			return err
+		}
+		if job.Metrics == nil || job.UsageKey == "" || job.ChargedAttempt >= job.Attempts {
+			return nil
+		}
+		charge = true
+		return tx.Update(jobRef, []firestore.Update{{Path: "chargedAttempt", Value: job.Attempts}})
+	})
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to read job token usage", "job_id", jobID, "error", err)
+		return
+	}
+	if !charge {
+		return
+	}
+
+	// Failing to record the tokens shouldn't fail the job
+	if err := s.usage.RecordTokens(ctx, job.UsageKey, job.Metrics.InputTokens, job.Metrics.OutputTokens); err != nil {
+		slog.ErrorContext(ctx, "Failed to record usage", "job_id", jobID, "error", err)
+	}
+}
@@ -0,0 +1,244 @@
+package share
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/google/uuid"
+	"golang.org/x/crypto/bcrypt"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Default link lifetimes applied when the corresponding environment variables are not set
+const (
+	defaultTTL    = 24 * time.Hour
+	defaultMaxTTL = 7 * 24 * time.Hour
+)
+
+var (
+	// ErrDisabled is returned when no signing secret is configured
+	ErrDisabled = errors.New("result sharing is not enabled")
+	// ErrInvalidLink is returned when a link's signature doesn't match
+	ErrInvalidLink = errors.New("invalid share link")
+	// ErrExpired is returned when a link is past its expiry
+	ErrExpired = errors.New("share link has expired")
+	// ErrRevoked is returned when a link has been revoked by its owner
+	ErrRevoked = errors.New("share link has been revoked")
+	// ErrNotFound is returned when a share doesn't exist or belongs to someone else
+	ErrNotFound = errors.New("share link not found")
+)
+
+// FirestoreShare is the Firestore representation of a share link
+type FirestoreShare struct {
+	ID           string `firestore:"id"`
+	JobID        string `firestore:"jobId"`
+	OwnerID      string `firestore:"ownerId,omitempty"`
+	PasswordHash []byte `firestore:"passwordHash,omitempty"`
+	Revoked      bool   `firestore:"revoked"`
+	CreatedAt    int64  `firestore:"createdAt"`
+	ExpiresAt    int64  `firestore:"expiresAt"`
+	RevokedAt    int64  `firestore:"revokedAt,omitempty"`
+}
+
+// HasPassword reports whether the link is password protected
+func (s *FirestoreShare) HasPassword() bool {
+	return len(s.PasswordHash) > 0
+}
+
+// Service creates and validates signed, expiring share links for results
+type Service struct {
+	client     *firestore.Client
+	secret     []byte
+	defaultTTL time.Duration
+	maxTTL     time.Duration
+}
+
+// NewService creates a new share service configured from environment variables.
+// Sharing is disabled unless SHARE_SIGNING_SECRET is set.
+func NewService(client *firestore.Client) (*Service, error) {
+	ttl := defaultTTL
+	if value := os.Getenv("SHARE_DEFAULT_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid SHARE_DEFAULT_TTL: %q", value)
+		}
+		ttl = parsed
+	}
+
+	maxTTL := defaultMaxTTL
+	if value := os.Getenv("SHARE_MAX_TTL"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid SHARE_MAX_TTL: %q", value)
+		}
+		maxTTL = parsed
+	}
+	if ttl > maxTTL {
+		ttl = maxTTL
+	}
+
+	return &Service{
+		client:     client,
+		secret:     []byte(os.Getenv("SHARE_SIGNING_SECRET")),
+		defaultTTL: ttl,
+		maxTTL:     maxTTL,
+	}, nil
+}
+
+// Collection returns the Firestore collection reference for share links
+func (s *Service) Collection() *firestore.CollectionRef {
+	return s.client.Collection("shares")
+}
+
+// MaxTTL returns the longest lifetime a link may be given
+func (s *Service) MaxTTL() time.Duration {
+	return s.maxTTL
+}
+
+// CreateShare stores a new share link for a result. A zero ttl uses the default lifetime and an
+// empty password leaves the link unprotected. The link expires no later than notAfter, the
+// result's own expiry, unless that is 0.
+func (s *Service) CreateShare(ctx context.Context, jobID, ownerID string, ttl time.Duration, notAfter int64, password string) (*FirestoreShare, error) {
+	if len(s.secret) == 0 {
+		return nil, ErrDisabled
+	}
+	if ttl == 0 {
+		ttl = s.defaultTTL
+	}
+	if ttl < 0 || ttl > s.maxTTL {
+		return nil, fmt.Errorf("ttl must be between 0 and %s", s.maxTTL)
+	}
+
+	now := time.Now()
+	share := FirestoreShare{
+		ID:        uuid.New().String(),
+		JobID:     jobID,
+		OwnerID:   ownerID,
+		CreatedAt: now.Unix(),
+		ExpiresAt: now.Add(ttl).Unix(),
+	}
+	if notAfter != 0 && share.ExpiresAt > notAfter {
+		share.ExpiresAt = notAfter
+	}
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, fmt.Errorf("failed to hash password: %v", err)
+		}
+		share.PasswordHash = hash
+	}
+
+	if _, err := s.Collection().Doc(share.ID).Set(ctx, share); err != nil {
+		slog.ErrorContext(ctx, "Failed to add share to Firestore", "job_id", jobID, "error", err)
+		return nil, fmt.Errorf("failed to store share link: %v", err)
+	}
+
+	slog.InfoContext(ctx, "Created share", "share_id", share.ID, "job_id", jobID, "expires_at", time.Unix(share.ExpiresAt, 0).Format(time.RFC3339))
+	return &share, nil
+}
+
+// URL returns the signed result URL for a share, relative like a job's result URL
+func (s *Service) URL(share *FirestoreShare) string {
+	query := url.Values{}
+	query.Set("share", share.ID)
+	query.Set("expires", strconv.FormatInt(share.ExpiresAt, 10))
+	query.Set("sig", s.sign(share.ID, share.JobID, share.ExpiresAt))
+	return "/results/" + share.JobID + "?" + query.Encode()
+}
+
+// sign computes the signature binding a share to its result and expiry
+func (s *Service) sign(shareID, jobID string, expiresAt int64) string {
+	mac := hmac.New(sha256.New, s.secret)
+	fmt.Fprintf(mac, "%s.%s.%d", shareID, jobID, expiresAt)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Validate checks a share link's signature, expiry and revocation and returns the share
+func (s *Service) Validate(ctx context.Context, jobID, shareID, expires, signature string) (*FirestoreShare, error) {
+	if len(s.secret) == 0 {
+		return nil, ErrDisabled
+	}
+
+	// Check the signature before touching Firestore so forged links are cheap to reject
+	expiresAt, err := strconv.ParseInt(expires, 10, 64)
+	if err != nil {
+		return nil, ErrInvalidLink
+	}
+	if !hmac.Equal([]byte(signature), []byte(s.sign(shareID, jobID, expiresAt))) {
+		return nil, ErrInvalidLink
+	}
+	if time.Now().Unix() > expiresAt {
+		return nil, ErrExpired
+	}
+
+	share, err := s.getShare(ctx, shareID)
+	if err != nil {
+		return nil, err
+	}
+	if share.JobID != jobID || share.ExpiresAt != expiresAt {
+		return nil, ErrInvalidLink
+	}
+	if share.Revoked {
+		return nil, ErrRevoked
+	}
+	return share, nil
+}
+
+// CheckPassword reports whether password unlocks the share
+func (s *Service) CheckPassword(share *FirestoreShare, password string) bool {
+	if !share.HasPassword() {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword(share.PasswordHash, []byte(password)) == nil
+}
+
+// Revoke disables a share link so it can no longer be used
+func (s *Service) Revoke(ctx context.Context, jobID, shareID, ownerID string) error {
+	share, err := s.getShare(ctx, shareID)
+	if err != nil {
+		return err
+	}
+	// Report shares owned by someone else as not found so IDs can't be probed
+	if share.JobID != jobID || (share.OwnerID != "" && share.OwnerID != ownerID) {
+		return ErrNotFound
+	}
+
+	_, err = s.Collection().Doc(shareID).Update(ctx, []firestore.Update{
+		{Path: "revoked", Value: true},
+		{Path: "revokedAt", Value: time.Now().Unix()},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to revoke share link: %v", err)
+	}
+
+	slog.InfoContext(ctx, "Revoked share", "share_id", shareID, "job_id", jobID)
+	return nil
+}
+
+// getShare retrieves a share by its ID from Firestore
+func (s *Service) getShare(ctx context.Context, shareID string) (*FirestoreShare, error) {
+	doc, err := s.Collection().Doc(shareID).Get(ctx)
+	if err != nil {
+		if status.Code(err) == codes.NotFound {
+			return nil, ErrNotFound
+		}
+		return nil, fmt.Errorf("error retrieving share link: %v", err)
+	}
+
+	var share FirestoreShare
+	if err := doc.DataTo(&share); err != nil {
+		return nil, fmt.Errorf("error parsing share link data: %v", err)
+	}
+	return &share, nil
+}
@@ -0,0 +1,130 @@
+package share
+
+import (
+	"context"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestURLSignature(t *testing.T) {
+	s := &Service{secret: []byte("test-secret")}
+	share := &FirestoreShare{ID: "share-1", JobID: "job-1", ExpiresAt: time.Now().Add(time.Hour).Unix()}
+
+	link := s.URL(share)
+	path, rawQuery, found := strings.Cut(link, "?")
+	if !found || path != "/results/job-1" {
+		t.Fatalf("URL() = %q, want a link to /results/job-1", link)
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		t.Fatalf("URL() query: %v", err)
+	}
+	if query.Get("share") != share.ID || query.Get("expires") != strconv.FormatInt(share.ExpiresAt, 10) {
+		t.Errorf("URL() query = %v, want the share ID and expiry", query)
+	}
+	if query.Get("sig") != s.sign(share.ID, share.JobID, share.ExpiresAt) {
+		t.Errorf("URL() signature doesn't match sign()")
+	}
+}
+
+func TestSign(t *testing.T) {
+	s := &Service{secret: []byte("test-secret")}
+	base := s.sign("share-1", "job-1", 1000)
+
+	tests := []struct {
+		name string
+		sig  string
+	}{
+		{name: "other share", sig: s.sign("share-2", "job-1", 1000)},
+		{name: "other job", sig: s.sign("share-1", "job-2", 1000)},
+		{name: "other expiry", sig: s.sign("share-1", "job-1", 1001)},
+		{name: "other secret", sig: (&Service{secret: []byte("other-secret")}).sign("share-1", "job-1", 1000)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.sig == base {
+				t.Error("signature matches the original link's")
+			}
+		})
+	}
+	if s.sign("share-1", "job-1", 1000) != base {
+		t.Error("sign() isn't deterministic")
+	}
+}
+
+// TestValidateRejects covers the checks Validate makes before looking the share up in Firestore
+func TestValidateRejects(t *testing.T) {
+	s := &Service{secret: []byte("test-secret")}
+	future := time.Now().Add(time.Hour).Unix()
+	past := time.Now().Add(-time.Minute).Unix()
+	format := func(unix int64) string { return strconv.FormatInt(unix, 10) }
+
+	tests := []struct {
+		name      string
+		service   *Service
+		jobID     string
+		expires   string
+		signature string
+		wantErr   error
+	}{
+		{
+			name:      "sharing disabled",
+			service:   &Service{},
+			jobID:     "job-1",
+			expires:   format(future),
+			signature: s.sign("share-1", "job-1", future),
+			wantErr:   ErrDisabled,
+		},
+		{
+			name:      "bad signature",
+			jobID:     "job-1",
+			expires:   format(future),
+			signature: "not-a-signature",
+			wantErr:   ErrInvalidLink,
+		},
+		{
+			name:      "link for another job",
+			jobID:     "job-2",
+			expires:   format(future),
+			signature: s.sign("share-1", "job-1", future),
+			wantErr:   ErrInvalidLink,
+		},
+		{
+			name:      "expiry extended",
+			jobID:     "job-1",
+			expires:   format(future + 3600),
+			signature: s.sign("share-1", "job-1", future),
+			wantErr:   ErrInvalidLink,
+		},
+		{
+			name:      "malformed expiry",
+			jobID:     "job-1",
+			expires:   "tomorrow",
+			signature: s.sign("share-1", "job-1", future),
+			wantErr:   ErrInvalidLink,
+		},
+		{
+			name:      "expired",
+			jobID:     "job-1",
+			expires:   format(past),
+			signature: s.sign("share-1", "job-1", past),
+			wantErr:   ErrExpired,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			service := tt.service
+			if service == nil {
+				service = s
+			}
+			_, err := service.Validate(context.Background(), tt.jobID, "share-1", tt.expires, tt.signature)
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("Validate() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,128 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// jobDurationBuckets covers jobs from a few seconds up to the slides-service timeout
+var jobDurationBuckets = []float64{1, 2.5, 5, 10, 20, 30, 45, 60, 90, 120, 180, 300}
+
+var (
+	// JobsTotal counts jobs as they are queued and as they finish
+	JobsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "slideitin_jobs_total",
+		Help: "Jobs by status: queued when accepted, then completed or failed.",
+	}, []string{"status"})
+
+	// QueueDepth is the number of jobs that have been accepted but haven't finished
+	QueueDepth = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "slideitin_queue_depth",
+		Help: "Jobs accepted by the API that haven't completed or failed yet.",
+	})
+
+	// JobDuration observes the end-to-end latency of a job, from being accepted until it finishes
+	JobDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "slideitin_job_duration_seconds",
+		Help:    "End-to-end job latency from acceptance to completion or failure.",
+		Buckets: jobDurationBuckets,
+	}, []string{"status"})
+
+	// CacheLookups counts the outcome of checking the result cache for new jobs
+	CacheLookups = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "slideitin_result_cache_lookups_total",
+		Help: "Result cache lookups for new jobs by outcome: hit, miss or skipped when the cache couldn't be checked.",
+	}, []string{"result"})
+
+	// FirestoreDuration observes the latency of Firestore RPCs
+	FirestoreDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "slideitin_firestore_operation_duration_seconds",
+		Help:    "Latency of Firestore operations by RPC method and gRPC status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "code"})
+)
+
+// MetricsServer serves the metrics in the Prometheus exposition format at /metrics on addr. It is
+// kept off the public router so only scrapers that can reach the port see them.
+func MetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+// JobFinished records a job reaching a terminal status
+func JobFinished(status string, started time.Time) {
+	JobsTotal.WithLabelValues(status).Inc()
+	JobDuration.WithLabelValues(status).Observe(time.Since(started).Seconds())
+}
+
+// FirestoreClientOptions instrument the RPCs of a Firestore client created with them
+func FirestoreClientOptions() []option.ClientOption {
+	return []option.ClientOption{
+		option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(unaryInterceptor)),
+		option.WithGRPCDialOption(grpc.WithChainStreamInterceptor(streamInterceptor)),
+	}
+}
+
+// operationName turns a full gRPC method such as /google.firestore.v1.Firestore/Commit into Commit
+func operationName(method string) string {
+	return method[strings.LastIndex(method, "/")+1:]
+}
+
+// observeFirestore records one Firestore operation
+func observeFirestore(method string, started time.Time, err error) {
+	FirestoreDuration.WithLabelValues(operationName(method), status.Code(err).String()).Observe(time.Since(started).Seconds())
+}
+
+func unaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	started := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	observeFirestore(method, started, err)
+	return err
+}
+
+func streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	// Listen streams stay open for as long as someone watches a job, so their duration says nothing
+	if operationName(method) == "Listen" {
+		return streamer(ctx, desc, cc, method, opts...)
+	}
+
+	started := time.Now()
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		observeFirestore(method, started, err)
+		return nil, err
+	}
+	return &timedStream{ClientStream: stream, method: method, started: started}, nil
+}
+
+// timedStream records a streaming operation, e.g. a document get or query, once it has been read to the end
+type timedStream struct {
+	grpc.ClientStream
+	method   string
+	started  time.Time
+	observed bool
+}
+
+func (s *timedStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil && !s.observed {
+		s.observed = true
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		observeFirestore(s.method, s.started, err)
+	}
+	return err
+}
@@ -0,0 +1,136 @@
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName identifies spans created by this service's own instrumentation
+const tracerName = "github.com/martin226/slideitin/backend/api"
+
+// JobIDKey is the span attribute holding the ID of the job a span belongs to
+const JobIDKey = attribute.Key("job.id")
+
+// InitTracing installs the global tracer provider and W3C trace context propagation. Spans are
+// exported over OTLP/HTTP when OTEL_EXPORTER_OTLP_ENDPOINT or OTEL_EXPORTER_OTLP_TRACES_ENDPOINT
+// is set, e.g. to a local collector at http://localhost:4318; otherwise tracing only propagates
+// incoming trace context. The returned function flushes pending spans.
+func InitTracing(ctx context.Context, serviceName string) (func(context.Context) error, error) {
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") == "" && os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT") == "" {
+		slog.Info("Tracing export disabled: OTEL_EXPORTER_OTLP_ENDPOINT not set")
+		return func(context.Context) error { return nil }, nil
+	}
+
+	// The exporter reads the endpoint, headers and TLS settings from the standard OTEL_ variables
+	exporter, err := otlptracehttp.New(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create OTLP trace exporter: %v", err)
+	}
+
+	// Later detectors win, so OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence over
+	// the default name
+	res, err := resource.New(ctx,
+		resource.WithAttributes(semconv.ServiceName(serviceName)),
+		resource.WithTelemetrySDK(),
+		resource.WithFromEnv(),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create trace resource: %v", err)
+	}
+
+	// The sampler can be configured with OTEL_TRACES_SAMPLER, it defaults to sampling everything
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	slog.Info("Exporting traces over OTLP", "service_name", serviceName)
+	return provider.Shutdown, nil
+}
+
+// WithJobID returns ctx carrying the job ID as baggage. Spans started from it are tagged with the
+// job, including the slides-service's since baggage is propagated with the trace context.
+func WithJobID(ctx context.Context, jobID string) context.Context {
+	member, err := baggage.NewMember(string(JobIDKey), jobID)
+	if err != nil {
+		return ctx
+	}
+	bag, err := baggage.FromContext(ctx).SetMember(member)
+	if err != nil {
+		return ctx
+	}
+	return baggage.ContextWithBaggage(ctx, bag)
+}
+
+// jobAttributes returns the job ID attribute if ctx carries one
+func jobAttributes(ctx context.Context) []attribute.KeyValue {
+	jobID := baggage.FromContext(ctx).Member(string(JobIDKey)).Value()
+	if jobID == "" {
+		return nil
+	}
+	return []attribute.KeyValue{JobIDKey.String(jobID)}
+}
+
+// StartSpan starts a span as a child of any span in ctx, tagged with the job ID from ctx
+func StartSpan(ctx context.Context, name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	attrs = append(jobAttributes(ctx), attrs...)
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// EndSpan ends a span, marking it as failed if err is set
+func EndSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// TracingMiddleware starts a server span for each request, continuing the caller's trace if the
+// request carries W3C trace context headers
+func TracingMiddleware() gin.HandlerFunc {
+	return func(ctx *gin.Context) {
+		parent := otel.GetTextMapPropagator().Extract(ctx.Request.Context(), propagation.HeaderCarrier(ctx.Request.Header))
+
+		// Name spans by route rather than path so IDs don't make every span name unique
+		route := ctx.FullPath()
+		if route == "" {
+			route = "unmatched"
+		}
+		spanCtx, span := otel.Tracer(tracerName).Start(parent, ctx.Request.Method+" "+route,
+			trace.WithSpanKind(trace.SpanKindServer),
+			trace.WithAttributes(
+				semconv.HTTPRequestMethodKey.String(ctx.Request.Method),
+				semconv.HTTPRoute(route),
+			),
+			trace.WithAttributes(jobAttributes(parent)...),
+		)
+		defer span.End()
+
+		ctx.Request = ctx.Request.WithContext(spanCtx)
+		ctx.Next()
+
+		status := ctx.Writer.Status()
+		span.SetAttributes(semconv.HTTPResponseStatusCode(status))
+		if status >= 500 {
+			span.SetStatus(codes.Error, fmt.Sprintf("HTTP %d", status))
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package usage
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/martin226/slideitin/backend/api/models"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Quota periods
+const (
+	PeriodDaily   = "daily"
+	PeriodMonthly = "monthly"
+)
+
+// usageTTL is how long a usage document is kept after its window has ended
+const usageTTL = 7 * 24 * time.Hour
+
+// FirestoreUsage is the Firestore representation of one caller's usage in one quota window
+type FirestoreUsage struct {
+	Key          string `firestore:"key"`
+	Period       string `firestore:"period"`
+	Window       string `firestore:"window"`
+	Jobs         int64  `firestore:"jobs"`
+	InputTokens  int64  `firestore:"inputTokens"`
+	OutputTokens int64  `firestore:"outputTokens"`
+	UpdatedAt    int64  `firestore:"updatedAt"`
+	ExpiresAt    int64  `firestore:"expiresAt"`
+}
+
+// QuotaError is returned when a caller has used up one of their quotas
+type QuotaError struct {
+	Period     string
+	Resource   string
+	Limit      int64
+	RetryAfter time.Duration
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%s %s quota of %d exceeded", e.Period, e.Resource, e.Limit)
+}
+
+// Reservation is a number of jobs counted against a caller's quotas by ReserveJobs. It records the
+// usage documents they were counted in, so jobs given back after a window has rolled over are taken
+// off the window they were counted in rather than the current one.
+type Reservation struct {
+	Key  string
+	Docs []string
+}
+
+// window is a single quota window, such as one UTC day
+type window struct {
+	period   string
+	id       string
+	resetsAt time.Time
+	limits   models.UsageCounts
+}
+
+// Service tracks per-caller usage and enforces daily and monthly quotas
+type Service struct {
+	client  *firestore.Client
+	daily   models.UsageCounts
+	monthly models.UsageCounts
+}
+
+// NewService creates a new usage service with quotas configured from environment variables.
+// A limit of 0 or an unset variable means unlimited.
+func NewService(client *firestore.Client) (*Service, error) {
+	s := &Service{client: client}
+
+	limits := []struct {
+		name  string
+		value *int64
+	}{
+		{"QUOTA_DAILY_JOBS", &s.daily.Jobs},
+		{"QUOTA_DAILY_INPUT_TOKENS", &s.daily.InputTokens},
+		{"QUOTA_DAILY_OUTPUT_TOKENS", &s.daily.OutputTokens},
+		{"QUOTA_MONTHLY_JOBS", &s.monthly.Jobs},
+		{"QUOTA_MONTHLY_INPUT_TOKENS", &s.monthly.InputTokens},
+		{"QUOTA_MONTHLY_OUTPUT_TOKENS", &s.monthly.OutputTokens},
+	}
+	for _, limit := range limits {
+		value := os.Getenv(limit.name)
+		if value == "" {
+			continue
+		}
+		parsed, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || parsed < 0 {
+			return nil, fmt.Errorf("invalid %s: %q", limit.name, value)
+		}
+		*limit.value = parsed
+	}
+
+	return s, nil
+}
+
+// Collection returns the Firestore collection reference for usage records
+func (s *Service) Collection() *firestore.CollectionRef {
+	return s.client.Collection("usage")
+}
+
+// windows returns the quota windows that contain now
+func (s *Service) windows(now time.Time) []window {
+	now = now.UTC()
+	startOfDay := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	startOfMonth := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	return []window{
+		{period: PeriodDaily, id: now.Format("2006-01-02"), resetsAt: startOfDay.AddDate(0, 0, 1), limits: s.daily},
+		{period: PeriodMonthly, id: now.Format("2006-01"), resetsAt: startOfMonth.AddDate(0, 1, 0), limits: s.monthly},
+	}
+}
+
+// doc returns the usage document for a caller in a window
+func (s *Service) doc(key string, w window) *firestore.DocumentRef {
+	// Owner IDs may contain characters that aren't allowed in document IDs
+	return s.Collection().Doc(url.PathEscape(key) + "_" + w.id)
+}
+
+// ReserveJobs checks every quota for the caller and, if none is exhausted, counts n new jobs
+// against them. It returns a *QuotaError when a quota would be exceeded.
+func (s *Service) ReserveJobs(ctx context.Context, key string, n int) (Reservation, error) {
+	now := time.Now()
+	windows := s.windows(now)
+
+	reservation := Reservation{Key: key}
+	for _, w := range windows {
+		reservation.Docs = append(reservation.Docs, s.doc(key, w).ID)
+	}
+
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		// Firestore transactions must do all reads before any writes
+		records := make([]FirestoreUsage, len(windows))
+		for i, w := range windows {
+			doc, err := tx.Get(s.doc(key, w))
+			if err != nil && status.Code(err) != codes.NotFound {
+				return fmt.Errorf("error retrieving usage: %v", err)
+			}
+			if err == nil {
+				if err := doc.DataTo(&records[i]); err != nil {
+					return fmt.Errorf("error parsing usage data: %v", err)
+				}
+			}
+		}
+
+		for i, w := range windows {
+			retryAfter := w.resetsAt.Sub(now)
+			switch {
+			case w.limits.Jobs > 0 && records[i].Jobs+int64(n) > w.limits.Jobs:
+				return &QuotaError{Period: w.period, Resource: "job", Limit: w.limits.Jobs, RetryAfter: retryAfter}
+			case w.limits.InputTokens > 0 && records[i].InputTokens >= w.limits.InputTokens:
+				return &QuotaError{Period: w.period, Resource: "input token", Limit: w.limits.InputTokens, RetryAfter: retryAfter}
+			case w.limits.OutputTokens > 0 && records[i].OutputTokens >= w.limits.OutputTokens:
+				return &QuotaError{Period: w.period, Resource: "output token", Limit: w.limits.OutputTokens, RetryAfter: retryAfter}
+			}
+		}
+
+		for i, w := range windows {
+			record := records[i]
+			record.Key = key
+			record.Period = w.period
+			record.Window = w.id
+			record.Jobs += int64(n)
+			record.UpdatedAt = now.Unix()
+			record.ExpiresAt = w.resetsAt.Add(usageTTL).Unix()
+			if err := tx.Set(s.doc(key, w), record); err != nil {
+				return fmt.Errorf("failed to store usage: %v", err)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return Reservation{}, err
+	}
+	return reservation, nil
+}
+
+// ReleaseJobs gives back n of the jobs in a reservation that were never started or failed, in the
+// windows they were counted in
+func (s *Service) ReleaseJobs(ctx context.Context, reservation Reservation, n int) error {
+	now := time.Now()
+	for _, id := range reservation.Docs {
+		_, err := s.Collection().Doc(id).Update(ctx, []firestore.Update{
+			{Path: "jobs", Value: firestore.Increment(-n)},
+			{Path: "updatedAt", Value: now.Unix()},
+		})
+		// A window whose usage has already expired has nothing to give back
+		if err != nil && status.Code(err) != codes.NotFound {
+			slog.ErrorContext(ctx, "Failed to release reserved jobs", "tenant", reservation.Key, "error", err)
+			return fmt.Errorf("failed to release reserved jobs: %v", err)
+		}
+	}
+	return nil
+}
+
+// RecordTokens adds the Gemini token usage of a finished job to the caller's usage
+func (s *Service) RecordTokens(ctx context.Context, key string, inputTokens, outputTokens int64) error {
+	if inputTokens == 0 && outputTokens == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	for _, w := range s.windows(now) {
+		// Increment so concurrent jobs for the same caller don't overwrite each other
+		_, err := s.doc(key, w).Set(ctx, map[string]interface{}{
+			"key":          key,
+			"period":       w.period,
+			"window":       w.id,
+			"inputTokens":  firestore.Increment(inputTokens),
+			"outputTokens": firestore.Increment(outputTokens),
+			"updatedAt":    now.Unix(),
+			"expiresAt":    w.resetsAt.Add(usageTTL).Unix(),
+		}, firestore.MergeAll)
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to record token usage", "tenant", key, "error", err)
+			return fmt.Errorf("failed to record token usage: %v", err)
+		}
+	}
+	return nil
+}
+
+// GetUsage returns the caller's usage and limits for the current day and month
+func (s *Service) GetUsage(ctx context.Context, key string) (*models.UsageResponse, error) {
+	periods := make([]models.UsagePeriod, 0, 2)
+	for _, w := range s.windows(time.Now()) {
+		var record FirestoreUsage
+		doc, err := s.doc(key, w).Get(ctx)
+		if err != nil && status.Code(err) != codes.NotFound {
+			return nil, fmt.Errorf("error retrieving usage: %v", err)
+		}
+		if err == nil {
+			if err := doc.DataTo(&record); err != nil {
+				return nil, fmt.Errorf("error parsing usage data: %v", err)
+			}
+		}
+
+		periods = append(periods, models.UsagePeriod{
+			Window: w.id,
+			Used: models.UsageCounts{
+				Jobs:         record.Jobs,
+				InputTokens:  record.InputTokens,
+				OutputTokens: record.OutputTokens,
+			},
+			Limits:   w.limits,
+			ResetsAt: w.resetsAt.Unix(),
+		})
+	}
+
+	return &models.UsageResponse{
+		Daily:   periods[0],
+		Monthly: periods[1],
+	}, nil
+}
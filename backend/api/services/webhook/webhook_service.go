@@ -0,0 +1,458 @@
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/google/uuid"
+	"github.com/martin226/slideitin/backend/api/models"
+	"github.com/martin226/slideitin/backend/api/services/logging"
+	"github.com/martin226/slideitin/backend/api/services/queue"
+)
+
+// Default limits applied when the corresponding environment variables are not set
+const (
+	defaultMaxAttempts = 5
+	defaultTimeout     = 10 * time.Second
+
+	// Retries wait retryBaseDelay, then twice as long each time
+	retryBaseDelay = 5 * time.Second
+
+	// How often pending webhooks are checked for retries that have become due
+	sweepInterval = 5 * time.Second
+
+	minSecretLength = 16
+)
+
+// Headers sent with every delivery
+const (
+	HeaderSignature = "X-Slideitin-Signature"
+	HeaderEvent     = "X-Slideitin-Event"
+	HeaderDelivery  = "X-Slideitin-Delivery"
+)
+
+// errNonPublicAddress is returned when a callback resolves to a loopback or private address
+var errNonPublicAddress = errors.New("callback address is not public")
+
+// Service delivers signed completion callbacks for jobs
+type Service struct {
+	client       *firestore.Client
+	queueService *queue.Service
+	httpClient   *http.Client
+	maxAttempts  int
+	allowPrivate bool
+	publicURL    string
+
+	// An instance delivering a webhook holds it for this long, after which another may retry it
+	lease time.Duration
+
+	// Wakes Run up when a job may have finished
+	wake chan struct{}
+
+	// Attempts in progress, tracked so a shutdown can wait for them
+	mu       sync.Mutex
+	inflight sync.WaitGroup
+	draining bool
+}
+
+// NewService creates a new webhook service configured from environment variables
+func NewService(client *firestore.Client, queueService *queue.Service) (*Service, error) {
+	maxAttempts := defaultMaxAttempts
+	if value := os.Getenv("WEBHOOK_MAX_ATTEMPTS"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid WEBHOOK_MAX_ATTEMPTS: %q", value)
+		}
+		maxAttempts = parsed
+	}
+
+	timeout := defaultTimeout
+	if value := os.Getenv("WEBHOOK_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid WEBHOOK_TIMEOUT: %q", value)
+		}
+		timeout = parsed
+	}
+
+	// Private addresses are only reachable when explicitly allowed, e.g. for local development
+	allowPrivate := os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true"
+	dialer := &net.Dialer{
+		Timeout: timeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			if allowPrivate {
+				return nil
+			}
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || !isPublicIP(ip) {
+				return errNonPublicAddress
+			}
+			return nil
+		},
+	}
+
+	return &Service{
+		client:       client,
+		queueService: queueService,
+		httpClient: &http.Client{
+			Timeout:   timeout,
+			Transport: &http.Transport{DialContext: dialer.DialContext},
+			// Receivers must answer at the registered URL rather than send us elsewhere
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		maxAttempts:  maxAttempts,
+		allowPrivate: allowPrivate,
+		publicURL:    strings.TrimSuffix(os.Getenv("PUBLIC_API_URL"), "/"),
+		lease:        2 * timeout,
+		wake:         make(chan struct{}, 1),
+	}, nil
+}
+
+// isPublicIP reports whether ip is routable on the public internet
+func isPublicIP(ip net.IP) bool {
+	return !(ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast())
+}
+
+// ValidateCallback checks a callback URL and signing secret supplied with a request
+func (s *Service) ValidateCallback(callbackURL, secret string) error {
+	u, err := url.Parse(callbackURL)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid callbackUrl")
+	}
+	if u.Scheme != "https" && !(s.allowPrivate && u.Scheme == "http") {
+		return fmt.Errorf("callbackUrl must use https")
+	}
+	if u.User != nil {
+		return fmt.Errorf("callbackUrl must not contain credentials")
+	}
+	if len(secret) < minSecretLength {
+		return fmt.Errorf("callbackSecret must be at least %d characters", minSecretLength)
+	}
+	return nil
+}
+
+// NewDelivery returns a pending completion callback to store on a job when it's created. It's
+// delivered by Run once the job reaches a terminal state, by whichever API instance gets to it
+// first.
+func NewDelivery(callbackURL, secret string) *queue.WebhookDelivery {
+	return &queue.WebhookDelivery{
+		URL:        callbackURL,
+		Secret:     secret,
+		DeliveryID: uuid.New().String(),
+		Status:     queue.WebhookPending,
+		Attempts:   []queue.WebhookAttempt{},
+	}
+}
+
+// jobs returns the Firestore collection the deliveries are kept in
+func (s *Service) jobs() *firestore.CollectionRef {
+	return s.client.Collection("jobs")
+}
+
+// pending returns the query for jobs with a webhook that hasn't been delivered or given up on
+func (s *Service) pending() firestore.Query {
+	return s.jobs().Where("webhook.status", "==", queue.WebhookPending)
+}
+
+// Run delivers pending webhooks until ctx is canceled, including the ones a previous instance left
+// behind. Deliveries start as soon as a job with a pending webhook finishes, and retries once their
+// backoff has passed.
+func (s *Service) Run(ctx context.Context) {
+	// Any change to a job with a pending webhook, such as it finishing, triggers a sweep
+	go func() {
+		snapshots := s.pending().Snapshots(ctx)
+		defer snapshots.Stop()
+		for {
+			if _, err := snapshots.Next(); err != nil {
+				if ctx.Err() == nil {
+					slog.ErrorContext(ctx, "Error watching pending webhooks", "error", err)
+				}
+				return
+			}
+			select {
+			case s.wake <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	go func() {
+		ticker := time.NewTicker(sweepInterval)
+		defer ticker.Stop()
+		for {
+			if err := s.sweep(ctx); err != nil && ctx.Err() == nil {
+				slog.ErrorContext(ctx, "Failed to deliver pending webhooks", "error", err)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.wake:
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+// begin registers a delivery attempt, returning false once draining has started. Every successful
+// call must be followed by a call to s.inflight.Done.
+func (s *Service) begin() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return false
+	}
+	s.inflight.Add(1)
+	return true
+}
+
+// Drain stops starting delivery attempts and waits for the ones in progress until ctx is done.
+// Attempts cut short are retried by another instance once their lease expires.
+func (s *Service) Drain(ctx context.Context) error {
+	s.mu.Lock()
+	s.draining = true
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.inflight.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// sweep starts an attempt for every finished job whose webhook is due and not held by another
+// instance
+func (s *Service) sweep(ctx context.Context) error {
+	docs, err := s.pending().Documents(ctx).GetAll()
+	if err != nil {
+		return fmt.Errorf("failed to list pending webhooks: %v", err)
+	}
+
+	now := time.Now().Unix()
+	for _, doc := range docs {
+		var listed queue.FirestoreJob
+		if err := doc.DataTo(&listed); err != nil {
+			slog.ErrorContext(ctx, "Error parsing job data", "job_id", doc.Ref.ID, "error", err)
+			continue
+		}
+		if !due(listed, now) {
+			continue
+		}
+
+		// Leave the rest to another instance once this one is shutting down
+		if !s.begin() {
+			return nil
+		}
+		job, err := s.claim(ctx, doc.Ref)
+		if err != nil || job == nil {
+			if err != nil {
+				slog.ErrorContext(ctx, "Failed to claim webhook", "job_id", doc.Ref.ID, "error", err)
+			}
+			s.inflight.Done()
+			continue
+		}
+		go func() {
+			defer s.inflight.Done()
+			// Attempts in progress are finished during a shutdown rather than cut short
+			s.attempt(context.WithoutCancel(ctx), doc.Ref, job)
+		}()
+	}
+	return nil
+}
+
+// due reports whether a job has finished and its webhook is waiting for an attempt that no
+// instance is making
+func due(job queue.FirestoreJob, now int64) bool {
+	finished := job.Status == string(queue.StatusCompleted) || job.Status == string(queue.StatusFailed)
+	delivery := job.Webhook
+	return finished && delivery != nil && delivery.Status == queue.WebhookPending &&
+		delivery.NextAttemptAt <= now && delivery.LeaseUntil <= now
+}
+
+// claim leases a job's webhook to this instance if the job has finished and the next attempt is
+// due. It returns nil if the webhook isn't ready or another instance holds it.
+func (s *Service) claim(ctx context.Context, jobRef *firestore.DocumentRef) (*queue.FirestoreJob, error) {
+	var claimed *queue.FirestoreJob
+	err := s.client.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		claimed = nil
+		doc, err := tx.Get(jobRef)
+		if err != nil {
+			return err
+		}
+		var job queue.FirestoreJob
+		if err := doc.DataTo(&job); err != nil {
+			return err
+		}
+
+		now := time.Now().Unix()
+		if !due(job, now) {
+			return nil
+		}
+		delivery := job.Webhook
+		delivery.LeaseUntil = now + int64(s.lease.Seconds())
+		claimed = &job
+		return tx.Update(jobRef, []firestore.Update{{Path: "webhook.leaseUntil", Value: delivery.LeaseUntil}})
+	})
+	return claimed, err
+}
+
+// attempt makes one delivery attempt for a claimed webhook and records it, scheduling a retry with
+// backoff if it failed and is worth retrying
+func (s *Service) attempt(ctx context.Context, jobRef *firestore.DocumentRef, firestoreJob *queue.FirestoreJob) {
+	delivery := firestoreJob.Webhook
+	ctx = logging.WithJob(ctx, firestoreJob.ID, firestoreJob.OwnerID)
+
+	// Deliveries recorded before secrets were kept with them can't be signed
+	if delivery.Secret == "" {
+		slog.ErrorContext(ctx, "Webhook failed: no signing secret")
+		s.record(ctx, jobRef, nil, queue.WebhookFailed, 0)
+		return
+	}
+
+	// The job's result URL and expiry are worked out the same way as for the status endpoint
+	job := s.queueService.GetJob(firestoreJob.ID, firestoreJob.OwnerID)
+	if job == nil {
+		slog.ErrorContext(ctx, "Webhook failed: job not found")
+		return
+	}
+	body, event, err := s.payload(job, delivery.DeliveryID)
+	if err != nil {
+		slog.ErrorContext(ctx, "Webhook failed", "error", err)
+		s.record(ctx, jobRef, nil, queue.WebhookFailed, 0)
+		return
+	}
+
+	result, retry := s.post(ctx, delivery.URL, delivery.Secret, event, delivery.DeliveryID, body)
+	result.Attempt = len(delivery.Attempts) + 1
+
+	switch {
+	case result.Error == "":
+		slog.InfoContext(ctx, "Delivered webhook", "attempt", result.Attempt)
+		s.record(ctx, jobRef, &result, queue.WebhookDelivered, 0)
+	case !retry || result.Attempt >= s.maxAttempts:
+		slog.ErrorContext(ctx, "Webhook failed", "attempt", result.Attempt, "error", result.Error)
+		s.record(ctx, jobRef, &result, queue.WebhookFailed, 0)
+	default:
+		// Retries wait retryBaseDelay, then twice as long each time
+		delay := retryBaseDelay << (result.Attempt - 1)
+		slog.WarnContext(ctx, "Webhook attempt failed, retrying", "attempt", result.Attempt, "error", result.Error, "delay", delay)
+		s.record(ctx, jobRef, &result, queue.WebhookPending, time.Now().Add(delay).Unix())
+	}
+}
+
+// record stores a delivery attempt, if there was one, with the webhook's new status, and releases
+// the lease on it
+func (s *Service) record(ctx context.Context, jobRef *firestore.DocumentRef, result *queue.WebhookAttempt, status string, nextAttemptAt int64) {
+	updates := []firestore.Update{
+		{Path: "webhook.status", Value: status},
+		{Path: "webhook.nextAttemptAt", Value: nextAttemptAt},
+		{Path: "webhook.leaseUntil", Value: firestore.Delete},
+	}
+	if result != nil {
+		updates = append(updates, firestore.Update{Path: "webhook.attempts", Value: firestore.ArrayUnion(*result)})
+	}
+	if _, err := jobRef.Update(ctx, updates); err != nil {
+		slog.ErrorContext(ctx, "Failed to record webhook attempt", "error", err)
+	}
+}
+
+// payload builds the JSON body and event name for a finished job
+func (s *Service) payload(job *queue.Job, deliveryID string) ([]byte, string, error) {
+	event := "job.failed"
+	if job.Status == queue.StatusCompleted {
+		event = "job.completed"
+	}
+
+	payload := models.WebhookPayload{
+		Event:           event,
+		DeliveryID:      deliveryID,
+		JobID:           job.ID,
+		Status:          string(job.Status),
+		Message:         job.Message,
+		ResultExpiresAt: job.ResultExpiresAt,
+		Timestamp:       time.Now().Unix(),
+	}
+	if job.ResultURL != "" {
+		payload.ResultURL = s.publicURL + job.ResultURL
+		payload.DownloadURL = payload.ResultURL + "?download=true"
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to marshal webhook payload: %v", err)
+	}
+	return body, event, nil
+}
+
+// post sends one delivery attempt and reports whether a failure is worth retrying
+func (s *Service) post(ctx context.Context, callbackURL, secret, event, deliveryID string, body []byte) (queue.WebhookAttempt, bool) {
+	start := time.Now()
+	attempt := queue.WebhookAttempt{At: start.Unix()}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, callbackURL, bytes.NewReader(body))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, false
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "slideitin-webhooks/1.0")
+	req.Header.Set(HeaderEvent, event)
+	req.Header.Set(HeaderDelivery, deliveryID)
+	req.Header.Set(HeaderSignature, Sign(secret, start.Unix(), body))
+
+	resp, err := s.httpClient.Do(req)
+	attempt.DurationMs = time.Since(start).Milliseconds()
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, !errors.Is(err, errNonPublicAddress)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	attempt.StatusCode = resp.StatusCode
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return attempt, false
+	}
+	attempt.Error = fmt.Sprintf("receiver returned status %d", resp.StatusCode)
+
+	// Other client errors mean the receiver rejected the payload, so retrying won't help
+	return attempt, resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+}
+
+// Sign computes the signature header for a payload: "t=<unix time>,v1=<hex HMAC-SHA256 of
+// "<unix time>.<body>">". Receivers should recompute it and reject stale timestamps.
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10) + "."))
+	mac.Write(body)
+	return fmt.Sprintf("t=%d,v1=%s", timestamp, hex.EncodeToString(mac.Sum(nil)))
+}
@@ -0,0 +1,58 @@
+package controllers
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/firestore"
+)
+
+// heartbeat records on the job document that the job is still being worked on, every
+// c.heartbeatInterval until ctx is done, so the API can detect jobs whose worker died. If the API
+// has given up on the job in the meantime, the job is stopped so it isn't finished twice.
+func (c *TaskController) heartbeat(ctx context.Context, jobID string) {
+	ticker := time.NewTicker(c.heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		alive, err := c.beat(ctx, jobID)
+		if err != nil && ctx.Err() == nil {
+			slog.WarnContext(ctx, "Failed to record job heartbeat", "error", err)
+		}
+		if err == nil && !alive {
+			if c.interruptJob(jobID) {
+				slog.WarnContext(ctx, "Job was taken over after missing heartbeats, stopping it")
+			}
+			return
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// beat sets a job's heartbeat, reporting false instead if the API has requeued or failed the job
+func (c *TaskController) beat(ctx context.Context, jobID string) (bool, error) {
+	jobRef := c.firestoreClient.Collection("jobs").Doc(jobID)
+	alive := true
+	err := c.firestoreClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		alive = true
+		doc, err := tx.Get(jobRef)
+		if err != nil {
+			return err
+		}
+		var job FirestoreJob
+		if err := doc.DataTo(&job); err != nil {
+			return err
+		}
+		if job.Requeue || job.Status == "failed" {
+			alive = false
+			return nil
+		}
+		return tx.Update(jobRef, []firestore.Update{{Path: "heartbeatAt", Value: time.Now().Unix()}})
+	})
+	return alive, err
+}
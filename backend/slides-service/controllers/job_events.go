@@ -0,0 +1,64 @@
+package controllers
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"github.com/martin226/slideitin/backend/slides-service/models"
+)
+
+// FirestoreJobEvent is one entry in a job's ordered event log, stored in jobs/{id}/events
+type FirestoreJobEvent struct {
+	Seq      int64                `firestore:"seq"`
+	Status   string               `firestore:"status"`
+	Message  string               `firestore:"message"`
+	At       int64                `firestore:"at"`
+	Progress *models.JobProgress  `firestore:"progress,omitempty"`
+	Preview  *models.SlidePreview `firestore:"preview,omitempty"` // Only kept in the event log, not on the job
+}
+
+// updateJobState updates a job's status, message and progress, plus any extra fields, and appends
+// the change to the job's event log so SSE clients can replay it after reconnecting. A nil
+// progress leaves the job's last progress in place.
+func (c *TaskController) updateJobState(ctx context.Context, jobID, status, message string, progress *models.JobProgress, extra ...firestore.Update) error {
+	return c.appendJobEvent(ctx, jobID, FirestoreJobEvent{Status: status, Message: message, Progress: progress}, extra...)
+}
+
+// appendJobEvent applies an event's status, message and progress to the job and appends the event,
+// numbered after the job's latest one, to its event log
+func (c *TaskController) appendJobEvent(ctx context.Context, jobID string, event FirestoreJobEvent, extra ...firestore.Update) error {
+	jobRef := c.firestoreClient.Collection("jobs").Doc(jobID)
+	return c.firestoreClient.RunTransaction(ctx, func(ctx context.Context, tx *firestore.Transaction) error {
+		doc, err := tx.Get(jobRef)
+		if err != nil {
+			return err
+		}
+		var job FirestoreJob
+		if err := doc.DataTo(&job); err != nil {
+			return err
+		}
+
+		now := time.Now().Unix()
+		seq := job.EventSeq + 1
+		updates := append([]firestore.Update{
+			{Path: "status", Value: event.Status},
+			{Path: "message", Value: event.Message},
+			{Path: "updatedAt", Value: now},
+			{Path: "eventSeq", Value: seq},
+		}, extra...)
+		if event.Progress != nil {
+			updates = append(updates, firestore.Update{Path: "progress", Value: *event.Progress})
+		}
+		if err := tx.Update(jobRef, updates); err != nil {
+			return err
+		}
+
+		// Zero-padded IDs keep the events in sequence order
+		eventRef := jobRef.Collection("events").Doc(fmt.Sprintf("%010d", seq))
+		event.Seq = seq
+		event.At = now
+		return tx.Create(eventRef, event)
+	})
+}
@@ -0,0 +1,154 @@
+package controllers
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+
+	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
+	"github.com/martin226/slideitin/backend/slides-service/models"
+)
+
+// interruptedMessage is the status of a job stopped by a shutdown, which the API will retry
+const interruptedMessage = "Interrupted by a service restart, waiting to be retried"
+
+// retryAfterSeconds is the Retry-After sent with jobs refused because this instance can't take them
+const retryAfterSeconds = "30"
+
+// Reasons sent in the body of a 503, so the API can tell a busy instance from one that can't run
+// the job at all
+const (
+	reasonBusy        = "busy"        // Too many jobs are waiting; the job never started
+	reasonDraining    = "draining"    // The instance is shutting down
+	reasonRunning     = "running"     // The job is still stopping on this instance
+	reasonInterrupted = "interrupted" // The job was handed back for a retry
+)
+
+// errInterrupted stops a job's progress updates once it has been handed back for a retry
+var errInterrupted = errors.New("job was interrupted by a service restart")
+
+// Reasons a job can't be started, both reported to the API as a 503 so it retries later
+var (
+	errDraining       = errors.New("service is shutting down")
+	errAlreadyRunning = errors.New("job is still running on this instance")
+)
+
+// runningJob is a job being processed by this instance
+type runningJob struct {
+	cancel      context.CancelFunc
+	interrupted bool
+}
+
+// jobTracker keeps track of the jobs this instance is processing so a shutdown can drain them
+type jobTracker struct {
+	mu       sync.Mutex
+	running  map[string]*runningJob
+	draining bool
+}
+
+// startJob registers a running job, starts its heartbeat and returns the context to process it
+// with. The job keeps running if the API disconnects and is only canceled if it's interrupted.
+// Jobs can't be started once the service is draining.
+func (c *TaskController) startJob(ctx context.Context, jobID string) (context.Context, error) {
+	c.jobs.mu.Lock()
+	defer c.jobs.mu.Unlock()
+	if c.jobs.draining {
+		return nil, errDraining
+	}
+	// A job taken over after missing heartbeats may still be stopping here
+	if _, ok := c.jobs.running[jobID]; ok {
+		return nil, errAlreadyRunning
+	}
+	jobCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	c.jobs.running[jobID] = &runningJob{cancel: cancel}
+	go c.heartbeat(jobCtx, jobID)
+	return jobCtx, nil
+}
+
+// finishJob unregisters a job, reporting false if it was interrupted. The status of an
+// interrupted job has already been handed back to the API, so it mustn't be changed.
+func (c *TaskController) finishJob(jobID string) bool {
+	c.jobs.mu.Lock()
+	defer c.jobs.mu.Unlock()
+	job, ok := c.jobs.running[jobID]
+	if !ok {
+		return true
+	}
+	delete(c.jobs.running, jobID)
+	job.cancel()
+	return !job.interrupted
+}
+
+// interruptJob stops a running job and marks it as interrupted so its status is left alone,
+// reporting whether it was running
+func (c *TaskController) interruptJob(jobID string) bool {
+	c.jobs.mu.Lock()
+	defer c.jobs.mu.Unlock()
+	job, ok := c.jobs.running[jobID]
+	if !ok {
+		return false
+	}
+	job.interrupted = true
+	job.cancel()
+	return true
+}
+
+// interrupted reports whether a job was interrupted by a shutdown or taken over by the API
+func (c *TaskController) interrupted(jobID string) bool {
+	c.jobs.mu.Lock()
+	defer c.jobs.mu.Unlock()
+	job, ok := c.jobs.running[jobID]
+	return ok && job.interrupted
+}
+
+// failJob marks a job as failed and responds with the failure, unless it was interrupted. An
+// interrupted job has been handed back for a retry, which the API is told with a 503.
+func (c *TaskController) failJob(ctx *gin.Context, jobID, message string) {
+	if c.interrupted(jobID) {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": interruptedMessage, "reason": reasonInterrupted})
+		return
+	}
+	c.updateJobStatus(jobID, "failed", message, "")
+	ctx.JSON(http.StatusInternalServerError, gin.H{"error": message})
+}
+
+// refuse responds to a job this instance can't take with a 503 and a Retry-After
+func refuse(ctx *gin.Context, reason string, err error) {
+	ctx.Header("Retry-After", retryAfterSeconds)
+	ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": err.Error(), "reason": reason})
+}
+
+// Drain stops accepting new jobs; jobs already running carry on
+func (c *TaskController) Drain() {
+	c.jobs.mu.Lock()
+	defer c.jobs.mu.Unlock()
+	c.jobs.draining = true
+}
+
+// InterruptJobs stops the jobs still running once the shutdown deadline has passed and marks them
+// for requeue, so the API retries them instead of leaving them processing forever
+func (c *TaskController) InterruptJobs(ctx context.Context) {
+	c.jobs.mu.Lock()
+	interrupted := make([]string, 0, len(c.jobs.running))
+	for jobID := range c.jobs.running {
+		interrupted = append(interrupted, jobID)
+	}
+	c.jobs.mu.Unlock()
+
+	for _, jobID := range interrupted {
+		if !c.interruptJob(jobID) {
+			continue // Finished in the meantime
+		}
+		err := c.updateJobState(ctx, jobID, "queued", interruptedMessage,
+			&models.JobProgress{Stage: models.StageQueued},
+			firestore.Update{Path: "requeue", Value: true})
+		if err != nil {
+			slog.ErrorContext(ctx, "Failed to mark interrupted job for requeue", "job_id", jobID, "error", err)
+			continue
+		}
+		slog.WarnContext(ctx, "Interrupted job, marked for requeue", "job_id", jobID)
+	}
+}
@@ -2,75 +2,112 @@ package controllers
 
 import (
 	"context"
-"fmt"
-// "io" // No longer needed for GCS read
-"log"
-"net/http"
-"path/filepath"
+	"errors"
+	"fmt"
+	// "io" // No longer needed for GCS read
+	"log/slog"
+	"net/http"
+	"path/filepath"
 	"time"
 
-	"github.com/gin-gonic/gin"
 	"cloud.google.com/go/firestore"
+	"github.com/gin-gonic/gin"
 	// "cloud.google.com/go/storage" // Removed storage client
-	"github.com/martin226/slideitin/backend/slides-service/services/slides"
 	"github.com/martin226/slideitin/backend/slides-service/models"
+	"github.com/martin226/slideitin/backend/slides-service/services/logging"
+	"github.com/martin226/slideitin/backend/slides-service/services/slides"
+	"github.com/martin226/slideitin/backend/slides-service/services/telemetry"
+	"go.opentelemetry.io/otel/trace"
 	"os"
 )
 
 // FileReference represents a reference to a file stored in GCS
 type FileReference struct {
-	Filename string `json:"filename"`
-	Type     string `json:"type"`
+	Filename  string `json:"filename"`
+	Type      string `json:"type"`
 	LocalPath string `json:"localPath"` // Changed from GCSPath
 }
 
 // TaskPayload represents the data structure received from Cloud Tasks
 type TaskPayload struct {
-	JobID     string            `json:"jobID"`
-	Theme     string            `json:"theme"`
-	Files     []FileReference   `json:"files"`
-	Settings  models.SlideSettings `json:"settings"`
+	JobID     string                 `json:"jobID"`
+	OwnerID   string                 `json:"ownerID,omitempty"`
+	Theme     string                 `json:"theme"`
+	Files     []FileReference        `json:"files"`
+	Settings  models.SlideSettings   `json:"settings"`
+	Retention models.RetentionPolicy `json:"retention"`
 }
 
 // FirestoreJob is the Firestore representation of a job
 type FirestoreJob struct {
-	ID        string `firestore:"id"`
-	Status    string `firestore:"status"`
-	Message   string `firestore:"message"`
-	CreatedAt int64  `firestore:"createdAt"`
-	UpdatedAt int64  `firestore:"updatedAt"`
-	ExpiresAt int64  `firestore:"expiresAt,omitempty"`
+	ID          string              `firestore:"id"`
+	Status      string              `firestore:"status"`
+	Message     string              `firestore:"message"`
+	CreatedAt   int64               `firestore:"createdAt"`
+	UpdatedAt   int64               `firestore:"updatedAt"`
+	ExpiresAt   int64               `firestore:"expiresAt,omitempty"`
+	EventSeq    int64               `firestore:"eventSeq"` // Sequence number of the latest entry in the event log
+	Progress    *models.JobProgress `firestore:"progress,omitempty"`
+	Requeue     bool                `firestore:"requeue,omitempty"`     // Set once the job is handed back to the API for a retry
+	HeartbeatAt int64               `firestore:"heartbeatAt,omitempty"` // Last time the worker reported the job as alive
 }
 
 // FirestoreResult is the Firestore representation of a job result
 type FirestoreResult struct {
+	ID                  string `firestore:"id"`
+	OwnerID             string `firestore:"ownerId,omitempty"`
+	ResultURL           string `firestore:"resultUrl"`
+	PDFData             []byte `firestore:"pdfData"`
+	HTMLData            []byte `firestore:"htmlData"`
+	CreatedAt           int64  `firestore:"createdAt"`
+	ExpiresAt           int64  `firestore:"expiresAt"` // 0 means the result is kept forever
+	DeleteAfterDownload bool   `firestore:"deleteAfterDownload,omitempty"`
+}
+
+// FirestoreResultImage is the Firestore representation of an image referenced by a result
+type FirestoreResultImage struct {
 	ID          string `firestore:"id"`
-	ResultURL   string `firestore:"resultUrl"`
-	PDFData     []byte `firestore:"pdfData"`
-	HTMLData    []byte `firestore:"htmlData"`
+	OwnerID     string `firestore:"ownerId,omitempty"`
+	ContentType string `firestore:"contentType"`
+	Data        []byte `firestore:"data"`
 	CreatedAt   int64  `firestore:"createdAt"`
 	ExpiresAt   int64  `firestore:"expiresAt"`
 }
 
 // TaskController handles requests from Cloud Tasks
 type TaskController struct {
-	slideService *slides.SlideService
+	slideService    *slides.SlideService
 	firestoreClient *firestore.Client
 	// Removed storageClient
 	// Removed bucketName
+	jobs              jobTracker
+	heartbeatInterval time.Duration
 }
 
-// NewTaskController creates a new task controller
-func NewTaskController(slideService *slides.SlideService, firestoreClient *firestore.Client) *TaskController {
+// NewTaskController creates a new task controller that records a heartbeat on each running job
+// every heartbeatInterval
+func NewTaskController(slideService *slides.SlideService, firestoreClient *firestore.Client, heartbeatInterval time.Duration) *TaskController {
 	// Removed bucket name and storage client initialization
 	return &TaskController{
-		slideService:    slideService,
-		firestoreClient: firestoreClient,
+		slideService:      slideService,
+		firestoreClient:   firestoreClient,
+		jobs:              jobTracker{running: make(map[string]*runningJob)},
+		heartbeatInterval: heartbeatInterval,
 	}
 }
 
 // Removed downloadFileFromGCS function
 
+// Generator reports the model and prompt version slides are generated with, so the API can tell
+// which cached results are still valid
+func (c *TaskController) Generator(ctx *gin.Context) {
+	model, promptVersion := c.slideService.Generator()
+	ctx.JSON(http.StatusOK, gin.H{
+		"model":         model,
+		"promptVersion": promptVersion,
+	})
+}
+
 // ProcessSlides handles slide generation requests (now via direct HTTP)
 func (c *TaskController) ProcessSlides(ctx *gin.Context) {
 	// Removed storage client check
@@ -78,19 +115,49 @@ func (c *TaskController) ProcessSlides(ctx *gin.Context) {
 	// Parse task payload from request body
 	var payload TaskPayload
 	if err := ctx.ShouldBindJSON(&payload); err != nil {
-		log.Printf("Failed to parse task payload: %v", err)
+		slog.ErrorContext(ctx.Request.Context(), "Failed to parse task payload", "error", err)
 		ctx.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Invalid payload: %v", err)})
 		return
 	}
-	
-	// Create a job status update function
-	statusUpdateFn := func(message string) error {
-		return c.updateJobStatus(payload.JobID, "processing", message, "")
+
+	// Continue the API's trace; spans started from reqCtx are tagged with the job ID, and so are
+	// log records, which only include document content if the job asked for it
+	reqCtx := telemetry.WithJobID(ctx.Request.Context(), payload.JobID)
+	reqCtx = logging.WithJob(reqCtx, payload.JobID, payload.OwnerID, payload.Settings.Debug)
+	trace.SpanFromContext(reqCtx).SetAttributes(telemetry.JobIDKey.String(payload.JobID))
+	// Refuse new jobs while shutting down; the API requeues them for another instance
+	jobCtx, err := c.startJob(reqCtx, payload.JobID)
+	if err != nil {
+		reason := reasonDraining
+		if errors.Is(err, errAlreadyRunning) {
+			reason = reasonRunning
+		}
+		refuse(ctx, reason, err)
+		return
 	}
-	
+	defer c.finishJob(payload.JobID)
+	slog.InfoContext(reqCtx, "Processing job", "theme", payload.Theme, "files", len(payload.Files))
+
+	// Count the job as failed unless it gets to the end
+	telemetry.JobsInProgress.Inc()
+	defer telemetry.JobsInProgress.Dec()
+	outcome := "failed"
+	defer func() {
+		telemetry.JobsTotal.WithLabelValues(outcome).Inc()
+	}()
+
+	// Track structured progress, reporting each stage as a processing update until the job is
+	// interrupted, which also stops generation
+	progress := slides.NewProgressTracker(time.Now(), len(payload.Files), func(message string, progress models.JobProgress, preview *models.SlidePreview) error {
+		if c.interrupted(payload.JobID) {
+			return errInterrupted
+		}
+		return c.updateJobProgress(payload.JobID, message, progress, preview)
+	})
+
 	// Update initial job status
-	if err := statusUpdateFn("Processing slides"); err != nil {
-		log.Printf("Failed to update job status: %v", err)
+	if err := progress.Report(models.StageStarting, 0, "Processing slides"); err != nil {
+		slog.ErrorContext(reqCtx, "Failed to update job status", "error", err)
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to update job status: %v", err)})
 		return
 	}
@@ -99,12 +166,11 @@ func (c *TaskController) ProcessSlides(ctx *gin.Context) {
 	files := make([]models.File, 0, len(payload.Files))
 	for _, fileRef := range payload.Files {
 		// Read the file from the local path provided
-		log.Printf("Reading file from local path: %s", fileRef.LocalPath)
+		slog.DebugContext(reqCtx, "Reading file from local path", "path", fileRef.LocalPath)
 		fileData, err := os.ReadFile(fileRef.LocalPath)
 		if err != nil {
-			log.Printf("Failed to read file %s from %s: %v", fileRef.Filename, fileRef.LocalPath, err)
-			c.updateJobStatus(payload.JobID, "failed", fmt.Sprintf("Failed to read local file %s: %v", fileRef.Filename, err), "")
-			ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to read local file: %v", err)})
+			slog.ErrorContext(reqCtx, "Failed to read file", "path", fileRef.LocalPath, "error", err)
+			c.failJob(ctx, payload.JobID, fmt.Sprintf("Failed to read local file %s: %v", fileRef.Filename, err))
 			return
 		}
 
@@ -118,133 +184,228 @@ func (c *TaskController) ProcessSlides(ctx *gin.Context) {
 		files = append(files, file)
 	}
 
-	// Generate slides
-	pdfData, htmlData, err := c.slideService.GenerateSlides(
-		ctx.Request.Context(),
+	// Generate slides, collecting token usage and render times for accounting.
+	// Image URLs are relative to the result URL (/results/<id> or /v1/results/<id>)
+	// so they resolve against whichever prefix the HTML was served from.
+	var metrics models.JobMetrics
+	result, err := c.slideService.GenerateSlides(
+		jobCtx,
 		payload.Theme,
 		files,
 		payload.Settings,
-		statusUpdateFn,
+		payload.JobID+"/images/",
+		&metrics,
+		progress,
 	)
-	
+
+	// Record metrics before the final status so watchers see them with it, even for failed jobs
+	if err := c.recordMetrics(payload.JobID, metrics); err != nil {
+		slog.ErrorContext(reqCtx, "Failed to record metrics", "error", err)
+	}
+
+	// Too many jobs are waiting; leave the job for the API to retry rather than failing it. The
+	// job never started, so it's refused as busy and doesn't use up an attempt.
+	if errors.Is(err, slides.ErrBusy) {
+		slog.WarnContext(reqCtx, "Worker queue full, refusing job")
+		outcome = "refused"
+		refuse(ctx, reasonBusy, err)
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to generate slides: %v", err)
-		c.updateJobStatus(payload.JobID, "failed", fmt.Sprintf("Failed to generate slides: %v", err), "")
-		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to generate slides: %v", err)})
+		slog.ErrorContext(reqCtx, "Failed to generate slides", "error", err)
+		c.failJob(ctx, payload.JobID, fmt.Sprintf("Failed to generate slides: %v", err))
 		return
 	}
-	
+
 	// Create result URL
-resultURL := "/results/" + payload.JobID
-
-// Store result in Firestore using a background context with timeout
-storeCtx, storeCancel := context.WithTimeout(context.Background(), 15*time.Second)
-defer storeCancel()
-if err := c.storeResult(storeCtx, payload.JobID, resultURL, pdfData, htmlData); err != nil {
-log.Printf("Failed to store result: %v", err)
-// Still update job status using background context
-c.updateJobStatus(payload.JobID, "failed", fmt.Sprintf("Failed to store result: %v", err), "")
-ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to store result: %v", err)})
+	resultURL := "/results/" + payload.JobID
+
+	if err := progress.Report(models.StageStoring, 0, "Saving presentation"); err != nil {
+		slog.ErrorContext(reqCtx, "Failed to update job progress", "error", err)
+	}
+
+	// Store result in Firestore using a context with timeout that keeps the trace but not the request's cancellation
+	storeCtx, storeCancel := context.WithTimeout(jobCtx, 15*time.Second)
+	defer storeCancel()
+	storeStart := time.Now()
+	storeCtx, storeSpan := telemetry.StartSpan(storeCtx, "firestore.StoreResult")
+	err = c.storeResult(storeCtx, payload.JobID, payload.OwnerID, resultURL, result, payload.Retention)
+	telemetry.EndSpan(storeSpan, err)
+	telemetry.ObserveStage(telemetry.StageStoreResult, storeStart)
+	if err != nil {
+		slog.ErrorContext(storeCtx, "Failed to store result", "error", err)
+		// Still update job status using background context
+		c.failJob(ctx, payload.JobID, fmt.Sprintf("Failed to store result: %v", err))
+		return
+	}
+
+	// Keep the files if the job was handed back for a retry in the meantime; otherwise it can no
+	// longer be interrupted
+	if !c.finishJob(payload.JobID) {
+		ctx.JSON(http.StatusServiceUnavailable, gin.H{"error": interruptedMessage, "reason": reasonInterrupted})
 		return
 	}
 
 	// Clean up local files from shared volume (optional, but good practice)
 	for _, fileRef := range payload.Files {
 		if err := os.Remove(fileRef.LocalPath); err != nil {
-			log.Printf("Warning: Failed to delete local file %s: %v", fileRef.LocalPath, err)
+			slog.WarnContext(reqCtx, "Failed to delete local file", "path", fileRef.LocalPath, "error", err)
 			// Continue anyway
 		} else {
-			log.Printf("Deleted local file %s", fileRef.LocalPath)
+			slog.DebugContext(reqCtx, "Deleted local file", "path", fileRef.LocalPath)
 		}
 	}
 	// Also remove the job directory itself
 	jobDir := filepath.Join("/shared", payload.JobID)
 	if err := os.RemoveAll(jobDir); err != nil {
-		log.Printf("Warning: Failed to delete local job directory %s: %v", jobDir, err)
+		slog.WarnContext(reqCtx, "Failed to delete local job directory", "path", jobDir, "error", err)
 	} else {
-		log.Printf("Deleted local job directory %s", jobDir)
+		slog.DebugContext(reqCtx, "Deleted local job directory", "path", jobDir)
 	}
 
-
 	// Mark job as completed
-	if err := c.setJobCompleted(payload.JobID, "Slides generated successfully", resultURL); err != nil {
-		log.Printf("Failed to mark job as completed: %v", err)
+	if err := c.setJobCompleted(payload.JobID, "Slides generated successfully", resultURL, payload.Retention); err != nil {
+		slog.ErrorContext(reqCtx, "Failed to mark job as completed", "error", err)
 		ctx.JSON(http.StatusInternalServerError, gin.H{"error": fmt.Sprintf("Failed to mark job as completed: %v", err)})
 		return
 	}
-	
+
 	// Return success response
-	ctx.JSON(http.StatusOK, gin.H{"status": "success", "jobID": payload.JobID})
+	outcome = "completed"
+	model, promptVersion := c.slideService.Generator()
+	ctx.JSON(http.StatusOK, gin.H{
+		"status":        "success",
+		"jobID":         payload.JobID,
+		"inputTokens":   metrics.InputTokens,
+		"outputTokens":  metrics.OutputTokens,
+		"model":         model,
+		"promptVersion": promptVersion,
+	})
 }
 
 // updateJobStatus updates a job's status in Firestore
 func (c *TaskController) updateJobStatus(jobID, status, message, resultURL string) error {
 	ctx := context.Background()
-	now := time.Now().Unix()
-	
-	// Update job in Firestore
-	updates := []firestore.Update{
-		{Path: "status", Value: status},
-		{Path: "message", Value: message},
-		{Path: "updatedAt", Value: now},
-	}
-	
-	_, err := c.firestoreClient.Collection("jobs").Doc(jobID).Update(ctx, updates)
+
+	// Update job in Firestore and record the change in its event log
+	err := c.updateJobState(ctx, jobID, status, message, nil)
 	if err != nil {
-		log.Printf("Failed to update job status in Firestore: %v", err)
+		slog.Error("Failed to update job status in Firestore", "job_id", jobID, "error", err)
+		return err
+	}
+
+	slog.Info("Job updated", "job_id", jobID, "status", status, "message", message)
+	return nil
+}
+
+// updateJobProgress records a processing update with its structured progress and, optionally, the
+// preview of a slide that has just been generated
+func (c *TaskController) updateJobProgress(jobID, message string, progress models.JobProgress, preview *models.SlidePreview) error {
+	ctx := context.Background()
+	event := FirestoreJobEvent{
+		Status:   "processing",
+		Message:  message,
+		Progress: &progress,
+		Preview:  preview,
+	}
+	if err := c.appendJobEvent(ctx, jobID, event); err != nil {
+		slog.Error("Failed to update job progress in Firestore", "job_id", jobID, "error", err)
 		return err
 	}
-	
-	log.Printf("Job %s updated: status=%s, message=%s", jobID, status, message)
+
+	slog.Info("Job progress", "job_id", jobID, "stage", progress.Stage, "percent", progress.Percent, "message", message)
 	return nil
 }
 
-// setJobCompleted marks a job as completed and sets it to expire
-func (c *TaskController) setJobCompleted(jobID, message, resultURL string) error {
+// recordMetrics stores a job's token usage, render times and estimated cost on the job document
+func (c *TaskController) recordMetrics(jobID string, metrics models.JobMetrics) error {
+	ctx := context.Background()
+	_, err := c.firestoreClient.Collection("jobs").Doc(jobID).Update(ctx, []firestore.Update{
+		{Path: "metrics", Value: metrics},
+	})
+	return err
+}
+
+// Retention used when the API doesn't send a policy
+const (
+	defaultJobTTL    = 300  // 5 minutes
+	defaultResultTTL = 3600 // 1 hour
+)
+
+// setJobCompleted marks a job as completed and sets it to expire according to the retention policy
+func (c *TaskController) setJobCompleted(jobID, message, resultURL string, retention models.RetentionPolicy) error {
 	ctx := context.Background()
 	now := time.Now().Unix()
-	// Set job to expire in 5 minutes
-	expiresAt := now + 300 // 300 seconds = 5 minutes
-	
-	// Update job in Firestore
-	updates := []firestore.Update{
-		{Path: "status", Value: "completed"},
-		{Path: "message", Value: message},
-		{Path: "updatedAt", Value: now},
-		{Path: "expiresAt", Value: expiresAt},
-	}
-	
-	_, err := c.firestoreClient.Collection("jobs").Doc(jobID).Update(ctx, updates)
+	jobTTL := retention.JobTTL
+	if jobTTL <= 0 {
+		jobTTL = defaultJobTTL
+	}
+	expiresAt := now + jobTTL
+
+	// Update job in Firestore and record the change in its event log
+	err := c.updateJobState(ctx, jobID, "completed", message,
+		&models.JobProgress{Stage: models.StageCompleted, Percent: 100},
+		firestore.Update{Path: "expiresAt", Value: expiresAt})
 	if err != nil {
-		log.Printf("Failed to update job status in Firestore: %v", err)
+		slog.Error("Failed to update job status in Firestore", "job_id", jobID, "error", err)
 		return err
 	}
-	
-	log.Printf("Job %s completed and will expire at %s", jobID, time.Unix(expiresAt, 0).Format(time.RFC3339))
+
+	slog.Info("Job completed", "job_id", jobID, "expires_at", time.Unix(expiresAt, 0).Format(time.RFC3339))
 	return nil
 }
 
-// storeResult stores a job result in Firestore
-func (c *TaskController) storeResult(ctx context.Context, jobID, resultURL string, pdfData []byte, htmlData []byte) error {
+// storeResult stores a job result and its referenced images in Firestore
+func (c *TaskController) storeResult(ctx context.Context, jobID, ownerID, resultURL string, slideResult *models.SlideResult, retention models.RetentionPolicy) error {
 	now := time.Now().Unix()
-	// Set expiration time to 1 hour from now
-	expiresAt := now + 3600
-	
+	// Compute the expiry from the retention policy, 0 keeps the result forever
+	var expiresAt int64
+	if !retention.KeepForever {
+		resultTTL := retention.ResultTTL
+		if resultTTL <= 0 {
+			resultTTL = defaultResultTTL
+		}
+		expiresAt = now + resultTTL
+	}
+
 	result := FirestoreResult{
-		ID:          jobID,
-		ResultURL:   resultURL,
-		PDFData:     pdfData,
-		HTMLData:    htmlData,
-		CreatedAt:   now,
-		ExpiresAt:   expiresAt,
-	}
-	
-	_, err := c.firestoreClient.Collection("results").Doc(jobID).Set(ctx, result)
+		ID:                  jobID,
+		OwnerID:             ownerID,
+		ResultURL:           resultURL,
+		PDFData:             slideResult.PDFData,
+		HTMLData:            slideResult.HTMLData,
+		CreatedAt:           now,
+		ExpiresAt:           expiresAt,
+		DeleteAfterDownload: retention.DeleteAfterDownload,
+	}
+
+	resultRef := c.firestoreClient.Collection("results").Doc(jobID)
+	_, err := resultRef.Set(ctx, result)
 	if err != nil {
-		log.Printf("Failed to store result for job %s: %v", jobID, err)
+		slog.ErrorContext(ctx, "Failed to store result in Firestore", "error", err)
 		return fmt.Errorf("failed to store result: %v", err)
 	}
-	
-	log.Printf("Stored result for job %s (expires at %s)", jobID, time.Unix(expiresAt, 0).Format(time.RFC3339))
+
+	// Store each image as its own document to stay under the Firestore document size limit
+	for _, img := range slideResult.Images {
+		imageDoc := FirestoreResultImage{
+			ID:          img.ID,
+			OwnerID:     ownerID,
+			ContentType: img.ContentType,
+			Data:        img.Data,
+			CreatedAt:   now,
+			ExpiresAt:   expiresAt,
+		}
+		if _, err := resultRef.Collection("images").Doc(img.ID).Set(ctx, imageDoc); err != nil {
+			slog.ErrorContext(ctx, "Failed to store image", "image_id", img.ID, "error", err)
+			return fmt.Errorf("failed to store image %s: %v", img.ID, err)
+		}
+	}
+
+	if expiresAt == 0 {
+		slog.InfoContext(ctx, "Stored result, kept forever")
+	} else {
+		slog.InfoContext(ctx, "Stored result", "expires_at", time.Unix(expiresAt, 0).Format(time.RFC3339))
+	}
 	return nil
 }
@@ -2,36 +2,58 @@ package main
 
 import (
 	"context"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"cloud.google.com/go/firestore"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 	"github.com/martin226/slideitin/backend/slides-service/controllers"
+	"github.com/martin226/slideitin/backend/slides-service/services/health"
+	"github.com/martin226/slideitin/backend/slides-service/services/logging"
 	"github.com/martin226/slideitin/backend/slides-service/services/slides"
-	"cloud.google.com/go/firestore"
+	"github.com/martin226/slideitin/backend/slides-service/services/telemetry"
 	"google.golang.org/api/option" // Add option package
 )
 
 func main() {
 	err := godotenv.Load()
+
+	// Set up structured logging first so everything after it is logged consistently
+	if err := logging.Setup("slideitin-slides-service"); err != nil {
+		logging.Fatal("Failed to initialize logging", "error", err)
+	}
 	if err != nil {
-		log.Println("Warning: .env file not found, using system environment variables")
+		slog.Warn(".env file not found, using system environment variables")
 	}
 
+	// Initialize tracing before anything that makes outgoing calls
+	shutdownTracing, err := telemetry.InitTracing(context.Background(), "slideitin-slides-service")
+	if err != nil {
+		logging.Fatal("Failed to initialize tracing", "error", err)
+	}
+	defer shutdownTracing(context.Background())
+
 	// Set up Gin router
 	router := gin.Default()
 
+	// Trace every request, continuing the API's trace for triggered jobs
+	router.Use(telemetry.TracingMiddleware())
+
 	// Get environment variables
 	apiKey := os.Getenv("GEMINI_API_KEY")
 	if apiKey == "" {
-		log.Fatal("GEMINI_API_KEY environment variable is required")
+		logging.Fatal("GEMINI_API_KEY environment variable is required")
 	}
-	
+
 	projectID := os.Getenv("GOOGLE_CLOUD_PROJECT")
 	if projectID == "" {
-		log.Fatal("GOOGLE_CLOUD_PROJECT environment variable is required")
+		logging.Fatal("GOOGLE_CLOUD_PROJECT environment variable is required")
 	}
 
 	// Initialize Firestore client
@@ -44,42 +66,127 @@ func main() {
 	// Note: 'err' is already declared by godotenv.Load() above, so no need to redeclare with :=
 
 	if emulatorHost != "" {
-		log.Printf("Using Firestore emulator at %s\n", emulatorHost)
+		slog.Info("Using Firestore emulator", "host", emulatorHost)
 		// Connect to the emulator
-		fsClient, err = firestore.NewClient(ctx, projectID,
+		fsClient, err = firestore.NewClient(ctx, projectID, append([]option.ClientOption{
 			option.WithEndpoint(emulatorHost),
 			option.WithoutAuthentication(), // No credentials needed for emulator
-		)
+		}, telemetry.FirestoreClientOptions()...)...)
 	} else {
-		log.Println("Connecting to live Firestore")
+		slog.Info("Connecting to live Firestore")
 		// Connect to live Firestore
-		fsClient, err = firestore.NewClient(ctx, projectID)
+		fsClient, err = firestore.NewClient(ctx, projectID, telemetry.FirestoreClientOptions()...)
 	}
 
 	if err != nil {
-		log.Fatalf("Failed to create Firestore client: %v", err)
+		logging.Fatal("Failed to create Firestore client", "error", err)
 	}
 	defer fsClient.Close()
-	
-	// Initialize services
-	slideService := slides.NewSlideService(apiKey)
-	
+
+	// Deadlines and resource limits for Marp, Chromium and the other tools the service runs
+	if err := slides.SetupSubprocesses(); err != nil {
+		logging.Fatal("Invalid subprocess limits", "error", err)
+	}
+
+	// Initialize services; the pool bounds concurrent Gemini calls and renders
+	pool, err := slides.NewPool()
+	if err != nil {
+		logging.Fatal("Failed to initialize worker pool", "error", err)
+	}
+	// Decks are rendered by a long-lived Marp server that is restarted if it exits
+	renderer, err := slides.NewRenderer()
+	if err != nil {
+		logging.Fatal("Failed to initialize Marp renderer", "error", err)
+	}
+	renderer.Start()
+	defer renderer.Close()
+	slideService := slides.NewSlideService(apiKey, pool, renderer)
+
+	// Running jobs record a heartbeat this often so the API can recover them if this instance dies
+	heartbeatInterval := 15 * time.Second
+	if value := os.Getenv("JOB_HEARTBEAT_INTERVAL"); value != "" {
+		heartbeatInterval, err = time.ParseDuration(value)
+		if err != nil || heartbeatInterval <= 0 {
+			logging.Fatal("Invalid JOB_HEARTBEAT_INTERVAL", "value", value)
+		}
+	}
+
 	// Initialize controllers
-	taskController := controllers.NewTaskController(slideService, fsClient)
-	
+	taskController := controllers.NewTaskController(slideService, fsClient, heartbeatInterval)
+
 	// Define routes
 	router.POST("/tasks/process-slides", taskController.ProcessSlides)
-	router.GET("/health", func(c *gin.Context) {
-		c.JSON(http.StatusOK, gin.H{"status": "ok"})
-	})
+	router.GET("/tasks/generator", taskController.Generator)
+
+	// Liveness and readiness probes. Gemini and Chromium are slow or rate limited to check, so
+	// their results are cached. Restarting the container fixes neither them nor the Marp renderer,
+	// which restarts itself, so they only affect readiness.
+	healthService, err := health.NewService()
+	if err != nil {
+		logging.Fatal("Failed to initialize health checks", "error", err)
+	}
+	healthService.Register(health.FirestoreCheck(fsClient))
+	healthService.Register(health.DirWritableCheck("shared_volume", "/shared"))
+	healthService.Register(health.Check{Name: "gemini", Run: slideService.CheckGemini, Cached: true})
+	healthService.Register(health.Check{Name: "marp", Run: renderer.Check})
+	healthService.Register(health.Check{Name: "chromium", Run: slides.CheckChromium, Cached: true})
+	router.GET("/healthz", healthService.LivenessHandler())
+	router.GET("/readyz", healthService.ReadinessHandler())
+	// The original static check, kept for existing probes
+	router.GET("/health", healthService.LivenessHandler())
 
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8080"
 	}
-	
-	log.Printf("Starting slides service on port %s", port)
-	if err := router.Run(":" + port); err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+
+	// Running jobs get this long to finish after a termination signal
+	shutdownTimeout := 25 * time.Second
+	if value := os.Getenv("SHUTDOWN_TIMEOUT"); value != "" {
+		shutdownTimeout, err = time.ParseDuration(value)
+		if err != nil || shutdownTimeout <= 0 {
+			logging.Fatal("Invalid SHUTDOWN_TIMEOUT", "value", value)
+		}
+	}
+
+	// Prometheus metrics get their own port, which isn't exposed publicly
+	metricsPort := os.Getenv("METRICS_PORT")
+	if metricsPort == "" {
+		metricsPort = "9090"
+	}
+	metricsServer := telemetry.MetricsServer(":" + metricsPort)
+	go func() {
+		slog.Info("Starting metrics server", "port", metricsPort)
+		if err := metricsServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatal("Failed to start metrics server", "error", err)
+		}
+	}()
+
+	server := &http.Server{Addr: ":" + port, Handler: router}
+	go func() {
+		slog.Info("Starting slides service", "port", port)
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logging.Fatal("Failed to start server", "error", err)
+		}
+	}()
+
+	signalCtx, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	<-signalCtx.Done()
+	stopSignals()
+
+	// Stop taking jobs and wait for the running ones; whatever is still running at the deadline
+	// is handed back to the API to be retried
+	slog.Info("Shutting down, draining running jobs", "timeout", shutdownTimeout)
+	healthService.SetDraining()
+	taskController.Drain()
+	shutdownCtx, cancelShutdown := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancelShutdown()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Warn("Shutdown deadline passed with jobs still running", "error", err)
+		interruptCtx, cancelInterrupt := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancelInterrupt()
+		taskController.InterruptJobs(interruptCtx)
 	}
+	metricsServer.Close()
+	slog.Info("Slides service stopped")
 }
@@ -2,12 +2,85 @@ package models
 
 // SlideSettings represents the settings for slide generation
 type SlideSettings struct {
-	SlideDetail string `json:"slideDetail"` // Values: minimal, medium, detailed
-	Audience    string `json:"audience"`    // Values: general, academic, technical, professional, executive
-} 
+	SlideDetail string `json:"slideDetail"`     // Values: minimal, medium, detailed
+	Audience    string `json:"audience"`        // Values: general, academic, technical, professional, executive
+	Math        bool   `json:"math,omitempty"`  // Render $...$ formulas; only supported for the academic audience
+	Debug       bool   `json:"debug,omitempty"` // Log the job's document and deck content; only honoured where LOG_ALLOW_JOB_DEBUG is set
+}
 
 type File struct {
 	Filename string `json:"filename"`
-	Data []byte `json:"data"`
-	Type string `json:"type"`
+	Data     []byte `json:"data"`
+	Type     string `json:"type"`
+}
+
+// Image represents an image extracted from an uploaded document
+type Image struct {
+	ID          string `json:"id"`     // Stable reference used by the model, e.g. img-1
+	Source      string `json:"source"` // Filename of the document the image came from
+	Page        int    `json:"page"`   // 1-based page number in the source document
+	Width       int    `json:"width"`
+	Height      int    `json:"height"`
+	ContentType string `json:"contentType"`
+	Data        []byte `json:"data"`
+}
+
+// SlideResult holds the rendered presentation and the images it references
+type SlideResult struct {
+	PDFData  []byte
+	HTMLData []byte
+	Images   []Image // Only images actually referenced by the deck
+}
+
+// JobMetrics records the model usage and render times of a job so it can be charged back
+type JobMetrics struct {
+	Model            string  `json:"model" firestore:"model"`
+	CountedTokens    int32   `json:"countedTokens" firestore:"countedTokens"` // Input estimate from CountTokens
+	InputTokens      int32   `json:"inputTokens" firestore:"inputTokens"`
+	OutputTokens     int32   `json:"outputTokens" firestore:"outputTokens"`
+	GenerationMs     int64   `json:"generationMs" firestore:"generationMs"`
+	PDFRenderMs      int64   `json:"pdfRenderMs" firestore:"pdfRenderMs"`
+	HTMLRenderMs     int64   `json:"htmlRenderMs" firestore:"htmlRenderMs"`
+	EstimatedCostUSD float64 `json:"estimatedCostUsd" firestore:"estimatedCostUsd"`
+}
+
+// RetentionPolicy controls how long a job and its result are kept, as decided by the API
+type RetentionPolicy struct {
+	JobTTL              int64 `json:"jobTtl"`    // Seconds a finished job's status is kept
+	ResultTTL           int64 `json:"resultTtl"` // Seconds the result is kept, unless KeepForever is set
+	KeepForever         bool  `json:"keepForever,omitempty"`
+	DeleteAfterDownload bool  `json:"deleteAfterDownload,omitempty"` // Delete the result once it's first viewed or downloaded
+}
+
+// ProgressStage identifies the step of slide generation a job is in
+type ProgressStage string
+
+// Progress stages in the order a job passes through them
+const (
+	StageQueued       ProgressStage = "queued"
+	StageStarting     ProgressStage = "starting"
+	StageUploading    ProgressStage = "uploading_files"
+	StageExtracting   ProgressStage = "extracting_images"
+	StagePrompting    ProgressStage = "building_prompt"
+	StageGenerating   ProgressStage = "generating"
+	StageRenderingPDF ProgressStage = "rendering_pdf" // Renders both the PDF and HTML decks
+	StageStoring      ProgressStage = "storing_result"
+	StageCompleted    ProgressStage = "completed"
+)
+
+// JobProgress is the structured progress of a job, stored on the job and sent with each update
+type JobProgress struct {
+	Stage         ProgressStage `json:"stage" firestore:"stage"`
+	Percent       int           `json:"percent" firestore:"percent"`
+	FileIndex     int           `json:"fileIndex,omitempty" firestore:"fileIndex,omitempty"` // 1-based index of the file being processed
+	FileCount     int           `json:"fileCount,omitempty" firestore:"fileCount,omitempty"`
+	ETASeconds    int64         `json:"etaSeconds,omitempty" firestore:"etaSeconds,omitempty"`       // Estimated time remaining, unset until known
+	QueuePosition int           `json:"queuePosition,omitempty" firestore:"queuePosition,omitempty"` // 1-based position while waiting for a worker
+}
+
+// SlidePreview is the rendered HTML of a single slide, published while the rest of the deck is
+// still being generated
+type SlidePreview struct {
+	Index int    `json:"index" firestore:"index"` // 1-based position of the slide in the deck
+	HTML  string `json:"html" firestore:"html"`
 }
@@ -0,0 +1,319 @@
+// Long-lived Marp renderer for the slides-service. Decks are parsed with Marp Core and PDFs are
+// printed by a Chromium instance kept open between renders instead of one launched per render.
+//
+// Usage: node server.js <socket path>
+//
+// Serves HTTP on the unix socket:
+//   GET  /healthz  checks that Chromium can be launched
+//   POST /render   renders a deck, see render below
+'use strict'
+
+const fs = require('fs/promises')
+const http = require('http')
+const path = require('path')
+const { fileURLToPath, pathToFileURL } = require('url')
+const { Marp } = require('@marp-team/marp-core')
+const puppeteer = require('puppeteer-core')
+
+const socketPath = process.argv[2]
+if (!socketPath) {
+  console.error('usage: node server.js <socket path>')
+  process.exit(2)
+}
+
+// Chromium is looked up the same way as by the Go health checks
+const browserPath =
+  process.env.CHROME_PATH || process.env.PUPPETEER_EXECUTABLE_PATH || '/usr/bin/chromium-browser'
+
+// Requests larger than this are refused; decks are a few hundred KB at most
+const maxBodyBytes = 32 << 20
+
+// How long a render may take unless the request sets its own timeout
+const defaultTimeoutMs = 60000
+
+let browserPromise = null
+
+// browser returns the shared Chromium instance, launching it on first use and again after it
+// crashes or is closed. Puppeteer normally starts Chromium in a process group of its own; it's kept
+// in this server's group instead, so the slides-service's resource limits and kills cover it too.
+function browser() {
+  if (!browserPromise) {
+    browserPromise = puppeteer
+      .launch({
+        executablePath: browserPath,
+        headless: true,
+        detached: false,
+        args: ['--no-sandbox', '--disable-gpu', '--disable-dev-shm-usage'],
+      })
+      .then(
+        (instance) => {
+          instance.on('disconnected', () => {
+            console.error('Chromium disconnected, relaunching on the next render')
+            browserPromise = null
+          })
+          return instance
+        },
+        (err) => {
+          browserPromise = null
+          throw err
+        },
+      )
+  }
+  return browserPromise
+}
+
+// loadTheme registers a theme CSS file with marp and returns its name. Anything that isn't a CSS
+// file is taken to be the name of a built-in theme.
+async function loadTheme(marp, theme) {
+  if (!theme || !theme.endsWith('.css')) {
+    return theme || 'default'
+  }
+  const css = await fs.readFile(theme, 'utf8')
+  return marp.themeSet.add(css).name
+}
+
+// viewerCSS and viewerScript turn the rendered slides into a slideshow: one slide fills the
+// window and the arrow keys, space, clicks and the URL hash move between slides
+const viewerCSS = `
+html, body { margin: 0; height: 100%; background: #000; overflow: hidden; }
+div.marpit > svg { display: none; width: 100vw; height: 100vh; }
+div.marpit > svg.active { display: block; }
+`
+
+const viewerScript = `
+document.addEventListener('DOMContentLoaded', function () {
+  var slides = document.querySelectorAll('div.marpit > svg');
+  var current = -1;
+  function show(index) {
+    index = Math.max(0, Math.min(slides.length - 1, index));
+    if (index === current || !slides.length) return;
+    if (current >= 0) slides[current].classList.remove('active');
+    slides[index].classList.add('active');
+    current = index;
+    history.replaceState(null, '', '#' + (index + 1));
+  }
+  document.addEventListener('keydown', function (e) {
+    if (['ArrowRight', 'ArrowDown', 'PageDown', ' '].indexOf(e.key) >= 0) show(current + 1);
+    else if (['ArrowLeft', 'ArrowUp', 'PageUp'].indexOf(e.key) >= 0) show(current - 1);
+    else if (e.key === 'Home') show(0);
+    else if (e.key === 'End') show(slides.length - 1);
+    else return;
+    e.preventDefault();
+  });
+  document.addEventListener('click', function (e) {
+    if (e.target.closest('a')) return;
+    show(e.clientX < window.innerWidth / 3 ? current - 1 : current + 1);
+  });
+  show((parseInt(location.hash.slice(1), 10) || 1) - 1);
+});
+`
+
+// documentHTML wraps rendered slides in a standalone page. Bare pages leave out the slideshow
+// viewer and show every slide one after another.
+function documentHTML(html, css, bare) {
+  const viewer = bare ? '' : `<style>${viewerCSS}</style><script>${viewerScript}</script>`
+  return (
+    '<!DOCTYPE html><html><head><meta charset="UTF-8">' +
+    '<meta name="viewport" content="width=device-width,initial-scale=1">' +
+    `<style>${css}</style>${viewer}</head><body>${html}</body></html>`
+  )
+}
+
+// allowedRequest reports whether the page printing a deck may load url. Local files are limited to
+// dir, so a deck can't pull other files on this machine, such as another job's or /proc, into its
+// PDF. Built-in themes import web fonts, so remote stylesheets and fonts are allowed too.
+function allowedRequest(dir, url, resourceType) {
+  if (url.startsWith('data:')) {
+    return true
+  }
+  if (url.startsWith('file:')) {
+    let file
+    try {
+      file = fileURLToPath(url)
+    } catch {
+      return false
+    }
+    const relative = path.relative(dir, file)
+    return relative !== '' && !relative.startsWith('..') && !path.isAbsolute(relative)
+  }
+  return url.startsWith('https:') && (resourceType === 'stylesheet' || resourceType === 'font')
+}
+
+// printPDF prints the rendered slides to dir/presentation.pdf, one slide per page. The page is
+// loaded from dir so the relative image paths in the deck resolve to local files.
+async function printPDF(dir, html, css, timeoutMs) {
+  dir = path.resolve(dir)
+  const printPath = path.join(dir, 'print.html')
+  await fs.writeFile(printPath, documentHTML(html, css, true))
+
+  const page = await (await browser()).newPage()
+  try {
+    page.setDefaultTimeout(timeoutMs)
+    await page.setRequestInterception(true)
+    page.on('request', (request) => {
+      if (allowedRequest(dir, request.url(), request.resourceType())) {
+        request.continue()
+      } else {
+        request.abort('accessdenied')
+      }
+    })
+    await page.goto(pathToFileURL(printPath).href, { waitUntil: 'networkidle0' })
+
+    // Every slide has the deck's size as its viewBox, so size the pages to match
+    const size = await page.evaluate(() => {
+      const slide = document.querySelector('div.marpit > svg')
+      return slide ? { width: slide.viewBox.baseVal.width, height: slide.viewBox.baseVal.height } : null
+    })
+    if (!size) {
+      throw new RenderError('the deck has no slides', 422)
+    }
+    await page.addStyleTag({
+      content:
+        `@page { size: ${size.width}px ${size.height}px; margin: 0; }` +
+        'html, body { margin: 0; }' +
+        `div.marpit > svg { display: block; width: ${size.width}px; height: ${size.height}px; }` +
+        'div.marpit > svg:not(:last-of-type) { break-after: page; }',
+    })
+
+    const pdfPath = path.join(dir, 'presentation.pdf')
+    await page.pdf({ path: pdfPath, printBackground: true, preferCSSPageSize: true, timeout: timeoutMs })
+    return pdfPath
+  } finally {
+    await page.close().catch(() => {})
+  }
+}
+
+// render parses a deck and produces the outputs the request asks for:
+//   markdown   the deck
+//   theme      a built-in theme name or the path of a theme CSS file
+//   dir        the directory local images are resolved against and the PDF is written to
+//   html, pdf  which outputs to produce
+//   bare       leave the slideshow viewer out of the HTML
+//   timeoutMs  how long printing the PDF may take
+async function render(req) {
+  const timeoutMs = req.timeoutMs > 0 ? req.timeoutMs : defaultTimeoutMs
+  const result = {}
+
+  const parseStart = Date.now()
+  if (req.html) {
+    const { html, css } = await parse(req, true)
+    result.html = documentHTML(html, css, req.bare)
+  }
+  result.htmlMs = Date.now() - parseStart
+
+  if (req.pdf) {
+    if (!req.dir) {
+      throw new RenderError('dir is required to render a PDF', 400)
+    }
+    const pdfStart = Date.now()
+    const { html, css } = await parse(req, false)
+    result.pdfPath = await printPDF(req.dir, html, css, timeoutMs)
+    result.pdfMs = Date.now() - pdfStart
+  }
+  return result
+}
+
+// parse renders a deck's markdown with its theme. Raw HTML is only kept in the HTML presentation,
+// which viewers open in their own browser; the deck printed to a PDF gets Marp's default allowlist
+// of harmless elements, so it can't embed frames or scripts in the page Chromium prints.
+async function parse(req, allowHTML) {
+  const marp = new Marp(allowHTML ? { html: true } : {})
+  const theme = await loadTheme(marp, req.theme)
+  const themeInstance = marp.themeSet.get(theme)
+  if (!themeInstance) {
+    throw new RenderError(`unknown theme ${JSON.stringify(theme)}`, 400)
+  }
+  marp.themeSet.default = themeInstance
+  try {
+    return marp.render(req.markdown || '')
+  } catch (err) {
+    throw new RenderError(err.message, 422)
+  }
+}
+
+// RenderError is an error caused by the request rather than the renderer
+class RenderError extends Error {
+  constructor(message, status) {
+    super(message)
+    this.status = status
+  }
+}
+
+// failure describes why a render failed, so the service can tell bad input from a timeout or a
+// broken renderer: invalid, timeout or crash
+function failure(err) {
+  if (err instanceof RenderError) {
+    return { status: err.status, kind: 'invalid' }
+  }
+  if (err instanceof puppeteer.TimeoutError) {
+    return { status: 504, kind: 'timeout' }
+  }
+  return { status: 500, kind: 'crash' }
+}
+
+// readJSON reads and parses a request body
+function readJSON(req) {
+  return new Promise((resolve, reject) => {
+    const chunks = []
+    let size = 0
+    req.on('data', (chunk) => {
+      size += chunk.length
+      if (size > maxBodyBytes) {
+        reject(new RenderError('request is too large', 413))
+        req.destroy()
+        return
+      }
+      chunks.push(chunk)
+    })
+    req.on('end', () => {
+      try {
+        resolve(JSON.parse(Buffer.concat(chunks).toString('utf8')))
+      } catch (err) {
+        reject(new RenderError(`invalid request: ${err.message}`, 400))
+      }
+    })
+    req.on('error', reject)
+  })
+}
+
+// send writes a JSON response
+function send(res, status, body) {
+  res.writeHead(status, { 'Content-Type': 'application/json' })
+  res.end(JSON.stringify(body))
+}
+
+const server = http.createServer(async (req, res) => {
+  try {
+    if (req.method === 'GET' && req.url === '/healthz') {
+      await browser()
+      send(res, 200, { status: 'ok' })
+      return
+    }
+    if (req.method === 'POST' && req.url === '/render') {
+      send(res, 200, await render(await readJSON(req)))
+      return
+    }
+    send(res, 404, { error: 'not found' })
+  } catch (err) {
+    if (!(err instanceof RenderError)) {
+      console.error('Render failed:', err)
+    }
+    const { status, kind } = failure(err)
+    send(res, status, { error: err.message, kind })
+  }
+})
+
+// Close Chromium along with the server so no browser processes are left behind
+async function shutdown() {
+  server.close()
+  if (browserPromise) {
+    await browserPromise.then((instance) => instance.close()).catch(() => {})
+  }
+  process.exit(0)
+}
+process.on('SIGTERM', shutdown)
+process.on('SIGINT', shutdown)
+
+fs.rm(socketPath, { force: true }).then(() => {
+  server.listen(socketPath, () => console.error(`Marp renderer listening on ${socketPath}`))
+})
@@ -2,15 +2,20 @@ package prompts
 
 import (
 	"bytes"
+	"strings"
 	"text/template"
 
 	"github.com/martin226/slideitin/backend/slides-service/models"
 )
 
+// Version identifies the prompts below. Bump it whenever a change would produce different decks,
+// so the API stops reusing cached results generated with the old prompts.
+const Version = "1"
+
 // Templates for different prompt types
 const (
-// Template for slide generation prompt
-slideGenerationTemplate = `You are a domain expert with deep analytical capabilities and extensive experience in creating insightful Marp markdown presentations. You excel at critically analyzing documents, identifying key insights, drawing meaningful connections, and presenting complex information in a clear, impactful way. You have the ability to understand both explicit content and implicit implications within your domain of expertise.
+	// Template for slide generation prompt
+	slideGenerationTemplate = `You are a domain expert with deep analytical capabilities and extensive experience in creating insightful Marp markdown presentations. You excel at critically analyzing documents, identifying key insights, drawing meaningful connections, and presenting complex information in a clear, impactful way. You have the ability to understand both explicit content and implicit implications within your domain of expertise.
 	
 Create a Marp markdown presentation using the following instructions:
 
@@ -23,9 +28,24 @@ Theme: {{.Theme}}
 {{.DetailLevel}}
 
 {{.Audience}}
-
+{{if .Diagrams}}
+{{.Diagrams}}
+{{end}}{{if .Math}}
+{{.Math}}
+{{end}}
 Generate the presentation content in Vietnamese.
+{{if .Images}}
+The following images were extracted from the uploaded documents. You may include the ones that support your slides (charts, diagrams, photos), referring to them by ID with the image: prefix. Use Marp image syntax, for example:
+
+![bg right:40% fit](image:img-1)
 
+![w:600](image:img-2)
+
+Available images:
+{{.Images}}
+
+Only reference the IDs listed above, use each image at most once, and never invent image URLs.
+{{end}}
 IMPORTANT GUIDELINES:
 1. Always begin with a short title slide with a title, a short description, and author name (only if provided). The title should be an H1 header, the description should be a regular text, and the author name should be a regular text.
 2. Ensure that the content on each slide fits inside the slide. Never create paragraphs.
@@ -41,6 +61,29 @@ Enclose your response in triple backticks like this:
 <your response here>
 ` + "```"
 
+	// Instructions for diagrams and charts, which are rendered to images before the deck is built
+	diagramInstructions = `Where a diagram explains architecture, data flow, sequences or state better than bullet points, include it as a Mermaid code block. Keep diagrams small enough to fit on one slide (at most about 12 nodes) and put each diagram on its own slide with a short heading:
+
+` + "```" + `mermaid
+flowchart LR
+  Client --> API --> Queue --> Worker
+` + "```" + `
+
+Where the document contains numeric data worth comparing, include a chart as a chart code block containing JSON. The type must be bar, line or pie. Only use numbers that appear in the document, every series must have one value per label, values must not be negative, and pie charts take a single series:
+
+` + "```" + `chart
+{"type": "bar", "title": "Requests per second", "unit": "k", "labels": ["v1", "v2"], "series": [{"name": "p50", "values": [12, 18]}]}
+` + "```"
+
+	// Instructions for math, which Marp renders with KaTeX or MathJax
+	mathInstructions = `Use LaTeX math for formulas, equations and symbols rather than writing them out in words. Write inline math between single dollar signs, like $E = mc^2$, and display math on its own lines between double dollar signs:
+
+$$
+\sum_{i=1}^{n} x_i = \frac{n(n+1)}{2}
+$$
+
+Only use commands supported by KaTeX. Do not use \label, \ref or document-level commands, keep every brace and \begin/\end pair balanced, and never put math inside code blocks. Escape literal dollar signs for currency as \$.`
+
 	// Common markdown header template used across all themes
 	commonMarpHeader = `---
 marp: true
@@ -136,63 +179,64 @@ This is regular text`
 // Theme configurations
 var themeConfigs = map[string]map[string]interface{}{
 	"default": {
-		"UseLeadClass":    true,
-		"HasInvertClass":  true,
+		"UseLeadClass":     true,
+		"HasInvertClass":   true,
 		"HasTinyTextClass": false,
-		"HasTitleClass":   false,
-		"HeaderLocation":  "(top left of the slide)",
-		"FooterLocation":  "(bottom left of the slide)",
+		"HasTitleClass":    false,
+		"HeaderLocation":   "(top left of the slide)",
+		"FooterLocation":   "(bottom left of the slide)",
 		"ThemeDescription": "By default, the color scheme for each slide is light.",
 	},
 	"beam": {
-		"UseLeadClass":    false,
-		"HasInvertClass":  false,
+		"UseLeadClass":     false,
+		"HasInvertClass":   false,
 		"HasTinyTextClass": true,
-		"HasTitleClass":   true,
-		"HeaderLocation":  "(bottom left half of the slide)",
-		"FooterLocation":  "(bottom right half of the slide)",
+		"HasTitleClass":    true,
+		"HeaderLocation":   "(bottom left half of the slide)",
+		"FooterLocation":   "(bottom right half of the slide)",
 		"ThemeDescription": "IMPORTANT: You must use the above title class tag at the top of the title slide (<!-- _class: title -->).\n- Beam is a light color scheme based on the LaTeX Beamer theme.",
 	},
 	"rose-pine": {
-		"UseLeadClass":    true,
-		"HasInvertClass":  false,
+		"UseLeadClass":     true,
+		"HasInvertClass":   false,
 		"HasTinyTextClass": false,
-		"HasTitleClass":   false,
-		"HeaderLocation":  "(top left of the slide)",
-		"FooterLocation":  "(bottom left of the slide)",
+		"HasTitleClass":    false,
+		"HeaderLocation":   "(top left of the slide)",
+		"FooterLocation":   "(bottom left of the slide)",
 		"ThemeDescription": "Rose Pine is a dark color scheme.",
 	},
 	"gaia": {
-		"UseLeadClass":    true,
-		"HasInvertClass":  true,
+		"UseLeadClass":     true,
+		"HasInvertClass":   true,
 		"HasTinyTextClass": false,
-		"HasTitleClass":   false,
-		"HeaderLocation":  "(top left of the slide)",
-		"FooterLocation":  "(bottom left of the slide)",
+		"HasTitleClass":    false,
+		"HeaderLocation":   "(top left of the slide)",
+		"FooterLocation":   "(bottom left of the slide)",
 		"ThemeDescription": "By default, the color scheme for each slide is light.",
 	},
 	"uncover": {
-		"UseLeadClass":    true,
-		"HasInvertClass":  true,
+		"UseLeadClass":     true,
+		"HasInvertClass":   true,
 		"HasTinyTextClass": false,
-		"HasTitleClass":   false,
-		"HeaderLocation":  "(top middle of the slide)",
-		"FooterLocation":  "(bottom middle of the slide)",
+		"HasTitleClass":    false,
+		"HeaderLocation":   "(top middle of the slide)",
+		"FooterLocation":   "(bottom middle of the slide)",
 		"ThemeDescription": "By default, the color scheme for each slide is light.",
 	},
 	"graph_paper": {
-		"UseLeadClass":    true,
-		"HasInvertClass":  false,
+		"UseLeadClass":     true,
+		"HasInvertClass":   false,
 		"HasTinyTextClass": true,
-		"HasTitleClass":   false,
-		"HeaderLocation":  "(top left of the slide)",
-		"FooterLocation":  "(bottom left of the slide)",
+		"HasTitleClass":    false,
+		"HeaderLocation":   "(top left of the slide)",
+		"FooterLocation":   "(bottom left of the slide)",
 		"ThemeDescription": "Graph Paper is a light color scheme.",
 	},
 }
 
-// GenerateSlidePrompt creates a prompt for slide generation based on the given parameters
-func GenerateSlidePrompt(theme string, settings models.SlideSettings) (string, error) {
+// GenerateSlidePrompt creates a prompt for slide generation based on the given parameters.
+// images describes the extracted images the model may reference, one per line.
+func GenerateSlidePrompt(theme string, settings models.SlideSettings, images []string) (string, error) {
 	// Generate theme example
 	themeExample, err := generateThemeExample(theme)
 	if err != nil {
@@ -221,12 +265,27 @@ func GenerateSlidePrompt(theme string, settings models.SlideSettings) (string, e
 		audiencePrompt = "Format the presentation for executive decision-makers with emphasis on strategic vision and organizational impact. Analyze the content to identify major strategic opportunities, risks, and competitive implications. Transform detailed findings into high-level insights that inform executive decision-making. When presenting outcomes or metrics, emphasize their impact on organizational strategy and market position. Look for insights about industry disruption, market transformation, or emerging opportunities. Identify implications for organizational capabilities, resource allocation, and competitive positioning. For financial or operational data, provide strategic context and long-term implications. Structure the presentation around key strategic decisions while maintaining focus on sustainable competitive advantage and organizational growth."
 	}
 
+	// Technical audiences get diagrams, which the slides service pre-renders to SVG
+	diagramPrompt := ""
+	if settings.Audience == "technical" {
+		diagramPrompt = diagramInstructions
+	}
+
+	// Academic decks can opt in to math, which Marp renders with KaTeX or MathJax
+	mathPrompt := ""
+	if settings.Math && settings.Audience == "academic" {
+		mathPrompt = mathInstructions
+	}
+
 	// Create template data
 	data := map[string]interface{}{
 		"Theme":        theme,
 		"ThemeExample": themeExample,
 		"DetailLevel":  detailPrompt,
 		"Audience":     audiencePrompt,
+		"Images":       strings.Join(images, "\n"),
+		"Diagrams":     diagramPrompt,
+		"Math":         mathPrompt,
 	}
 
 	// Parse and execute the template
@@ -250,7 +309,7 @@ func generateThemeExample(theme string) (string, error) {
 	if !exists {
 		themeConfig = themeConfigs["default"]
 	}
-	
+
 	// Copy the theme config and add the theme name
 	templateData := make(map[string]interface{})
 	for k, v := range themeConfig {
@@ -263,26 +322,26 @@ func generateThemeExample(theme string) (string, error) {
 	if err != nil {
 		return "", err
 	}
-	
+
 	var headerBuf bytes.Buffer
 	if err := headerTemplate.Execute(&headerBuf, templateData); err != nil {
 		return "", err
 	}
-	
+
 	// Generate the body
 	bodyTemplate, err := template.New("body").Parse(commonExampleBody)
 	if err != nil {
 		return "", err
 	}
-	
+
 	var bodyBuf bytes.Buffer
 	if err := bodyTemplate.Execute(&bodyBuf, templateData); err != nil {
 		return "", err
 	}
-	
+
 	// Combine the parts into a complete example
 	example := "```md\n" + headerBuf.String() + bodyBuf.String() + "\n```"
-	
+
 	return example, nil
 }
 
@@ -0,0 +1,226 @@
+package slides
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"math"
+	"strings"
+)
+
+// Canvas and layout constants for chart SVGs
+const (
+	chartWidth        = 800
+	chartHeight       = 450
+	chartMarginLeft   = 70
+	chartMarginRight  = 20
+	chartMarginTop    = 50
+	chartMarginBottom = 80
+	chartGridLines    = 5
+)
+
+// chartPalette holds the series colors
+var chartPalette = []string{"#4e79a7", "#f28e2b", "#e15759", "#76b7b2", "#59a14f", "#edc948", "#b07aa1", "#ff9da7"}
+
+// ChartSeries is one named series of values in a chart spec
+type ChartSeries struct {
+	Name   string    `json:"name"`
+	Values []float64 `json:"values"`
+}
+
+// ChartSpec is the JSON chart description the model emits in ```chart blocks
+type ChartSpec struct {
+	Type   string        `json:"type"` // Values: bar, line, pie
+	Title  string        `json:"title"`
+	Unit   string        `json:"unit,omitempty"`
+	Labels []string      `json:"labels"`
+	Series []ChartSeries `json:"series"`
+}
+
+// parseChartSpec parses and validates a chart spec
+func parseChartSpec(source string) (*ChartSpec, error) {
+	var spec ChartSpec
+	if err := json.Unmarshal([]byte(source), &spec); err != nil {
+		return nil, fmt.Errorf("invalid chart JSON: %v", err)
+	}
+
+	spec.Type = strings.ToLower(strings.TrimSpace(spec.Type))
+	if spec.Type != "bar" && spec.Type != "line" && spec.Type != "pie" {
+		return nil, fmt.Errorf("unsupported chart type: %q", spec.Type)
+	}
+	if len(spec.Labels) == 0 || len(spec.Series) == 0 {
+		return nil, errors.New("chart needs at least one label and one series")
+	}
+	for _, series := range spec.Series {
+		if len(series.Values) != len(spec.Labels) {
+			return nil, fmt.Errorf("series %q has %d values for %d labels", series.Name, len(series.Values), len(spec.Labels))
+		}
+		for _, v := range series.Values {
+			if v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+				return nil, fmt.Errorf("series %q contains an unsupported value", series.Name)
+			}
+		}
+	}
+	if spec.Type == "pie" && len(spec.Series) > 1 {
+		return nil, errors.New("pie charts support a single series")
+	}
+
+	return &spec, nil
+}
+
+// renderChartSVG renders a chart spec to a standalone SVG document
+func renderChartSVG(spec *ChartSpec) []byte {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" font-family="sans-serif">`,
+		chartWidth, chartHeight, chartWidth, chartHeight)
+	// Opaque background keeps the dark text legible on dark themes like rose_pine
+	sb.WriteString(`<rect width="100%" height="100%" fill="#fff"/>`)
+	if spec.Title != "" {
+		fmt.Fprintf(&sb, `<text x="%d" y="30" font-size="22" font-weight="bold" text-anchor="middle" fill="#333">%s</text>`,
+			chartWidth/2, html.EscapeString(spec.Title))
+	}
+
+	switch spec.Type {
+	case "pie":
+		writePieChart(&sb, spec)
+	default:
+		writeAxisChart(&sb, spec)
+	}
+
+	sb.WriteString(`</svg>`)
+	return []byte(sb.String())
+}
+
+// writeAxisChart draws bar and line charts on shared axes
+func writeAxisChart(sb *strings.Builder, spec *ChartSpec) {
+	plotLeft := float64(chartMarginLeft)
+	plotTop := float64(chartMarginTop)
+	plotWidth := float64(chartWidth - chartMarginLeft - chartMarginRight)
+	plotHeight := float64(chartHeight - chartMarginTop - chartMarginBottom)
+	plotBottom := plotTop + plotHeight
+
+	maxValue := 0.0
+	for _, series := range spec.Series {
+		for _, v := range series.Values {
+			maxValue = math.Max(maxValue, v)
+		}
+	}
+	axisMax := niceCeiling(maxValue)
+	yFor := func(v float64) float64 { return plotBottom - v/axisMax*plotHeight }
+
+	// Horizontal grid lines with value labels
+	for i := 0; i <= chartGridLines; i++ {
+		value := axisMax * float64(i) / chartGridLines
+		y := yFor(value)
+		fmt.Fprintf(sb, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#ddd"/>`, plotLeft, y, plotLeft+plotWidth, y)
+		fmt.Fprintf(sb, `<text x="%.1f" y="%.1f" font-size="13" text-anchor="end" fill="#555">%s</text>`,
+			plotLeft-8, y+4, html.EscapeString(formatChartValue(value, spec.Unit)))
+	}
+	fmt.Fprintf(sb, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#555"/>`, plotLeft, plotBottom, plotLeft+plotWidth, plotBottom)
+
+	groupWidth := plotWidth / float64(len(spec.Labels))
+	for i, label := range spec.Labels {
+		x := plotLeft + groupWidth*(float64(i)+0.5)
+		fmt.Fprintf(sb, `<text x="%.1f" y="%.1f" font-size="13" text-anchor="middle" fill="#333">%s</text>`,
+			x, plotBottom+20, html.EscapeString(label))
+	}
+
+	if spec.Type == "bar" {
+		barWidth := groupWidth * 0.8 / float64(len(spec.Series))
+		for j, series := range spec.Series {
+			color := chartPalette[j%len(chartPalette)]
+			for i, v := range series.Values {
+				x := plotLeft + groupWidth*float64(i) + groupWidth*0.1 + barWidth*float64(j)
+				y := yFor(v)
+				fmt.Fprintf(sb, `<rect x="%.1f" y="%.1f" width="%.1f" height="%.1f" fill="%s"/>`,
+					x, y, barWidth, plotBottom-y, color)
+			}
+		}
+	} else {
+		for j, series := range spec.Series {
+			color := chartPalette[j%len(chartPalette)]
+			points := make([]string, 0, len(series.Values))
+			for i, v := range series.Values {
+				points = append(points, fmt.Sprintf("%.1f,%.1f", plotLeft+groupWidth*(float64(i)+0.5), yFor(v)))
+			}
+			fmt.Fprintf(sb, `<polyline points="%s" fill="none" stroke="%s" stroke-width="3"/>`, strings.Join(points, " "), color)
+			for _, point := range points {
+				xy := strings.Split(point, ",")
+				fmt.Fprintf(sb, `<circle cx="%s" cy="%s" r="4" fill="%s"/>`, xy[0], xy[1], color)
+			}
+		}
+	}
+
+	// Legend along the bottom, only useful when there's more than one series
+	if len(spec.Series) > 1 {
+		x := plotLeft
+		for j, series := range spec.Series {
+			color := chartPalette[j%len(chartPalette)]
+			fmt.Fprintf(sb, `<rect x="%.1f" y="%d" width="14" height="14" fill="%s"/>`, x, chartHeight-30, color)
+			fmt.Fprintf(sb, `<text x="%.1f" y="%d" font-size="13" fill="#333">%s</text>`, x+20, chartHeight-18, html.EscapeString(series.Name))
+			x += 40 + float64(len(series.Name))*8
+		}
+	}
+}
+
+// writePieChart draws a pie chart of the first series with a legend on the right
+func writePieChart(sb *strings.Builder, spec *ChartSpec) {
+	values := spec.Series[0].Values
+	total := 0.0
+	for _, v := range values {
+		total += v
+	}
+	if total == 0 {
+		return
+	}
+
+	cx, cy, r := 260.0, 250.0, 160.0
+	angle := -math.Pi / 2 // Start at 12 o'clock
+	for i, v := range values {
+		color := chartPalette[i%len(chartPalette)]
+		sweep := v / total * 2 * math.Pi
+		if sweep >= 2*math.Pi-1e-9 {
+			// A single slice covering the whole pie can't be drawn as an arc
+			fmt.Fprintf(sb, `<circle cx="%.1f" cy="%.1f" r="%.1f" fill="%s"/>`, cx, cy, r, color)
+		} else if sweep > 0 {
+			x1, y1 := cx+r*math.Cos(angle), cy+r*math.Sin(angle)
+			x2, y2 := cx+r*math.Cos(angle+sweep), cy+r*math.Sin(angle+sweep)
+			largeArc := 0
+			if sweep > math.Pi {
+				largeArc = 1
+			}
+			fmt.Fprintf(sb, `<path d="M%.1f,%.1f L%.1f,%.1f A%.1f,%.1f 0 %d 1 %.1f,%.1f Z" fill="%s" stroke="#fff" stroke-width="2"/>`,
+				cx, cy, x1, y1, r, r, largeArc, x2, y2, color)
+		}
+		angle += sweep
+
+		legendY := 110 + i*28
+		fmt.Fprintf(sb, `<rect x="480" y="%d" width="16" height="16" fill="%s"/>`, legendY, color)
+		fmt.Fprintf(sb, `<text x="504" y="%d" font-size="15" fill="#333">%s (%.0f%%)</text>`,
+			legendY+13, html.EscapeString(spec.Labels[i]), v/total*100)
+	}
+}
+
+// niceCeiling rounds a value up to a readable axis maximum (1, 2, 2.5 or 5 times a power of ten)
+func niceCeiling(v float64) float64 {
+	if v <= 0 {
+		return 1
+	}
+	magnitude := math.Pow(10, math.Floor(math.Log10(v)))
+	for _, step := range []float64{1, 2, 2.5, 5, 10} {
+		if step*magnitude >= v {
+			return step * magnitude
+		}
+	}
+	return 10 * magnitude
+}
+
+// formatChartValue formats an axis value without trailing zeros
+func formatChartValue(v float64, unit string) string {
+	s := strings.TrimRight(strings.TrimRight(fmt.Sprintf("%.2f", v), "0"), ".")
+	if unit != "" {
+		s += " " + unit
+	}
+	return s
+}
@@ -0,0 +1,84 @@
+package slides
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseChartSpec(t *testing.T) {
+	tests := []struct {
+		name     string
+		source   string
+		wantType string
+		wantErr  string
+	}{
+		{
+			name:     "bar",
+			source:   `{"type": "bar", "labels": ["Q1", "Q2"], "series": [{"name": "Revenue", "values": [1, 2]}]}`,
+			wantType: "bar",
+		},
+		{
+			name:     "type is normalised",
+			source:   `{"type": " Line ", "labels": ["Q1"], "series": [{"name": "Revenue", "values": [1]}]}`,
+			wantType: "line",
+		},
+		{
+			name:     "pie",
+			source:   `{"type": "pie", "labels": ["A", "B"], "series": [{"name": "Share", "values": [60, 40]}]}`,
+			wantType: "pie",
+		},
+		{
+			name:    "invalid JSON",
+			source:  `{"type": "bar",`,
+			wantErr: "invalid chart JSON",
+		},
+		{
+			name:    "unsupported type",
+			source:  `{"type": "radar", "labels": ["A"], "series": [{"name": "S", "values": [1]}]}`,
+			wantErr: "unsupported chart type",
+		},
+		{
+			name:    "no labels",
+			source:  `{"type": "bar", "labels": [], "series": [{"name": "S", "values": []}]}`,
+			wantErr: "at least one label and one series",
+		},
+		{
+			name:    "no series",
+			source:  `{"type": "bar", "labels": ["A"], "series": []}`,
+			wantErr: "at least one label and one series",
+		},
+		{
+			name:    "too few values",
+			source:  `{"type": "bar", "labels": ["A", "B"], "series": [{"name": "S", "values": [1]}]}`,
+			wantErr: `series "S" has 1 values for 2 labels`,
+		},
+		{
+			name:    "negative value",
+			source:  `{"type": "bar", "labels": ["A"], "series": [{"name": "S", "values": [-1]}]}`,
+			wantErr: "unsupported value",
+		},
+		{
+			name:    "pie with two series",
+			source:  `{"type": "pie", "labels": ["A"], "series": [{"name": "S", "values": [1]}, {"name": "T", "values": [2]}]}`,
+			wantErr: "single series",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			spec, err := parseChartSpec(tt.source)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Errorf("parseChartSpec() error = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parseChartSpec() error = %v", err)
+			}
+			if spec.Type != tt.wantType {
+				t.Errorf("parseChartSpec() type = %q, want %q", spec.Type, tt.wantType)
+			}
+		})
+	}
+}
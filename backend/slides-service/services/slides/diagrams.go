@@ -0,0 +1,126 @@
+package slides
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/martin226/slideitin/backend/slides-service/models"
+	"github.com/martin226/slideitin/backend/slides-service/services/logging"
+)
+
+// maxDiagrams caps how many diagrams are pre-rendered for a single deck
+const maxDiagrams = 10
+
+var (
+	// diagramFenceOpen matches the opening line of a mermaid or chart code block
+	diagramFenceOpen = regexp.MustCompile("^```\\s*(mermaid|chart)\\s*$")
+	// fenceClose matches the closing line of any code block
+	fenceClose = regexp.MustCompile("^```\\s*$")
+)
+
+// mermaidPuppeteerConfig lets mmdc launch the container's Chromium as root
+const mermaidPuppeteerConfig = `{"args": ["--no-sandbox", "--disable-gpu"]}`
+
+// renderDiagrams pre-renders ```mermaid and ```chart blocks to SVG images. Each rendered block is
+// replaced with an image:<id> reference so it flows through the same path as extracted PDF images.
+// Blocks that fail to render are left as code so the deck still renders.
+func renderDiagrams(ctx context.Context, markdown string) (string, []models.Image) {
+	lines := strings.Split(markdown, "\n")
+	out := make([]string, 0, len(lines))
+	diagrams := make([]models.Image, 0)
+
+	for i := 0; i < len(lines); i++ {
+		match := diagramFenceOpen.FindStringSubmatch(strings.TrimSpace(lines[i]))
+		if match == nil || len(diagrams) >= maxDiagrams {
+			out = append(out, lines[i])
+			continue
+		}
+
+		// Find the closing fence
+		end := -1
+		for j := i + 1; j < len(lines); j++ {
+			if fenceClose.MatchString(strings.TrimSpace(lines[j])) {
+				end = j
+				break
+			}
+		}
+		if end == -1 {
+			out = append(out, lines[i])
+			continue
+		}
+
+		source := strings.Join(lines[i+1:end], "\n")
+		id := fmt.Sprintf("diagram-%d", len(diagrams)+1)
+
+		var svg []byte
+		var err error
+		if match[1] == "mermaid" {
+			svg, err = renderMermaidSVG(ctx, source)
+		} else {
+			var spec *ChartSpec
+			spec, err = parseChartSpec(source)
+			if err == nil {
+				svg = renderChartSVG(spec)
+			}
+		}
+		if err != nil {
+			// Chart and Mermaid errors can quote the diagram source, so they count as deck content
+			slog.WarnContext(ctx, "Failed to render diagram, leaving it as code", "source", match[1])
+			logging.Content(ctx, "Diagram render error", "error", err.Error())
+			out = append(out, lines[i:end+1]...)
+			i = end
+			continue
+		}
+
+		diagrams = append(diagrams, models.Image{
+			ID:          id,
+			Source:      match[1],
+			ContentType: "image/svg+xml",
+			Data:        svg,
+		})
+		out = append(out, fmt.Sprintf("![h:440](image:%s)", id))
+		i = end
+	}
+
+	if len(diagrams) > 0 {
+		slog.InfoContext(ctx, "Pre-rendered diagrams", "diagrams", len(diagrams))
+	}
+	return strings.Join(out, "\n"), diagrams
+}
+
+// renderMermaidSVG renders a Mermaid definition to SVG using mermaid-cli
+func renderMermaidSVG(ctx context.Context, source string) ([]byte, error) {
+	tempDir, err := os.MkdirTemp("", "slideitin-mermaid-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	inputPath := filepath.Join(tempDir, "diagram.mmd")
+	outputPath := filepath.Join(tempDir, "diagram.svg")
+	configPath := filepath.Join(tempDir, "puppeteer.json")
+	if err := os.WriteFile(inputPath, []byte(source), 0644); err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(configPath, []byte(mermaidPuppeteerConfig), 0644); err != nil {
+		return nil, err
+	}
+
+	// mermaid-cli exits non-zero when the diagram doesn't parse
+	err = runCommand(ctx, "rendering a Mermaid diagram", ErrInvalidMarkdown, "mmdc",
+		"--input", inputPath,
+		"--output", outputPath,
+		"--backgroundColor", "white",
+		"--puppeteerConfigFile", configPath,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(outputPath)
+}
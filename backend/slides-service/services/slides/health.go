@@ -0,0 +1,55 @@
+package slides
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// chromiumCandidates are the browser executables looked up on PATH when no path is configured
+var chromiumCandidates = []string{"chromium-browser", "chromium", "google-chrome-stable", "google-chrome"}
+
+// CheckGemini checks that the Gemini API can be reached with the configured key and model
+func (s *SlideService) CheckGemini(ctx context.Context) error {
+	if _, err := s.model.Info(ctx); err != nil {
+		return fmt.Errorf("failed to get model info: %v", err)
+	}
+	return nil
+}
+
+// CheckChromium checks that the browser Marp renders PDFs with can be launched
+func CheckChromium(ctx context.Context) error {
+	browser, err := chromiumPath()
+	if err != nil {
+		return err
+	}
+
+	// Chromium forks helper processes, so run it in its own process group to kill them all
+	cmd := command(ctx, true, browser, "--headless", "--no-sandbox", "--disable-gpu", "--dump-dom", "about:blank")
+	var cmdError bytes.Buffer
+	cmd.Stderr = &cmdError
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("failed to launch %s: %v: %s", browser, err, strings.TrimSpace(cmdError.String()))
+	}
+	return nil
+}
+
+// chromiumPath finds the browser the same way Marp does, preferring CHROME_PATH and then the
+// Puppeteer executable set in the container image
+func chromiumPath() (string, error) {
+	for _, name := range []string{"CHROME_PATH", "PUPPETEER_EXECUTABLE_PATH"} {
+		if path := os.Getenv(name); path != "" {
+			return path, nil
+		}
+	}
+	for _, candidate := range chromiumCandidates {
+		if path, err := exec.LookPath(candidate); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.New("no Chromium executable found")
+}
@@ -0,0 +1,181 @@
+package slides
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	_ "image/jpeg" // Register JPEG decoder for image.DecodeConfig
+	_ "image/png"  // Register PNG decoder for image.DecodeConfig
+	"log/slog"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/martin226/slideitin/backend/slides-service/models"
+)
+
+// Limits for images extracted from PDFs
+const (
+	maxExtractedImages = 12
+	minImageDimension  = 150     // Smaller images are usually icons, logos or rules
+	maxImageBytes      = 900_000 // Keep each stored image below the Firestore document limit
+)
+
+// pdfImageName matches files written by `pdfimages -p`, e.g. img-003-001.jpg
+var pdfImageName = regexp.MustCompile(`-(\d+)-(\d+)\.(jpg|png)$`)
+
+// imageReference matches Marp image syntax pointing at an extracted image, e.g. ![bg right](image:img-1)
+var imageReference = regexp.MustCompile(`!\[([^\]]*)\]\(image:([a-zA-Z0-9-]+)\)`)
+
+// extractPDFImages extracts embedded images from the PDF files using poppler's pdfimages
+func extractPDFImages(ctx context.Context, files []models.File) ([]models.Image, error) {
+	images := make([]models.Image, 0)
+
+	for _, file := range files {
+		if file.Type != "application/pdf" {
+			continue
+		}
+		if len(images) >= maxExtractedImages {
+			break
+		}
+
+		extracted, err := extractImagesFromPDF(ctx, file)
+		if err != nil {
+			return nil, err
+		}
+		for _, img := range extracted {
+			if len(images) >= maxExtractedImages {
+				break
+			}
+			img.ID = fmt.Sprintf("img-%d", len(images)+1)
+			images = append(images, img)
+		}
+	}
+
+	return images, nil
+}
+
+// extractImagesFromPDF runs pdfimages on a single PDF and returns the usable images in page order
+func extractImagesFromPDF(ctx context.Context, file models.File) ([]models.Image, error) {
+	tempDir, err := os.MkdirTemp("", "slideitin-images-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tempDir)
+
+	pdfPath := filepath.Join(tempDir, "source.pdf")
+	if err := os.WriteFile(pdfPath, file.Data, 0644); err != nil {
+		return nil, err
+	}
+
+	// -all keeps the native encoding so JPEG photos aren't re-encoded as large PNGs
+	err = runCommand(ctx, "extracting images from "+file.Filename, nil, "pdfimages", "-all", "-p", pdfPath, filepath.Join(tempDir, "img"))
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := os.ReadDir(tempDir)
+	if err != nil {
+		return nil, err
+	}
+
+	images := make([]models.Image, 0)
+	for _, entry := range entries {
+		match := pdfImageName.FindStringSubmatch(entry.Name())
+		if match == nil {
+			// Skip formats browsers can't display (jp2, jbig2, ccitt, ...)
+			continue
+		}
+
+		data, err := os.ReadFile(filepath.Join(tempDir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > maxImageBytes {
+			slog.DebugContext(ctx, "Skipping image that exceeds the size limit", "image", entry.Name(), "bytes", len(data))
+			continue
+		}
+
+		config, _, err := image.DecodeConfig(bytes.NewReader(data))
+		if err != nil {
+			slog.DebugContext(ctx, "Skipping undecodable image", "image", entry.Name(), "error", err)
+			continue
+		}
+		if config.Width < minImageDimension || config.Height < minImageDimension {
+			continue
+		}
+
+		page, _ := strconv.Atoi(match[1])
+		contentType := "image/png"
+		if match[3] == "jpg" {
+			contentType = "image/jpeg"
+		}
+		images = append(images, models.Image{
+			Source:      file.Filename,
+			Page:        page,
+			Width:       config.Width,
+			Height:      config.Height,
+			ContentType: contentType,
+			Data:        data,
+		})
+	}
+
+	// ReadDir sorts by name and pdfimages zero-pads page numbers, but be explicit
+	sort.SliceStable(images, func(i, j int) bool { return images[i].Page < images[j].Page })
+
+	slog.InfoContext(ctx, "Extracted usable images", "images", len(images))
+	return images, nil
+}
+
+// imageExtension returns the file extension for an image's content type
+func imageExtension(img models.Image) string {
+	switch img.ContentType {
+	case "image/jpeg":
+		return ".jpg"
+	case "image/svg+xml":
+		return ".svg"
+	default:
+		return ".png"
+	}
+}
+
+// resolveImageReferences rewrites image:<id> references using urlFn and drops references to unknown
+// images. It returns the rewritten markdown and the images that were referenced.
+func resolveImageReferences(markdown string, images []models.Image, urlFn func(models.Image) string) (string, []models.Image) {
+	byID := make(map[string]models.Image, len(images))
+	for _, img := range images {
+		byID[img.ID] = img
+	}
+
+	used := make([]models.Image, 0)
+	seen := make(map[string]bool)
+	resolved := imageReference.ReplaceAllStringFunc(markdown, func(ref string) string {
+		match := imageReference.FindStringSubmatch(ref)
+		img, ok := byID[match[2]]
+		if !ok {
+			slog.Debug("Dropping reference to unknown image", "image", match[2])
+			return ""
+		}
+		if !seen[img.ID] {
+			seen[img.ID] = true
+			used = append(used, img)
+		}
+		return "![" + match[1] + "](" + urlFn(img) + ")"
+	})
+
+	return resolved, used
+}
+
+// describeImages lists the available images for the prompt
+func describeImages(images []models.Image) []string {
+	lines := make([]string, 0, len(images))
+	for _, img := range images {
+		lines = append(lines, fmt.Sprintf("- %s: page %d of %s (%dx%d px)",
+			img.ID, img.Page, strings.TrimSpace(img.Source), img.Width, img.Height))
+	}
+	return lines
+}
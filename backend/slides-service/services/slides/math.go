@@ -0,0 +1,257 @@
+package slides
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/martin226/slideitin/backend/slides-service/services/logging"
+)
+
+// Supported Marp math renderers
+var validMathRenderers = []string{"katex", "mathjax"}
+
+// unsupportedTeXCommands are LaTeX commands that neither KaTeX nor MathJax can render inline
+var unsupportedTeXCommands = []string{`\label`, `\usepackage`, `\documentclass`, `\include`, `\input`, `\write`, `\immediate`}
+
+var texEnvironment = regexp.MustCompile(`\\(begin|end)\{([^}]*)\}`)
+
+// texLeft and texRight match delimiter sizing commands but not \leftarrow or \rightarrow
+var (
+	texLeft  = regexp.MustCompile(`\\left(?:[^a-zA-Z]|$)`)
+	texRight = regexp.MustCompile(`\\right(?:[^a-zA-Z]|$)`)
+)
+
+// mathRenderer returns the Marp math renderer configured by MARP_MATH_RENDERER (default katex)
+func mathRenderer() string {
+	renderer := strings.ToLower(strings.TrimSpace(os.Getenv("MARP_MATH_RENDERER")))
+	for _, valid := range validMathRenderers {
+		if renderer == valid {
+			return renderer
+		}
+	}
+	if renderer != "" {
+		slog.Warn("Unsupported MARP_MATH_RENDERER, using katex", "renderer", renderer)
+	}
+	return "katex"
+}
+
+// prepareMath enables the math renderer in the deck's front-matter and replaces formulas that
+// fail validation with code so one bad formula can't break the whole render
+func prepareMath(ctx context.Context, markdown string) string {
+	markdown = setFrontmatterDirective(markdown, "math", mathRenderer())
+
+	lines := strings.Split(markdown, "\n")
+	out := make([]string, 0, len(lines))
+	inCode := false
+	invalid := 0
+
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		// Never treat dollar signs inside fenced code as math
+		if strings.HasPrefix(trimmed, "```") {
+			inCode = !inCode
+			out = append(out, line)
+			continue
+		}
+		if inCode {
+			out = append(out, line)
+			continue
+		}
+
+		// Multi-line display math opened by a line starting with $$
+		if strings.HasPrefix(trimmed, "$$") && !(len(trimmed) > 4 && strings.HasSuffix(trimmed, "$$")) {
+			end := -1
+			for j := i + 1; j < len(lines); j++ {
+				if strings.HasSuffix(strings.TrimSpace(lines[j]), "$$") {
+					end = j
+					break
+				}
+			}
+			if end != -1 {
+				block := strings.Join(lines[i:end+1], "\n")
+				tex := strings.TrimSuffix(strings.TrimPrefix(strings.TrimSpace(block), "$$"), "$$")
+				if err := validateTeX(tex); err != nil {
+					// Validation errors quote the formula, so they count as deck content
+					logging.Content(ctx, "Invalid display formula, rendering as code", "error", err.Error())
+					invalid++
+					out = append(out, "```tex", strings.TrimSpace(tex), "```")
+				} else {
+					out = append(out, lines[i:end+1]...)
+				}
+				i = end
+				continue
+			}
+		}
+
+		out = append(out, replaceInlineMath(line, func(tex string, display bool) string {
+			if err := validateTeX(tex); err != nil {
+				logging.Content(ctx, "Invalid formula, rendering as code", "error", err.Error())
+				invalid++
+				return "`" + strings.ReplaceAll(tex, "`", "'") + "`"
+			}
+			if display {
+				return "$$" + tex + "$$"
+			}
+			return "$" + tex + "$"
+		}))
+	}
+
+	if invalid > 0 {
+		slog.InfoContext(ctx, "Replaced invalid formulas with code", "formulas", invalid)
+	}
+	return strings.Join(out, "\n")
+}
+
+// replaceInlineMath calls fn for each $...$ or $$...$$ span on a line, skipping inline code.
+// Like Pandoc, an opening $ must not be followed by a space and a closing $ must not be preceded
+// by one or followed by a digit, so prices such as "$5 and $10" are left alone.
+func replaceInlineMath(line string, fn func(tex string, display bool) string) string {
+	var sb strings.Builder
+	for i := 0; i < len(line); i++ {
+		ch := line[i]
+
+		switch {
+		case ch == '\\' && i+1 < len(line):
+			sb.WriteString(line[i : i+2])
+			i++
+		case ch == '`':
+			// Copy inline code spans verbatim
+			end := strings.IndexByte(line[i+1:], '`')
+			if end == -1 {
+				sb.WriteString(line[i:])
+				return sb.String()
+			}
+			sb.WriteString(line[i : i+end+2])
+			i += end + 1
+		case strings.HasPrefix(line[i:], "$$"):
+			end := strings.Index(line[i+2:], "$$")
+			if end <= 0 {
+				sb.WriteString("$$")
+				i++
+				continue
+			}
+			sb.WriteString(fn(line[i+2:i+2+end], true))
+			i += end + 3
+		case ch == '$':
+			end := closingDollar(line, i)
+			if end == -1 {
+				sb.WriteByte(ch)
+				continue
+			}
+			sb.WriteString(fn(line[i+1:end], false))
+			i = end
+		default:
+			sb.WriteByte(ch)
+		}
+	}
+	return sb.String()
+}
+
+// closingDollar returns the index of the $ closing the inline formula opened at start, or -1
+func closingDollar(line string, start int) int {
+	if start+1 >= len(line) || line[start+1] == ' ' || line[start+1] == '$' {
+		return -1
+	}
+	for j := start + 1; j < len(line); j++ {
+		switch line[j] {
+		case '\\':
+			j++
+		case '$':
+			if line[j-1] == ' ' {
+				return -1
+			}
+			if j+1 < len(line) && line[j+1] >= '0' && line[j+1] <= '9' {
+				return -1
+			}
+			return j
+		}
+	}
+	return -1
+}
+
+// validateTeX performs structural checks that catch the formulas KaTeX and MathJax reject most often
+func validateTeX(tex string) error {
+	if strings.TrimSpace(tex) == "" {
+		return fmt.Errorf("empty formula")
+	}
+
+	// Balanced braces, ignoring escaped \{ and \}
+	depth := 0
+	for i := 0; i < len(tex); i++ {
+		switch tex[i] {
+		case '\\':
+			i++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth < 0 {
+				return fmt.Errorf("unbalanced braces in %q", tex)
+			}
+		}
+	}
+	if depth != 0 {
+		return fmt.Errorf("unbalanced braces in %q", tex)
+	}
+
+	// Matching \begin{...} and \end{...}
+	stack := make([]string, 0)
+	for _, match := range texEnvironment.FindAllStringSubmatch(tex, -1) {
+		if match[1] == "begin" {
+			stack = append(stack, match[2])
+			continue
+		}
+		if len(stack) == 0 || stack[len(stack)-1] != match[2] {
+			return fmt.Errorf("unmatched \\end{%s} in %q", match[2], tex)
+		}
+		stack = stack[:len(stack)-1]
+	}
+	if len(stack) > 0 {
+		return fmt.Errorf("unclosed \\begin{%s} in %q", stack[len(stack)-1], tex)
+	}
+
+	// Every \left needs a \right
+	if len(texLeft.FindAllStringIndex(tex, -1)) != len(texRight.FindAllStringIndex(tex, -1)) {
+		return fmt.Errorf("unmatched \\left/\\right in %q", tex)
+	}
+
+	for _, command := range unsupportedTeXCommands {
+		if strings.Contains(tex, command) {
+			return fmt.Errorf("unsupported command %s in %q", command, tex)
+		}
+	}
+
+	return nil
+}
+
+// setFrontmatterDirective sets a global directive in the deck's YAML front-matter, adding the
+// front-matter if the deck has none
+func setFrontmatterDirective(markdown, key, value string) string {
+	directive := key + ": " + value
+	lines := strings.Split(markdown, "\n")
+	if len(lines) == 0 || strings.TrimSpace(lines[0]) != "---" {
+		return "---\n" + directive + "\n---\n\n" + markdown
+	}
+
+	for i := 1; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if trimmed == "---" {
+			// Directive not present, insert it before the closing fence
+			lines = append(lines[:i], append([]string{directive}, lines[i:]...)...)
+			return strings.Join(lines, "\n")
+		}
+		if strings.HasPrefix(trimmed, key+":") {
+			lines[i] = directive
+			return strings.Join(lines, "\n")
+		}
+	}
+
+	// Unterminated front-matter, leave it alone rather than guess
+	return markdown
+}
@@ -0,0 +1,204 @@
+package slides
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/martin226/slideitin/backend/slides-service/services/telemetry"
+)
+
+// Pool defaults
+const (
+	defaultGeminiConcurrency = 4
+	defaultRenderConcurrency = 2
+	defaultQueueSize         = 32
+)
+
+// ErrBusy is returned when a job can't even wait for a worker because the queue is full
+var ErrBusy = errors.New("too many jobs waiting, try again later")
+
+// Pool bounds how many jobs call Gemini and how many Marp renders run at once. Jobs over the
+// limits wait in FIFO order, and jobs arriving while the Gemini queue is full are refused.
+type Pool struct {
+	gemini *limiter
+	render *limiter
+}
+
+// NewPool creates a pool configured by SLIDES_GEMINI_CONCURRENCY, SLIDES_RENDER_CONCURRENCY and
+// SLIDES_QUEUE_SIZE
+func NewPool() (*Pool, error) {
+	geminiConcurrency, err := positiveIntEnv("SLIDES_GEMINI_CONCURRENCY", defaultGeminiConcurrency)
+	if err != nil {
+		return nil, err
+	}
+	renderConcurrency, err := positiveIntEnv("SLIDES_RENDER_CONCURRENCY", defaultRenderConcurrency)
+	if err != nil {
+		return nil, err
+	}
+	queueSize, err := positiveIntEnv("SLIDES_QUEUE_SIZE", defaultQueueSize)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pool{
+		gemini: newLimiter("gemini", geminiConcurrency, queueSize),
+		// Jobs waiting to render have already been admitted, so their queue isn't bounded
+		render: newLimiter("render", renderConcurrency, 0),
+	}, nil
+}
+
+// positiveIntEnv reads a positive integer from an environment variable, returning fallback if unset
+func positiveIntEnv(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil || parsed <= 0 {
+		return 0, fmt.Errorf("invalid %s: %q", name, value)
+	}
+	return parsed, nil
+}
+
+// limiter is a semaphore that hands free slots to waiters in arrival order and tells each waiter
+// its position in the queue as it moves
+type limiter struct {
+	name       string
+	size       int
+	maxWaiting int // 0 means unbounded
+
+	mu      sync.Mutex
+	running int
+	waiting []*waiter
+}
+
+// waiter is a caller waiting for a slot
+type waiter struct {
+	ready chan struct{} // Closed once the waiter has been handed a slot
+	moved chan struct{} // Signaled when the waiter moves up the queue
+}
+
+// newLimiter creates a limiter with size slots that lets at most maxWaiting callers wait
+func newLimiter(name string, size, maxWaiting int) *limiter {
+	return &limiter{name: name, size: size, maxWaiting: maxWaiting}
+}
+
+// acquire takes a slot, waiting for one if all are busy. onWait, if set, is called with the
+// caller's 1-based position whenever it starts waiting or moves up the queue. It returns
+// ErrBusy without waiting if the queue is full, and ctx's error if ctx is done first. The
+// returned function releases the slot and may be called more than once.
+func (l *limiter) acquire(ctx context.Context, onWait func(position int)) (release func(), err error) {
+	l.mu.Lock()
+	if l.running < l.size && len(l.waiting) == 0 {
+		l.running++
+		l.updateMetrics()
+		l.mu.Unlock()
+		return l.releaseFunc(), nil
+	}
+	if l.maxWaiting > 0 && len(l.waiting) >= l.maxWaiting {
+		l.mu.Unlock()
+		return nil, ErrBusy
+	}
+	w := &waiter{ready: make(chan struct{}), moved: make(chan struct{}, 1)}
+	l.waiting = append(l.waiting, w)
+	position := len(l.waiting)
+	l.updateMetrics()
+	l.mu.Unlock()
+
+	for {
+		if onWait != nil && position > 0 {
+			onWait(position)
+		}
+		select {
+		case <-w.ready:
+			return l.releaseFunc(), nil
+		case <-w.moved:
+			position = l.position(w)
+		case <-ctx.Done():
+			l.mu.Lock()
+			if i := l.index(w); i >= 0 {
+				l.remove(i)
+				l.mu.Unlock()
+				return nil, ctx.Err()
+			}
+			l.mu.Unlock()
+			// The slot was handed over just as ctx finished, so pass it on
+			l.releaseFunc()()
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// tryAcquire takes a slot only if one is free right away, for work that is better skipped than
+// delayed. ok is false if every slot is busy or callers are already waiting.
+func (l *limiter) tryAcquire() (release func(), ok bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.running >= l.size || len(l.waiting) > 0 {
+		return nil, false
+	}
+	l.running++
+	l.updateMetrics()
+	return l.releaseFunc(), true
+}
+
+// releaseFunc returns a function that releases one slot, once
+func (l *limiter) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(l.release)
+	}
+}
+
+// release hands the slot to the first waiter, or frees it if nobody is waiting
+func (l *limiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.waiting) == 0 {
+		l.running--
+		l.updateMetrics()
+		return
+	}
+	next := l.waiting[0]
+	l.remove(0)
+	close(next.ready)
+}
+
+// remove drops the i-th waiter and tells the ones behind it that they moved up. l.mu must be held.
+func (l *limiter) remove(i int) {
+	l.waiting = append(l.waiting[:i], l.waiting[i+1:]...)
+	for _, behind := range l.waiting[i:] {
+		select {
+		case behind.moved <- struct{}{}:
+		default: // Already signaled
+		}
+	}
+	l.updateMetrics()
+}
+
+// index returns a waiter's index in the queue, or -1 if it isn't waiting. l.mu must be held.
+func (l *limiter) index(w *waiter) int {
+	for i, queued := range l.waiting {
+		if queued == w {
+			return i
+		}
+	}
+	return -1
+}
+
+// position returns a waiter's 1-based position in the queue, or 0 if it isn't waiting anymore
+func (l *limiter) position(w *waiter) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.index(w) + 1
+}
+
+// updateMetrics publishes the limiter's state. l.mu must be held.
+func (l *limiter) updateMetrics() {
+	telemetry.PoolRunning.WithLabelValues(l.name).Set(float64(l.running))
+	telemetry.PoolWaiting.WithLabelValues(l.name).Set(float64(len(l.waiting)))
+}
@@ -0,0 +1,228 @@
+package slides
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"strings"
+
+	"github.com/martin226/slideitin/backend/slides-service/models"
+	"github.com/martin226/slideitin/backend/slides-service/services/telemetry"
+)
+
+// Limits for slide previews. Each preview is kept in the job's event log and replayed to every
+// stream that resumes from before it, so previews are kept small and larger ones are left out.
+const (
+	maxPreviewSlides     = 50
+	maxPreviewImageBytes = 16 << 10 // Larger images are left out of previews
+	maxPreviewHTMLBytes  = 48 << 10
+)
+
+// expectedSlides is a rough deck size for each detail level, only used to estimate progress
+// while the model is still generating
+var expectedSlides = map[string]int{
+	"minimal":  8,
+	"medium":   12,
+	"detailed": 16,
+}
+
+// completedSlides splits streamed model output into the deck's front-matter and the slides that
+// are known to be complete, i.e. followed by a --- separator. The trailing partial line and the
+// slide still being written are left out.
+func completedSlides(text string) (string, []string) {
+	lines := strings.Split(text, "\n")
+	lines = lines[:len(lines)-1]
+
+	// Skip the opening fence the model wraps the deck in, if it comes before the front-matter
+	start := 0
+	for i, line := range lines {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "---" {
+			break
+		}
+		if strings.HasPrefix(trimmed, "```") {
+			start = i + 1
+			break
+		}
+	}
+	for start < len(lines) && strings.TrimSpace(lines[start]) == "" {
+		start++
+	}
+
+	// The front-matter runs from the first --- to the next one
+	if start >= len(lines) || strings.TrimSpace(lines[start]) != "---" {
+		return "", nil
+	}
+	frontmatterEnd := -1
+	for i := start + 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == "---" {
+			frontmatterEnd = i
+			break
+		}
+	}
+	if frontmatterEnd == -1 {
+		return "", nil
+	}
+	frontmatter := strings.Join(lines[start:frontmatterEnd+1], "\n")
+
+	// Split the rest on --- separators, ignoring any inside code blocks
+	slides := make([]string, 0)
+	slideStart := frontmatterEnd + 1
+	inFence := false
+	for i := slideStart; i < len(lines); i++ {
+		trimmed := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(trimmed, "```") {
+			inFence = !inFence
+			continue
+		}
+		if trimmed == "---" && !inFence {
+			slides = append(slides, strings.Join(lines[slideStart:i], "\n"))
+			slideStart = i + 1
+		}
+	}
+
+	return frontmatter, slides
+}
+
+// previewSlide is a completed slide waiting to be rendered
+type previewSlide struct {
+	index       int
+	frontmatter string
+	markdown    string
+}
+
+// slidePreviewer renders completed slides one at a time in the background while the model keeps
+// generating, and reports each one with the job's progress
+type slidePreviewer struct {
+	ctx      context.Context
+	theme    string
+	settings models.SlideSettings
+	images   []models.Image
+	expected int
+	progress *ProgressTracker
+	render   *limiter
+	renderer *Renderer
+
+	queue chan previewSlide
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+// newSlidePreviewer starts a previewer for a deck using theme and the images available to it.
+// Previews share the render limiter and renderer with full renders.
+func newSlidePreviewer(ctx context.Context, theme string, settings models.SlideSettings, images []models.Image, progress *ProgressTracker, render *limiter, renderer *Renderer) *slidePreviewer {
+	expected, ok := expectedSlides[settings.SlideDetail]
+	if !ok {
+		expected = expectedSlides["medium"]
+	}
+
+	p := &slidePreviewer{
+		ctx:      ctx,
+		theme:    theme,
+		settings: settings,
+		images:   images,
+		expected: expected,
+		progress: progress,
+		render:   render,
+		renderer: renderer,
+		queue:    make(chan previewSlide, maxPreviewSlides),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go p.run()
+	return p
+}
+
+// add queues a completed slide for rendering without blocking generation
+func (p *slidePreviewer) add(index int, frontmatter, markdown string) {
+	select {
+	case p.queue <- previewSlide{index: index, frontmatter: frontmatter, markdown: markdown}:
+	default:
+		slog.WarnContext(p.ctx, "Preview queue full, skipping slide", "slide", index)
+	}
+}
+
+// finish drops slides that haven't been rendered yet and waits for the one in progress. The full
+// render follows straight after, so late previews would only arrive after the real deck.
+func (p *slidePreviewer) finish() {
+	close(p.stop)
+	<-p.done
+}
+
+// run renders queued slides until finish is called
+func (p *slidePreviewer) run() {
+	defer close(p.done)
+	for {
+		// Check for stop first so queued slides aren't rendered after generation has finished
+		select {
+		case <-p.stop:
+			return
+		default:
+		}
+
+		select {
+		case <-p.stop:
+			return
+		case slide := <-p.queue:
+			var preview *models.SlidePreview
+			if strings.TrimSpace(slide.markdown) != "" {
+				preview = p.renderPreview(slide)
+			}
+			// Report the slide even without a preview so progress keeps moving
+			if err := p.progress.ReportSlide(slide.index, p.expected, preview); err != nil {
+				slog.ErrorContext(p.ctx, "Failed to publish slide preview", "slide", slide.index, "error", err)
+			}
+		}
+	}
+}
+
+// renderPreview renders a slide's preview if a renderer is free; previews are skipped rather than
+// delaying full renders
+func (p *slidePreviewer) renderPreview(slide previewSlide) *models.SlidePreview {
+	release, ok := p.render.tryAcquire()
+	if !ok {
+		slog.DebugContext(p.ctx, "All renderers busy, skipping slide preview", "slide", slide.index)
+		return nil
+	}
+	defer release()
+
+	html, err := renderSlidePreview(p.ctx, p.renderer, p.theme, p.settings, p.images, slide.frontmatter, slide.markdown)
+	if err != nil {
+		slog.WarnContext(p.ctx, "Failed to render slide preview", "slide", slide.index, "error", err)
+		return nil
+	}
+	return &models.SlidePreview{Index: slide.index, HTML: html}
+}
+
+// renderSlidePreview renders a single slide to standalone HTML, inlining the images it uses
+func renderSlidePreview(ctx context.Context, renderer *Renderer, theme string, settings models.SlideSettings, images []models.Image, frontmatter, slide string) (html string, err error) {
+	ctx, span := telemetry.StartSpan(ctx, "marp.RenderPreview")
+	defer func() { telemetry.EndSpan(span, err) }()
+
+	markdown, diagrams := renderDiagrams(ctx, frontmatter+"\n\n"+slide)
+	if settings.Math && settings.Audience == "academic" {
+		markdown = prepareMath(ctx, markdown)
+	}
+	markdown, _ = resolveImageReferences(markdown, append(images, diagrams...), func(img models.Image) string {
+		if len(img.Data) > maxPreviewImageBytes {
+			return ""
+		}
+		return "data:" + img.ContentType + ";base64," + base64.StdEncoding.EncodeToString(img.Data)
+	})
+
+	// A bare page leaves out the slideshow viewer, which a single slide doesn't need
+	rendered, err := renderer.render(ctx, "rendering the preview", renderRequest{
+		Markdown: markdown,
+		Theme:    marpTheme(theme),
+		HTML:     true,
+		Bare:     true,
+	})
+	if err != nil {
+		return "", err
+	}
+	if len(rendered.HTML) > maxPreviewHTMLBytes {
+		return "", errors.New("preview is too large")
+	}
+	return rendered.HTML, nil
+}
@@ -0,0 +1,72 @@
+package slides
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestCompletedSlides(t *testing.T) {
+	const frontmatter = "---\nmarp: true\n---"
+
+	tests := []struct {
+		name            string
+		text            string
+		wantFrontmatter string
+		wantSlides      []string
+	}{
+		{
+			name: "empty",
+			text: "",
+		},
+		{
+			name: "front-matter still being written",
+			text: "---\nmarp: true\n",
+		},
+		{
+			name:            "first slide still being written",
+			text:            frontmatter + "\n# One\n",
+			wantFrontmatter: frontmatter,
+			wantSlides:      []string{},
+		},
+		{
+			name:            "completed slides",
+			text:            frontmatter + "\n# One\n---\n# Two\n---\n# Three\n",
+			wantFrontmatter: frontmatter,
+			wantSlides:      []string{"# One", "# Two"},
+		},
+		{
+			name:            "partial separator line",
+			text:            frontmatter + "\n# One\n--",
+			wantFrontmatter: frontmatter,
+			wantSlides:      []string{},
+		},
+		{
+			name:            "opening fence",
+			text:            "```markdown\n" + frontmatter + "\n# One\n---\n",
+			wantFrontmatter: frontmatter,
+			wantSlides:      []string{"# One"},
+		},
+		{
+			name:            "separator inside a code block",
+			text:            frontmatter + "\n```yaml\n---\n```\n---\n# Two\n",
+			wantFrontmatter: frontmatter,
+			wantSlides:      []string{"```yaml\n---\n```"},
+		},
+		{
+			name: "text before the front-matter",
+			text: "Here is your deck\n" + frontmatter + "\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotFrontmatter, gotSlides := completedSlides(tt.text)
+			if gotFrontmatter != tt.wantFrontmatter {
+				t.Errorf("completedSlides() front-matter = %q, want %q", gotFrontmatter, tt.wantFrontmatter)
+			}
+			if !slices.Equal(gotSlides, tt.wantSlides) {
+				t.Errorf("completedSlides() slides = %q, want %q", gotSlides, tt.wantSlides)
+			}
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package slides
+
+import (
+	"log/slog"
+	"os"
+	"strconv"
+)
+
+// Default gemini-2.0-flash prices in USD per million tokens
+const (
+	defaultInputPricePerMTok  = 0.10
+	defaultOutputPricePerMTok = 0.40
+)
+
+// modelPricing holds the per-token prices used to estimate the cost of a job
+type modelPricing struct {
+	inputPerMTok  float64
+	outputPerMTok float64
+}
+
+// loadPricing reads GEMINI_INPUT_PRICE_PER_MTOK and GEMINI_OUTPUT_PRICE_PER_MTOK, falling back to
+// the list prices of the default model
+func loadPricing() modelPricing {
+	return modelPricing{
+		inputPerMTok:  priceFromEnv("GEMINI_INPUT_PRICE_PER_MTOK", defaultInputPricePerMTok),
+		outputPerMTok: priceFromEnv("GEMINI_OUTPUT_PRICE_PER_MTOK", defaultOutputPricePerMTok),
+	}
+}
+
+// priceFromEnv parses a non-negative price from an environment variable
+func priceFromEnv(name string, fallback float64) float64 {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback
+	}
+	price, err := strconv.ParseFloat(value, 64)
+	if err != nil || price < 0 {
+		slog.Warn("Invalid price, using default", "variable", name, "value", value, "default", fallback)
+		return fallback
+	}
+	return price
+}
+
+// cost estimates the USD cost of a call with the given token counts
+func (p modelPricing) cost(inputTokens, outputTokens int32) float64 {
+	return (float64(inputTokens)*p.inputPerMTok + float64(outputTokens)*p.outputPerMTok) / 1e6
+}
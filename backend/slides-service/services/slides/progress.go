@@ -0,0 +1,123 @@
+package slides
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/martin226/slideitin/backend/slides-service/models"
+)
+
+// ProgressFunc receives a human-readable status message together with structured progress and,
+// while the model is generating, the preview of a slide that has just been completed
+type ProgressFunc func(message string, progress models.JobProgress, preview *models.SlidePreview) error
+
+// stagePercents is the percentage at which each stage starts. The ranges reflect typical run
+// times: generation dominates, followed by rendering the PDF and HTML decks.
+var stagePercents = map[models.ProgressStage]int{
+	models.StageQueued:       0,
+	models.StageStarting:     2,
+	models.StageUploading:    5,
+	models.StageExtracting:   20,
+	models.StagePrompting:    25,
+	models.StageGenerating:   30,
+	models.StageRenderingPDF: 75,
+	models.StageStoring:      97,
+	models.StageCompleted:    100,
+}
+
+// stageOrder lists the stages so a stage's range can end where the next one starts
+var stageOrder = []models.ProgressStage{
+	models.StageQueued,
+	models.StageStarting,
+	models.StageUploading,
+	models.StageExtracting,
+	models.StagePrompting,
+	models.StageGenerating,
+	models.StageRenderingPDF,
+	models.StageStoring,
+	models.StageCompleted,
+}
+
+// minETAPercent is how far a job must be before its elapsed time says anything about the rest
+const minETAPercent = 5
+
+// stagePercent returns the percentage reached once done of a stage's total items are finished
+func stagePercent(stage models.ProgressStage, done, total int) int {
+	start := stagePercents[stage]
+	if total <= 0 || done <= 0 {
+		return start
+	}
+	if done > total {
+		done = total
+	}
+	end := start
+	for i, s := range stageOrder {
+		if s == stage && i+1 < len(stageOrder) {
+			end = stagePercents[stageOrder[i+1]]
+			break
+		}
+	}
+	return start + (end-start)*done/total
+}
+
+// ProgressTracker turns stage transitions into structured progress with an ETA based on the
+// time elapsed since the job started
+type ProgressTracker struct {
+	start     time.Time
+	fileCount int
+	update    ProgressFunc
+}
+
+// NewProgressTracker creates a tracker for a job over fileCount files that started at start
+func NewProgressTracker(start time.Time, fileCount int, update ProgressFunc) *ProgressTracker {
+	return &ProgressTracker{
+		start:     start,
+		fileCount: fileCount,
+		update:    update,
+	}
+}
+
+// Report sends a stage transition. fileIndex is the 1-based file being processed, or 0 when the
+// stage isn't working on a particular file.
+func (t *ProgressTracker) Report(stage models.ProgressStage, fileIndex int, message string) error {
+	percent := stagePercents[stage]
+	if fileIndex > 0 {
+		percent = stagePercent(stage, fileIndex-1, t.fileCount)
+	}
+	return t.update(message, t.progress(stage, percent, fileIndex), nil)
+}
+
+// ReportQueued sends the 1-based position of a job waiting for a worker before it can start stage
+func (t *ProgressTracker) ReportQueued(stage models.ProgressStage, position int, message string) error {
+	progress := t.progress(stage, stagePercents[stage], 0)
+	progress.QueuePosition = position
+	return t.update(message, progress, nil)
+}
+
+// ReportSlide sends progress for the index-th generated slide out of about expected slides,
+// along with its preview if one was rendered
+func (t *ProgressTracker) ReportSlide(index, expected int, preview *models.SlidePreview) error {
+	// The deck may run longer than expected, so hold below the end of the stage until it's done
+	done := index
+	if done >= expected {
+		done = expected - 1
+	}
+	percent := stagePercent(models.StageGenerating, done, expected)
+	return t.update(fmt.Sprintf("Generated slide %d", index), t.progress(models.StageGenerating, percent, 0), preview)
+}
+
+// progress builds the progress for a stage at percent, estimating the remaining time
+func (t *ProgressTracker) progress(stage models.ProgressStage, percent, fileIndex int) models.JobProgress {
+	progress := models.JobProgress{
+		Stage:     stage,
+		Percent:   percent,
+		FileIndex: fileIndex,
+		FileCount: t.fileCount,
+	}
+	if percent >= minETAPercent && percent < 100 {
+		elapsed := time.Since(t.start)
+		remaining := time.Duration(float64(elapsed) * float64(100-percent) / float64(percent))
+		progress.ETASeconds = int64(remaining.Round(time.Second).Seconds())
+	}
+	return progress
+}
@@ -0,0 +1,370 @@
+package slides
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// Renderer defaults
+const (
+	defaultRendererScript  = "renderer/server.js"
+	defaultRenderTimeout   = 60 * time.Second
+	rendererStartTimeout   = 30 * time.Second
+	rendererHealthTimeout  = 2 * time.Second
+	rendererMaxRestartWait = 30 * time.Second
+	// How long the processes of a killed render server get to exit before they're reported as leaked
+	rendererKillTimeout = 2 * time.Second
+)
+
+// Renderer runs the Marp render server, a long-lived Node process that renders decks with Marp Core
+// and keeps Chromium open between renders, and restarts it whenever it exits
+type Renderer struct {
+	script  string
+	socket  string
+	timeout time.Duration
+	client  *http.Client
+
+	mu      sync.Mutex
+	cmd     *exec.Cmd
+	ready   chan struct{} // Closed while the current process accepts requests
+	closing bool
+	done    chan struct{}
+	killed  []int // Process groups killed by restart, checked for survivors once the server exits
+
+	// Read by the watchdog to tell how many renders the server's CPU time was spent on
+	active    atomic.Int64 // Renders in progress
+	started   atomic.Int64 // Renders started since the service started
+	overLimit atomic.Bool  // Set when the watchdog killed the server, until it's started again
+}
+
+// renderRequest is a deck to render; see renderer/server.js
+type renderRequest struct {
+	Markdown  string `json:"markdown"`
+	Theme     string `json:"theme"`         // Built-in theme name or path of a theme CSS file
+	Dir       string `json:"dir,omitempty"` // Local images are resolved against it and the PDF is written to it
+	HTML      bool   `json:"html"`
+	PDF       bool   `json:"pdf"`
+	Bare      bool   `json:"bare,omitempty"` // Leave the slideshow viewer out of the HTML
+	TimeoutMs int64  `json:"timeoutMs"`
+}
+
+// renderResponse is the outcome of a render
+type renderResponse struct {
+	HTML    string `json:"html"`
+	HTMLMs  int64  `json:"htmlMs"`
+	PDFPath string `json:"pdfPath"`
+	PDFMs   int64  `json:"pdfMs"`
+	Error   string `json:"error"`
+	Kind    string `json:"kind"` // Why a render failed: invalid, timeout or crash
+}
+
+// renderErrorKinds maps the render server's failure kinds to render errors
+var renderErrorKinds = map[string]error{
+	"invalid": ErrInvalidMarkdown,
+	"timeout": ErrRenderTimeout,
+	"crash":   ErrRenderCrashed,
+}
+
+// NewRenderer creates a renderer configured by MARP_RENDERER_SCRIPT and MARP_RENDER_TIMEOUT. It
+// doesn't run until Start is called.
+func NewRenderer() (*Renderer, error) {
+	script := os.Getenv("MARP_RENDERER_SCRIPT")
+	if script == "" {
+		script = defaultRendererScript
+	}
+	if _, err := os.Stat(script); err != nil {
+		return nil, fmt.Errorf("invalid MARP_RENDERER_SCRIPT: %v", err)
+	}
+
+	timeout := defaultRenderTimeout
+	if value := os.Getenv("MARP_RENDER_TIMEOUT"); value != "" {
+		parsed, err := time.ParseDuration(value)
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("invalid MARP_RENDER_TIMEOUT: %q", value)
+		}
+		timeout = parsed
+	}
+
+	socket := filepath.Join(os.TempDir(), fmt.Sprintf("slideitin-marp-%d.sock", os.Getpid()))
+	return &Renderer{
+		script:  script,
+		socket:  socket,
+		timeout: timeout,
+		client: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "unix", socket)
+				},
+			},
+		},
+		ready: make(chan struct{}),
+		done:  make(chan struct{}),
+	}, nil
+}
+
+// Start runs the render server in the background, restarting it with a growing delay whenever it
+// exits until Close is called
+func (r *Renderer) Start() {
+	go func() {
+		defer close(r.done)
+		wait := time.Second
+		for {
+			started := time.Now()
+			err := r.run()
+			if r.isClosing() {
+				return
+			}
+
+			// Only back off while the server keeps failing straight away
+			if time.Since(started) > time.Minute {
+				wait = time.Second
+			}
+			slog.Error("Marp renderer exited, restarting", "error", err, "restart_in", wait)
+			time.Sleep(wait)
+			wait = min(wait*2, rendererMaxRestartWait)
+		}
+	}()
+}
+
+// run starts the render server and waits for it to exit. It runs in its own process group under
+// the per-process subprocess memory limit, and the server launches Chromium in the same group, so
+// Chromium inherits the limit and the watchdog enforcing the subprocess limits on the whole group
+// counts it.
+func (r *Renderer) run() error {
+	cmd := command(context.Background(), false, "node", r.script, r.socket)
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("failed to start renderer: %v", err)
+	}
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	r.mu.Lock()
+	r.cmd = cmd
+	closing := r.closing
+	r.mu.Unlock()
+	if closing {
+		r.restart()
+		err := <-exited
+		r.reap(cmd.Process.Pid)
+		return err
+	}
+
+	if err := r.waitStarted(exited); err != nil {
+		r.restart()
+		<-exited
+		r.reap(cmd.Process.Pid)
+		return err
+	}
+	slog.Info("Marp renderer started", "pid", cmd.Process.Pid)
+
+	stopWatch := make(chan struct{})
+	defer close(stopWatch)
+	r.overLimit.Store(false)
+	go r.watch(cmd.Process.Pid, stopWatch)
+
+	r.mu.Lock()
+	close(r.ready)
+	r.mu.Unlock()
+
+	err := <-exited
+
+	r.mu.Lock()
+	r.ready = make(chan struct{})
+	r.cmd = nil
+	r.mu.Unlock()
+	r.reap(cmd.Process.Pid)
+	return err
+}
+
+// reap kills whatever the exited render server with process group pgid left behind, such as a
+// Chromium it didn't get to close, and logs any process that survives being killed
+func (r *Renderer) reap(pgid int) {
+	r.mu.Lock()
+	groups := append(r.killed, killProcessTree(pgid)...)
+	r.killed = nil
+	r.mu.Unlock()
+
+	if pids := survivors(groups, rendererKillTimeout); len(pids) > 0 {
+		slog.Error("Marp renderer processes survived being killed", "pids", pids)
+	}
+}
+
+// waitStarted polls the render server until it's healthy, it exits or rendererStartTimeout passes
+func (r *Renderer) waitStarted(exited <-chan error) error {
+	deadline := time.Now().Add(rendererStartTimeout)
+	for {
+		if err := r.health(context.Background()); err == nil {
+			return nil
+		} else if time.Now().After(deadline) {
+			return fmt.Errorf("renderer didn't become healthy within %s: %v", rendererStartTimeout, err)
+		}
+		select {
+		case err := <-exited:
+			return fmt.Errorf("renderer exited while starting: %v", err)
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+// isClosing reports whether Close has been called
+func (r *Renderer) isClosing() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.closing
+}
+
+// readyChan returns a channel that is closed while the render server accepts requests
+func (r *Renderer) readyChan() <-chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.ready
+}
+
+// restart kills the render server and its Chromium so they're started again, for when they stop
+// responding. Chromium is killed by its own process group too, in case it was launched detached.
+func (r *Renderer) restart() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cmd != nil {
+		r.killed = append(r.killed, killProcessTree(r.cmd.Process.Pid)...)
+	}
+}
+
+// Close stops the render server and waits for it to exit, killing it if it doesn't
+func (r *Renderer) Close() {
+	r.mu.Lock()
+	r.closing = true
+	if r.cmd != nil {
+		// The server closes Chromium before exiting
+		r.cmd.Process.Signal(syscall.SIGTERM)
+	}
+	r.mu.Unlock()
+
+	select {
+	case <-r.done:
+	case <-time.After(5 * time.Second):
+		r.restart()
+		// Wait for whatever it left behind to be reaped
+		select {
+		case <-r.done:
+		case <-time.After(2 * rendererKillTimeout):
+		}
+	}
+	os.Remove(r.socket)
+}
+
+// health asks the render server whether it can launch Chromium
+func (r *Renderer) health(ctx context.Context) error {
+	ctx, cancel := context.WithTimeout(ctx, rendererHealthTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://marp/healthz", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var body renderResponse
+		json.NewDecoder(resp.Body).Decode(&body)
+		return fmt.Errorf("renderer is unhealthy: %s", body.Error)
+	}
+	return nil
+}
+
+// Check checks that the render server is running and can launch Chromium
+func (r *Renderer) Check(ctx context.Context) error {
+	select {
+	case <-r.readyChan():
+	default:
+		return errors.New("marp renderer is not running")
+	}
+	return r.health(ctx)
+}
+
+// render renders a deck, waiting for the render server if it's restarting. The deadline is the
+// render timeout or ctx's, whichever comes first, and a render that misses it restarts the server
+// if it has stopped responding. Failures are returned as a RenderError for op unless ctx was
+// canceled.
+func (r *Renderer) render(ctx context.Context, op string, req renderRequest) (*renderResponse, error) {
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, r.timeout)
+	defer cancel()
+	req.TimeoutMs = r.timeout.Milliseconds()
+	if deadline, ok := ctx.Deadline(); ok {
+		req.TimeoutMs = time.Until(deadline).Milliseconds()
+	}
+
+	select {
+	case <-r.readyChan():
+	case <-ctx.Done():
+		if parent.Err() != nil {
+			return nil, fmt.Errorf("%s: %w", op, parent.Err())
+		}
+		return nil, &RenderError{Op: op, Kind: ErrRenderTimeout, Detail: "the renderer didn't restart in time"}
+	}
+
+	body, err := json.Marshal(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal render request: %v", err)
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://marp/render", bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create render request: %v", err)
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+
+	r.started.Add(1)
+	r.active.Add(1)
+	resp, err := r.client.Do(httpReq)
+	r.active.Add(-1)
+	if err != nil {
+		switch {
+		case parent.Err() != nil:
+			return nil, fmt.Errorf("%s: %w", op, parent.Err())
+		case errors.Is(ctx.Err(), context.DeadlineExceeded):
+			if err := r.health(context.Background()); err != nil {
+				slog.WarnContext(ctx, "Marp renderer stopped responding, restarting it", "error", err)
+				r.restart()
+			}
+			return nil, &RenderError{Op: op, Kind: ErrRenderTimeout, Detail: "after " + r.timeout.String()}
+		}
+		// The connection dropped, so the server died mid-render; it's restarted in the background
+		if r.overLimit.Load() {
+			return nil, &RenderError{Op: op, Kind: ErrRenderCrashed, Detail: "the renderer went over its memory or CPU limit"}
+		}
+		return nil, &RenderError{Op: op, Kind: ErrRenderCrashed}
+	}
+	defer resp.Body.Close()
+
+	var result renderResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, &RenderError{Op: op, Kind: ErrRenderCrashed, Detail: "unreadable response"}
+	}
+	if resp.StatusCode != http.StatusOK {
+		kind, ok := renderErrorKinds[result.Kind]
+		if !ok {
+			kind = ErrRenderCrashed
+		}
+		return nil, &RenderError{Op: op, Kind: kind, Detail: errorDetail(result.Error)}
+	}
+	return &result, nil
+}
@@ -3,93 +3,162 @@ package slides
 import (
 	"context"
 	"errors"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
-	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strings"
-	
+
+	"bytes"
 	"github.com/google/generative-ai-go/genai"
-	"google.golang.org/api/option"
 	"github.com/martin226/slideitin/backend/slides-service/models"
+	"github.com/martin226/slideitin/backend/slides-service/services/logging"
 	"github.com/martin226/slideitin/backend/slides-service/services/prompts"
-	"bytes"
+	"github.com/martin226/slideitin/backend/slides-service/services/telemetry"
+	"go.opentelemetry.io/otel/attribute"
+	"google.golang.org/api/iterator"
+	"google.golang.org/api/option"
 	"time" // Added for context timeout
 )
 
 // SlideService handles interactions with the Gemini API
 type SlideService struct {
-	client *genai.Client
-	model *genai.GenerativeModel
+	client    *genai.Client
+	model     *genai.GenerativeModel
+	modelName string
+	pricing   modelPricing
+	pool      *Pool
+	renderer  *Renderer
 }
 
-// NewSlideService creates a new Slide service
-func NewSlideService(apiKey string) *SlideService {
+// NewSlideService creates a new Slide service that runs Gemini calls and renders within pool's
+// limits, rendering decks with renderer
+func NewSlideService(apiKey string, pool *Pool, renderer *Renderer) *SlideService {
 	ctx := context.Background()
 	client, err := genai.NewClient(ctx, option.WithAPIKey(apiKey))
 	if err != nil {
-		log.Fatalf("Failed to create Gemini client: %v", err)
+		logging.Fatal("Failed to create Gemini client", "error", err)
 	}
-	model := client.GenerativeModel("gemini-2.0-flash")
+	modelName := "gemini-2.0-flash"
+	model := client.GenerativeModel(modelName)
 	model.SetMaxOutputTokens(4096)
 	return &SlideService{
-		client: client,
-		model: model,
+		client:    client,
+		model:     model,
+		modelName: modelName,
+		pricing:   loadPricing(),
+		pool:      pool,
+		renderer:  renderer,
 	}
 }
 
-// GenerateSlides creates a presentation based on the provided theme, files, and settings
+// Generator returns the model and prompt version decks are generated with, which identify the
+// results the API may reuse from its cache
+func (s *SlideService) Generator() (model, promptVersion string) {
+	return s.modelName, prompts.Version
+}
+
+// GenerateSlides creates a presentation based on the provided theme, files, and settings.
+// Images extracted from PDFs are linked in the HTML output as imageURLPrefix + image ID.
+// metrics is filled in as generation progresses, so it is accurate even when an error is returned,
+// and each stage is reported to the progress tracker.
 func (s *SlideService) GenerateSlides(
-	ctx context.Context, 
-	theme string, 
+	ctx context.Context,
+	theme string,
 	files []models.File,
 	settings models.SlideSettings,
-	statusUpdateFn func(message string) error,
-) ([]byte, []byte, error) {
+	imageURLPrefix string,
+	metrics *models.JobMetrics,
+	progress *ProgressTracker,
+) (*models.SlideResult, error) {
+	metrics.Model = s.modelName
+	ctx, span := telemetry.StartSpan(ctx, "slides.GenerateSlides",
+		attribute.String("slides.theme", theme), attribute.Int("slides.file_count", len(files)))
+	defer span.End()
+
+	// Wait for a Gemini slot, reporting the job's place in the queue while it waits. A full queue
+	// returns ErrBusy straight away so the API can retry the job later.
+	releaseGemini, err := s.pool.gemini.acquire(ctx, func(position int) {
+		message := fmt.Sprintf("Waiting for a free worker (position %d in queue)", position)
+		if err := progress.ReportQueued(models.StageQueued, position, message); err != nil {
+			slog.WarnContext(ctx, "Failed to report queue position", "error", err)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer releaseGemini()
+
 	// Update status to show we're processing the files
-	if err := statusUpdateFn("Analyzing uploaded files"); err != nil {
-		return nil, nil, err
+	if err := progress.Report(models.StageUploading, 0, "Analyzing uploaded files"); err != nil {
+		return nil, err
 	}
 
+	uploadStart := time.Now()
+	uploadCtx, uploadSpan := telemetry.StartSpan(ctx, "gemini.UploadFiles")
 	geminiFiles := make([]*genai.File, 0, len(files))
 	// Process files by creating readers from the stored data when needed
 	// This ensures the file data is available even after the HTTP request finishes
-	for _, file := range files {
+	for i, file := range files {
+		// Report each file so multi-file jobs show movement while uploading
+		if len(files) > 1 {
+			if err := progress.Report(models.StageUploading, i+1, fmt.Sprintf("Analyzing %s", file.Filename)); err != nil {
+				telemetry.EndSpan(uploadSpan, err)
+				return nil, err
+			}
+		}
 		fileReader := io.NopCloser(bytes.NewReader(file.Data))
-		
+
 		// Upload the file to Gemini
-		geminiFile, err := s.client.UploadFile(ctx, "", fileReader, &genai.UploadFileOptions{
+		geminiFile, err := s.client.UploadFile(uploadCtx, "", fileReader, &genai.UploadFileOptions{
 			DisplayName: file.Filename,
-			MIMEType: file.Type,
+			MIMEType:    file.Type,
 		})
 		if err != nil {
-			log.Printf("Failed to upload file to Gemini: %v", err)
-			return nil, nil, err
+			telemetry.GeminiError(telemetry.GeminiUpload, err)
+			telemetry.EndSpan(uploadSpan, err)
+			slog.ErrorContext(ctx, "Failed to upload file to Gemini", "error", err)
+			return nil, err
 		}
 		geminiFiles = append(geminiFiles, geminiFile)
-		log.Printf("Processing file: %s (%s)", file.Filename, file.Type)
+		slog.InfoContext(ctx, "Uploaded file to Gemini", "type", file.Type, "bytes", len(file.Data))
+	}
+	uploadSpan.End()
+	telemetry.ObserveStage(telemetry.StageUpload, uploadStart)
+
+	// Extract embedded images from PDFs so the model can place them on slides
+	if err := progress.Report(models.StageExtracting, 0, "Extracting images from documents"); err != nil {
+		return nil, err
+	}
+	extractCtx, extractSpan := telemetry.StartSpan(ctx, "slides.ExtractImages")
+	images, err := extractPDFImages(extractCtx, files)
+	telemetry.EndSpan(extractSpan, err)
+	if err != nil {
+		// Images are optional, so fall back to a text-only deck
+		slog.WarnContext(ctx, "Failed to extract images", "error", err)
+		images = nil
 	}
 
 	// Update status to show we're generating the prompt
-	if err := statusUpdateFn("Generating content for slides"); err != nil {
-		return nil, nil, err
+	if err := progress.Report(models.StagePrompting, 0, "Generating content for slides"); err != nil {
+		return nil, err
 	}
-	
+
 	// 2. Generate the prompt using the prompt generator
-	prompt, err := prompts.GenerateSlidePrompt(theme, settings)
+	prompt, err := prompts.GenerateSlidePrompt(theme, settings, describeImages(images))
 	if err != nil {
-		log.Printf("Error generating prompt: %v", err)
-		return nil, nil, err
+		slog.ErrorContext(ctx, "Error generating prompt", "error", err)
+		return nil, err
 	}
-	log.Printf("Prompt: %s", prompt)
-	
+	logging.Content(ctx, "Generated prompt", "prompt", prompt)
+
 	// Update status to show we're sending to Gemini
-	if err := statusUpdateFn("Creating presentation with AI"); err != nil {
-		return nil, nil, err
+	if err := progress.Report(models.StageGenerating, 0, "Creating presentation with AI"); err != nil {
+		return nil, err
 	}
-	
+
 	// 3. Send the prompt to Gemini
 	parts := []genai.Part{}
 	for _, file := range geminiFiles {
@@ -98,140 +167,224 @@ func (s *SlideService) GenerateSlides(
 	parts = append(parts, genai.Text(prompt))
 
 	// Ensure input tokens do not exceed 16384
-	countResp, err := s.model.CountTokens(ctx, parts...)
+	countCtx, countSpan := telemetry.StartSpan(ctx, "gemini.CountTokens")
+	countResp, err := s.model.CountTokens(countCtx, parts...)
+	telemetry.EndSpan(countSpan, err)
 	if err != nil {
-		log.Printf("Failed to count tokens: %v", err)
-		return nil, nil, err
+		telemetry.GeminiError(telemetry.GeminiCountTokens, err)
+		slog.ErrorContext(ctx, "Failed to count tokens", "error", err)
+		return nil, err
 	}
 	if countResp.TotalTokens > 16384 {
-		log.Printf("Input tokens exceed 16384: %d", countResp.TotalTokens)
-		return nil, nil, errors.New("documents are too large to process")
+		slog.WarnContext(ctx, "Input tokens exceed 16384", "tokens", countResp.TotalTokens)
+		return nil, errors.New("documents are too large to process")
 	}
+	metrics.CountedTokens = countResp.TotalTokens
 
-	resp, err := s.model.GenerateContent(ctx, parts...)
-	if err != nil {
-		log.Printf("Failed to generate content: %v", err)
-		return nil, nil, err
+	// Stream the response, previewing each slide as soon as the separator after it arrives
+	generationStart := time.Now()
+	previewer := newSlidePreviewer(ctx, theme, settings, images, progress, s.pool.render, s.renderer)
+	generateCtx, generateSpan := telemetry.StartSpan(ctx, "gemini.GenerateContent", attribute.String("gemini.model", s.modelName))
+	stream := s.model.GenerateContentStream(generateCtx, parts...)
+	var streamed strings.Builder
+	var usage *genai.UsageMetadata
+	previewed := 0
+	for {
+		chunk, err := stream.Next()
+		if err == iterator.Done {
+			break
+		}
+		if err != nil {
+			previewer.finish()
+			metrics.GenerationMs = time.Since(generationStart).Milliseconds()
+			telemetry.GeminiError(telemetry.GeminiGenerate, err)
+			telemetry.EndSpan(generateSpan, err)
+			slog.ErrorContext(ctx, "Failed to generate content", "error", err)
+			return nil, err
+		}
+		if chunk.UsageMetadata != nil {
+			usage = chunk.UsageMetadata
+		}
+		if len(chunk.Candidates) == 0 || chunk.Candidates[0].Content == nil {
+			continue
+		}
+		for _, part := range chunk.Candidates[0].Content.Parts {
+			if text, ok := part.(genai.Text); ok {
+				streamed.WriteString(string(text))
+			}
+		}
+
+		frontmatter, slides := completedSlides(streamed.String())
+		for ; previewed < len(slides) && previewed < maxPreviewSlides; previewed++ {
+			previewer.add(previewed+1, frontmatter, slides[previewed])
+		}
+	}
+	previewer.finish()
+	metrics.GenerationMs = time.Since(generationStart).Milliseconds()
+	telemetry.ObserveStage(telemetry.StageGeneration, generationStart)
+
+	// Record the billed token counts; fall back to the estimate if the response has none
+	metrics.InputTokens = countResp.TotalTokens
+	if usage != nil {
+		metrics.InputTokens = usage.PromptTokenCount
+		metrics.OutputTokens = usage.CandidatesTokenCount
 	}
+	metrics.EstimatedCostUSD = s.pricing.cost(metrics.InputTokens, metrics.OutputTokens)
+	generateSpan.SetAttributes(
+		attribute.Int("gemini.input_tokens", int(metrics.InputTokens)),
+		attribute.Int("gemini.output_tokens", int(metrics.OutputTokens)),
+		attribute.Int("slides.previewed", previewed),
+	)
+	generateSpan.End()
+	slog.InfoContext(ctx, "Gemini usage", "input_tokens", metrics.InputTokens,
+		"output_tokens", metrics.OutputTokens, "estimated_cost_usd", metrics.EstimatedCostUSD)
+
+	// Generation is done, so let the next job call Gemini while this one renders
+	releaseGemini()
 
-	respText := resp.Candidates[0].Content.Parts[0].(genai.Text)
 	// Extract the markdown from the response between triple backticks
 	// Match any language specifier or none at all
-	respString := string(respText)
-	marpText := extractMarkdownContent(respString)
-	
+	respText := streamed.String()
+	marpText := extractMarkdownContent(respText)
+
 	if marpText == "" {
-		log.Printf("No markdown found in response: %s", respText)
-		return nil, nil, errors.New("failed to generate presentation. Please try again.")
+		slog.ErrorContext(ctx, "No markdown found in response")
+		logging.Content(ctx, "Model response without markdown", "response", respText)
+		return nil, errors.New("failed to generate presentation. Please try again.")
+	}
+
+	logging.Content(ctx, "Generated presentation", "presentation", marpText)
+
+	// Diagrams and the Marp render both drive a browser, so wait for a render slot first
+	releaseRender, err := s.pool.render.acquire(ctx, func(position int) {
+		message := fmt.Sprintf("Waiting to render (position %d in queue)", position)
+		if err := progress.ReportQueued(models.StageRenderingPDF, position, message); err != nil {
+			slog.WarnContext(ctx, "Failed to report queue position", "error", err)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer releaseRender()
+
+	// Pre-render Mermaid and chart blocks to SVG so both the PDF and HTML outputs show them
+	diagramCtx, diagramSpan := telemetry.StartSpan(ctx, "slides.RenderDiagrams")
+	marpText, diagrams := renderDiagrams(diagramCtx, marpText)
+	diagramSpan.End()
+	images = append(images, diagrams...)
+
+	// Enable the math renderer and drop formulas that would fail to render
+	if settings.Math && settings.Audience == "academic" {
+		marpText = prepareMath(ctx, marpText)
 	}
 
-	log.Printf("Generated presentation: %s", marpText)
-	
 	// Update status to show we're finalizing the presentation
-	if err := statusUpdateFn("Finalizing presentation"); err != nil {
-		return nil, nil, err
+	if err := progress.Report(models.StageRenderingPDF, 0, "Finalizing presentation"); err != nil {
+		return nil, err
 	}
 
 	// Create a temporary directory for our files
 	tempDir, err := os.MkdirTemp("", "slideitin-")
 	if err != nil {
-		log.Printf("Failed to create temp directory: %v", err)
-		return nil, nil, err
+		slog.ErrorContext(ctx, "Failed to create temp directory", "error", err)
+		return nil, err
 	}
 	defer os.RemoveAll(tempDir) // Clean up when we're done
-	
-	// Create the markdown file
-	mdFilePath := filepath.Join(tempDir, "presentation.md")
-	err = os.WriteFile(mdFilePath, []byte(marpText), 0644)
-	if err != nil {
-		log.Printf("Failed to write markdown file: %v", err)
-		return nil, nil, err
-	}
-	
-	// Set up PDF output path
-	pdfFilePath := filepath.Join(tempDir, "presentation.pdf")
-	
-	// Run Marp CLI to generate the PDF
-	marpArgs := []string{"@marp-team/marp-cli", mdFilePath}
-	
-	// Add theme parameter if it's in themes directory
-	themePath := filepath.Join("services", "slides", "themes", theme+".css")
-	if _, err := os.Stat(themePath); err == nil {
-		// Theme file exists, add it to the arguments
-		marpArgs = append(marpArgs, "--theme", themePath)
-		log.Printf("Using theme: %s", themePath)
-	} else {
-		marpArgs = append(marpArgs, "--theme", theme)
-		log.Printf("Using built-in theme: %s", theme)
+
+	// Write referenced images next to the markdown so the PDF render can load them locally
+	renderMarkdown, usedImages := resolveImageReferences(marpText, images, func(img models.Image) string {
+		return "images/" + img.ID + imageExtension(img)
+	})
+	if len(usedImages) > 0 {
+		if err := os.MkdirAll(filepath.Join(tempDir, "images"), 0755); err != nil {
+			slog.ErrorContext(ctx, "Failed to create images directory", "error", err)
+			return nil, err
+		}
+		for _, img := range usedImages {
+			imgPath := filepath.Join(tempDir, "images", img.ID+imageExtension(img))
+			if err := os.WriteFile(imgPath, img.Data, 0644); err != nil {
+				slog.ErrorContext(ctx, "Failed to write image file", "error", err)
+				return nil, err
+			}
+		}
+		slog.InfoContext(ctx, "Presentation references extracted images", "images", len(usedImages))
 	}
-	
-	cmd := exec.Command("npx", append(marpArgs, "--output", pdfFilePath, "--pdf")...)
-	var cmdOutput bytes.Buffer
-	var cmdError bytes.Buffer
-	cmd.Stdout = &cmdOutput
-	cmd.Stderr = &cmdError
-	err = cmd.Run()
+
+	// Render the PDF and HTML from a single parse of the deck
+	themeArg := marpTheme(theme)
+	slog.DebugContext(ctx, "Using theme", "theme", themeArg)
+	renderCtx, renderSpan := telemetry.StartSpan(ctx, "marp.Render")
+	rendered, err := s.renderer.render(renderCtx, "rendering the presentation", renderRequest{
+		Markdown: renderMarkdown,
+		Theme:    themeArg,
+		Dir:      tempDir,
+		HTML:     true,
+		PDF:      true,
+	})
+	telemetry.EndSpan(renderSpan, err)
 	if err != nil {
-		log.Printf("Failed to run Marp CLI: %v", err)
-		log.Printf("Marp CLI stderr: %s", cmdError.String())
-		return nil, nil, errors.New("failed to generate PDF. Please try again.")
+		slog.ErrorContext(ctx, "Failed to render presentation", "error", err)
+		return nil, err
 	}
-	
+	metrics.HTMLRenderMs = rendered.HTMLMs
+	metrics.PDFRenderMs = rendered.PDFMs
+	telemetry.ObserveStageDuration(telemetry.StageHTMLRender, time.Duration(rendered.HTMLMs)*time.Millisecond)
+	telemetry.ObserveStageDuration(telemetry.StagePDFRender, time.Duration(rendered.PDFMs)*time.Millisecond)
+	releaseRender()
+
 	// Read the generated PDF
-	pdfBytes, err := os.ReadFile(pdfFilePath)
+	pdfBytes, err := os.ReadFile(rendered.PDFPath)
 	if err != nil {
-		log.Printf("Failed to read generated PDF: %v", err)
-		return nil, nil, err
+		slog.ErrorContext(ctx, "Failed to read generated PDF", "error", err)
+		return nil, err
 	}
-	
-	log.Printf("Successfully generated PDF (%d bytes)", len(pdfBytes))
-
-	// Create the HTML file
-	htmlFilePath := filepath.Join(tempDir, "presentation.html")
-
-	// Run Marp CLI to generate the HTML
-	cmd = exec.Command("npx", append(marpArgs, "--output", htmlFilePath, "--html")...)
-	cmdOutput.Reset()
-	cmdError.Reset()
-	cmd.Stdout = &cmdOutput
-	cmd.Stderr = &cmdError
-	err = cmd.Run()
-	if err != nil {
-		log.Printf("Failed to run Marp CLI: %v", err)
-		log.Printf("Marp CLI stderr: %s", cmdError.String())
-		return nil, nil, errors.New("failed to generate HTML. Please try again.")
+
+	slog.InfoContext(ctx, "Generated PDF", "bytes", len(pdfBytes))
+
+	// The HTML is served by the API, so point its images at the stored copies instead
+	htmlBytes := []byte(rendered.HTML)
+	for _, img := range usedImages {
+		htmlBytes = bytes.ReplaceAll(htmlBytes, []byte("images/"+img.ID+imageExtension(img)), []byte(imageURLPrefix+img.ID))
 	}
 
-	// Read the generated HTML
-	htmlBytes, err := os.ReadFile(htmlFilePath)
-	if err != nil {
-		log.Printf("Failed to read generated HTML: %v", err)
-		return nil, nil, err
+	slog.InfoContext(ctx, "Generated HTML", "bytes", len(htmlBytes))
+
+	// Delete the files from Gemini using a background context
+	deleteCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, file := range geminiFiles {
+		if err := s.client.DeleteFile(deleteCtx, file.Name); err != nil {
+			telemetry.GeminiError(telemetry.GeminiDelete, err)
+			slog.WarnContext(ctx, "Failed to delete file from Gemini", "error", err)
+			// Continue with other deletions, don't fail the overall process
+		}
 	}
 
-	log.Printf("Successfully generated HTML (%d bytes)", len(htmlBytes))
-	
-// Delete the files from Gemini using a background context
-deleteCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
-defer cancel()
-for _, file := range geminiFiles {
-if err := s.client.DeleteFile(deleteCtx, file.Name); err != nil {
-log.Printf("Failed to delete file from Gemini: %v", err)
-// Continue with other deletions, don't fail the overall process
-}
+	// Return the PDF and HTML bytes along with the images they reference
+	return &models.SlideResult{
+		PDFData:  pdfBytes,
+		HTMLData: htmlBytes,
+		Images:   usedImages,
+	}, nil
 }
-	
-	// Return the PDF and HTML bytes
-	return pdfBytes, htmlBytes, nil
+
+// marpTheme returns the path of the theme's CSS file if it's in the themes directory, otherwise
+// the name of a built-in theme
+func marpTheme(theme string) string {
+	themePath := filepath.Join("services", "slides", "themes", theme+".css")
+	if _, err := os.Stat(themePath); err == nil {
+		return themePath
+	}
+	return theme
 }
 
 // extractMarkdownContent extracts markdown content between triple backticks
 func extractMarkdownContent(text string) string {
 	lines := regexp.MustCompile(`\r?\n`).Split(text, -1)
-	
+
 	firstBacktickLine := -1
 	lastBacktickLine := -1
-	
+
 	// Find first and last lines with triple backticks
 	for i, line := range lines {
 		if strings.HasPrefix(line, "```") {
@@ -241,16 +394,16 @@ func extractMarkdownContent(text string) string {
 			lastBacktickLine = i
 		}
 	}
-	
+
 	// If we found backticks, extract the content
 	if firstBacktickLine != -1 && lastBacktickLine != -1 && lastBacktickLine > firstBacktickLine {
 		// Extract content between the backtick lines, excluding the lines with backticks themselves
 		// firstBacktickLine+1 skips the opening backtick line
 		// lastBacktickLine as the end index (exclusive in Go slices) excludes the closing backtick line
-		content := lines[firstBacktickLine+1:lastBacktickLine]
+		content := lines[firstBacktickLine+1 : lastBacktickLine]
 		return strings.Join(content, "\n")
 	}
-	
+
 	// If no backticks found, return the entire text
 	return text
 }
@@ -0,0 +1,189 @@
+package slides
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Subprocess defaults
+const (
+	defaultSubprocessTimeout    = 60 * time.Second
+	defaultSubprocessMemoryMB   = 2048
+	defaultSubprocessCPUSeconds = 120
+	// How long a subprocess gets to exit after being killed before its output is abandoned
+	subprocessWaitDelay = 5 * time.Second
+	// Longest stderr excerpt included in an error
+	maxErrorDetail = 300
+)
+
+// subprocessLimits apply to every subprocess started by the service. They're set once at startup
+// by SetupSubprocesses.
+var subprocessLimits = struct {
+	timeout    time.Duration
+	memoryMB   int // 0 means unlimited
+	cpuSeconds int // 0 means unlimited
+}{defaultSubprocessTimeout, defaultSubprocessMemoryMB, defaultSubprocessCPUSeconds}
+
+// Kinds of render failures, so job failures say whether to retry or change the input
+var (
+	ErrRenderTimeout   = errors.New("render timed out")
+	ErrRenderCrashed   = errors.New("renderer crashed")
+	ErrInvalidMarkdown = errors.New("invalid markdown")
+)
+
+// RenderError is a failed render or subprocess, classified by Kind
+type RenderError struct {
+	Op     string // What was being done, e.g. "rendering the presentation"
+	Kind   error  // ErrRenderTimeout, ErrRenderCrashed or ErrInvalidMarkdown
+	Detail string
+}
+
+// Error describes the failure in a form that can be shown to users
+func (e *RenderError) Error() string {
+	var message string
+	switch e.Kind {
+	case ErrRenderTimeout:
+		message = e.Op + " timed out"
+	case ErrRenderCrashed:
+		message = e.Op + " crashed, please try again"
+	case ErrInvalidMarkdown:
+		message = e.Op + " failed because the slides contain invalid markdown"
+	default:
+		message = e.Op + " failed"
+	}
+	if e.Detail != "" {
+		message += ": " + e.Detail
+	}
+	return message
+}
+
+// Unwrap returns the kind of failure so callers can use errors.Is
+func (e *RenderError) Unwrap() error {
+	return e.Kind
+}
+
+// SetupSubprocesses reads the limits applied to subprocesses from SUBPROCESS_TIMEOUT,
+// SUBPROCESS_MEMORY_LIMIT_MB and SUBPROCESS_CPU_LIMIT_SECONDS. A limit of 0 disables it.
+func SetupSubprocesses() error {
+	if value := os.Getenv("SUBPROCESS_TIMEOUT"); value != "" {
+		timeout, err := time.ParseDuration(value)
+		if err != nil || timeout <= 0 {
+			return fmt.Errorf("invalid SUBPROCESS_TIMEOUT: %q", value)
+		}
+		subprocessLimits.timeout = timeout
+	}
+	for _, limit := range []struct {
+		name  string
+		value *int
+	}{
+		{"SUBPROCESS_MEMORY_LIMIT_MB", &subprocessLimits.memoryMB},
+		{"SUBPROCESS_CPU_LIMIT_SECONDS", &subprocessLimits.cpuSeconds},
+	} {
+		if value := os.Getenv(limit.name); value != "" {
+			parsed, err := strconv.Atoi(value)
+			if err != nil || parsed < 0 {
+				return fmt.Errorf("invalid %s: %q", limit.name, value)
+			}
+			*limit.value = parsed
+		}
+	}
+	return nil
+}
+
+// command builds a subprocess that runs in its own process group, so the browsers it starts are
+// killed along with it when ctx is done. The memory limit always applies to each process on its
+// own; the CPU limit only applies to short-lived commands, as it counts CPU time over the process's
+// whole life. The render server's limits across its process group are enforced by its watchdog.
+func command(ctx context.Context, limitCPU bool, name string, args ...string) *exec.Cmd {
+	// Limits are set by a shell before exec, so every process the command starts inherits them
+	var limits []string
+	if subprocessLimits.memoryMB > 0 {
+		limits = append(limits, "ulimit -d "+strconv.Itoa(subprocessLimits.memoryMB*1024))
+	}
+	if limitCPU && subprocessLimits.cpuSeconds > 0 {
+		limits = append(limits, "ulimit -t "+strconv.Itoa(subprocessLimits.cpuSeconds))
+	}
+
+	var cmd *exec.Cmd
+	if len(limits) > 0 {
+		script := strings.Join(limits, " && ") + ` && exec "$0" "$@"`
+		cmd = exec.CommandContext(ctx, "/bin/sh", append([]string{"-c", script, name}, args...)...)
+	} else {
+		cmd = exec.CommandContext(ctx, name, args...)
+	}
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Cancel = func() error {
+		return killProcessGroup(cmd.Process)
+	}
+	cmd.WaitDelay = subprocessWaitDelay
+	return cmd
+}
+
+// killProcessGroup kills a process started by command and everything it started, including
+// children that moved to a process group of their own, such as the browser mmdc launches
+func killProcessGroup(process *os.Process) error {
+	killProcessTree(process.Pid)
+	return nil
+}
+
+// runCommand runs a short-lived subprocess under the subprocess limits with a deadline derived
+// from ctx. Failures are returned as a RenderError when they can be classified; a non-zero exit
+// is classified as exitKind if it's set.
+func runCommand(ctx context.Context, op string, exitKind error, name string, args ...string) error {
+	ctx, cancel := context.WithTimeout(ctx, subprocessLimits.timeout)
+	defer cancel()
+
+	cmd := command(ctx, true, name, args...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	return classifyExit(ctx, op, exitKind, cmd.Run(), stderr.String())
+}
+
+// classifyExit turns the result of running a subprocess into a RenderError
+func classifyExit(ctx context.Context, op string, exitKind error, err error, stderr string) error {
+	if err == nil {
+		return nil
+	}
+	switch {
+	case errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return &RenderError{Op: op, Kind: ErrRenderTimeout, Detail: "after " + subprocessLimits.timeout.String()}
+	case ctx.Err() != nil:
+		// The job was canceled, which isn't the subprocess's fault
+		return fmt.Errorf("%s: %w", op, ctx.Err())
+	}
+
+	detail := errorDetail(stderr)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		// Killed by a signal, e.g. for going over its memory or CPU limit
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return &RenderError{Op: op, Kind: ErrRenderCrashed, Detail: "killed by " + status.Signal().String()}
+		}
+		if exitKind != nil {
+			return &RenderError{Op: op, Kind: exitKind, Detail: detail}
+		}
+	}
+	if detail != "" {
+		return fmt.Errorf("%s failed: %v: %s", op, err, detail)
+	}
+	return fmt.Errorf("%s failed: %v", op, err)
+}
+
+// errorDetail returns the last line of a subprocess's stderr, which is usually the error itself,
+// shortened to keep job messages readable
+func errorDetail(stderr string) string {
+	lines := strings.Split(strings.TrimSpace(stderr), "\n")
+	detail := strings.TrimSpace(lines[len(lines)-1])
+	if len(detail) > maxErrorDetail {
+		detail = detail[:maxErrorDetail] + "..."
+	}
+	return detail
+}
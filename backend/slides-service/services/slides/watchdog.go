@@ -0,0 +1,221 @@
+package slides
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Watchdog defaults
+const (
+	rendererWatchInterval = time.Second
+	// Linux reports CPU times in /proc in clock ticks, which are 1/100s on every common platform
+	clockTicksPerSecond = 100
+)
+
+// groupUsage is the combined resource usage of a set of processes
+type groupUsage struct {
+	rssBytes   int64
+	cpuSeconds float64
+}
+
+// process is a process read from /proc
+type process struct {
+	pid, ppid, pgid int
+	zombie          bool
+	cpuSeconds      float64 // Including the exited children it has waited for
+	rssBytes        int64
+}
+
+// readProcesses reads every process from /proc
+func readProcesses() ([]process, error) {
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+	pageSize := int64(os.Getpagesize())
+	processes := make([]process, 0, len(entries))
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+		// Processes may exit while they're being read, so unreadable ones are skipped
+		data, err := os.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// The command name may contain spaces, so fields are counted from after it
+		stat := string(data)
+		fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+		if len(fields) < 22 {
+			continue
+		}
+		var ticks int64
+		for _, field := range fields[11:15] { // utime, stime, cutime and cstime
+			value, _ := strconv.ParseInt(field, 10, 64)
+			ticks += value
+		}
+		ppid, _ := strconv.Atoi(fields[1])
+		pgid, _ := strconv.Atoi(fields[2])
+		rssPages, _ := strconv.ParseInt(fields[21], 10, 64)
+		processes = append(processes, process{
+			pid:        pid,
+			ppid:       ppid,
+			pgid:       pgid,
+			zombie:     fields[0] == "Z",
+			cpuSeconds: float64(ticks) / clockTicksPerSecond,
+			rssBytes:   rssPages * pageSize,
+		})
+	}
+	return processes, nil
+}
+
+// processTree returns the processes in group pgid along with every descendant of its leader, so
+// children that moved to a process group of their own, like a detached browser, are included
+func processTree(pgid int) ([]process, error) {
+	processes, err := readProcesses()
+	if err != nil {
+		return nil, err
+	}
+	children := make(map[int][]process)
+	for _, p := range processes {
+		children[p.ppid] = append(children[p.ppid], p)
+	}
+
+	seen := make(map[int]bool)
+	tree := make([]process, 0)
+	add := func(p process) {
+		if !seen[p.pid] {
+			seen[p.pid] = true
+			tree = append(tree, p)
+		}
+	}
+	for _, p := range processes {
+		if p.pgid == pgid {
+			add(p)
+		}
+	}
+	for pending := []int{pgid}; len(pending) > 0; pending = pending[1:] {
+		for _, child := range children[pending[0]] {
+			if !seen[child.pid] {
+				add(child)
+				pending = append(pending, child.pid)
+			}
+		}
+	}
+	return tree, nil
+}
+
+// processTreeUsage adds up the resident memory and CPU time of the processes in processTree(pgid)
+func processTreeUsage(pgid int) (groupUsage, error) {
+	var usage groupUsage
+	tree, err := processTree(pgid)
+	if err != nil {
+		return usage, err
+	}
+	for _, p := range tree {
+		usage.cpuSeconds += p.cpuSeconds
+		usage.rssBytes += p.rssBytes
+	}
+	return usage, nil
+}
+
+// killProcessTree kills process group pgid and the groups of every process in processTree(pgid),
+// and returns the groups it killed
+func killProcessTree(pgid int) []int {
+	groups := []int{pgid}
+	if tree, err := processTree(pgid); err == nil {
+		for _, p := range tree {
+			if !slices.Contains(groups, p.pgid) {
+				groups = append(groups, p.pgid)
+			}
+		}
+	}
+	for _, group := range groups {
+		syscall.Kill(-group, syscall.SIGKILL)
+	}
+	return groups
+}
+
+// survivors returns the live processes left in any of groups, waiting up to timeout for killed
+// processes to exit. Zombies are left out, as they've already released their memory.
+func survivors(groups []int, timeout time.Duration) []int {
+	deadline := time.Now().Add(timeout)
+	for {
+		var pids []int
+		processes, err := readProcesses()
+		if err != nil {
+			return nil
+		}
+		for _, p := range processes {
+			if !p.zombie && slices.Contains(groups, p.pgid) {
+				pids = append(pids, p.pid)
+			}
+		}
+		if len(pids) == 0 || time.Now().After(deadline) {
+			return pids
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// watch restarts the render server in process group pgid when it goes over its budget, until stop
+// is closed. The server and everything it started, including Chromium, together may use SUBPROCESS_MEMORY_LIMIT_MB of memory, and
+// SUBPROCESS_CPU_LIMIT_SECONDS of CPU time for each render started while it's busy. CPU time spent
+// while no render is running, e.g. starting Chromium, isn't counted.
+func (r *Renderer) watch(pgid int, stop <-chan struct{}) {
+	memoryLimit := int64(subprocessLimits.memoryMB) << 20
+	cpuLimit := float64(subprocessLimits.cpuSeconds)
+	if memoryLimit == 0 && cpuLimit == 0 {
+		return
+	}
+
+	// Renders are only counted from when the server is ready, so its startup counts as idle
+	usage, err := processTreeUsage(pgid)
+	if err != nil {
+		slog.Warn("Failed to read renderer resource usage, not enforcing its limits", "error", err)
+		return
+	}
+	baselineCPU, baselineStarted := usage.cpuSeconds, r.started.Load()
+
+	ticker := time.NewTicker(rendererWatchInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		usage, err := processTreeUsage(pgid)
+		if err != nil {
+			slog.Warn("Failed to read renderer resource usage, not enforcing its limits", "error", err)
+			return
+		}
+
+		var exceeded string
+		active, started := r.active.Load(), r.started.Load()
+		switch {
+		case memoryLimit > 0 && usage.rssBytes > memoryLimit:
+			exceeded = fmt.Sprintf("using %d MB of memory, over the limit of %d MB", usage.rssBytes>>20, subprocessLimits.memoryMB)
+		case active == 0:
+			baselineCPU, baselineStarted = usage.cpuSeconds, started
+		case cpuLimit > 0 && usage.cpuSeconds-baselineCPU > cpuLimit*float64(started-baselineStarted):
+			exceeded = fmt.Sprintf("used %.0fs of CPU time for %d renders, over the limit of %ds each",
+				usage.cpuSeconds-baselineCPU, started-baselineStarted, subprocessLimits.cpuSeconds)
+		}
+		if exceeded != "" {
+			slog.Warn("Marp renderer went over its resource limits, restarting it", "reason", exceeded)
+			r.overLimit.Store(true)
+			r.restart()
+			return
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package slides
+
+import (
+	"os/exec"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestKillProcessTreeLeavesNoSurvivors starts a process in its own group with one child in the
+// same group and one in a group of its own, like a detached browser, and checks that killing the
+// tree leaves neither behind
+func TestKillProcessTreeLeavesNoSurvivors(t *testing.T) {
+	if _, err := exec.LookPath("setsid"); err != nil {
+		t.Skip("setsid is not available")
+	}
+
+	cmd := exec.Command("/bin/sh", "-c", "setsid sleep 60 & sleep 60 & wait")
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start process tree: %v", err)
+	}
+	pgid := cmd.Process.Pid
+	exited := make(chan error, 1)
+	go func() { exited <- cmd.Wait() }()
+
+	// Wait for the shell and both children
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		tree, err := processTree(pgid)
+		if err != nil {
+			t.Fatalf("failed to read process tree: %v", err)
+		}
+		if len(tree) >= 3 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 3 processes in the tree, got %d", len(tree))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	groups := killProcessTree(pgid)
+	if len(groups) < 2 {
+		t.Errorf("expected the detached child's group to be killed too, killed %v", groups)
+	}
+	<-exited
+	if pids := survivors(groups, rendererKillTimeout); len(pids) > 0 {
+		t.Errorf("processes survived being killed: %v", pids)
+	}
+}
@@ -0,0 +1,186 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/generative-ai-go/genai"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/option"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Stages timed by StageDuration
+const (
+	StageUpload      = "upload"
+	StageGeneration  = "generation"
+	StagePDFRender   = "pdf_render"
+	StageHTMLRender  = "html_render"
+	StageStoreResult = "store_result"
+)
+
+// Gemini operations counted by GeminiErrors
+const (
+	GeminiUpload      = "upload"
+	GeminiCountTokens = "count_tokens"
+	GeminiGenerate    = "generate"
+	GeminiDelete      = "delete"
+)
+
+// stageDurationBuckets covers stages from well under a second up to a long generation
+var stageDurationBuckets = []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 60, 120}
+
+var (
+	// JobsTotal counts processed jobs by outcome
+	JobsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "slideitin_generation_jobs_total",
+		Help: "Jobs processed by the slides-service, by status (completed, failed, or refused because the queue was full).",
+	}, []string{"status"})
+
+	// JobsInProgress is the number of jobs the slides-service is working on
+	JobsInProgress = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "slideitin_generation_jobs_in_progress",
+		Help: "Jobs currently being processed by the slides-service.",
+	})
+
+	// PoolRunning is the number of busy slots in each worker pool
+	PoolRunning = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "slideitin_pool_running",
+		Help: "Busy slots in each worker pool (gemini or render).",
+	}, []string{"pool"})
+
+	// PoolWaiting is the number of jobs waiting for a slot in each worker pool
+	PoolWaiting = promauto.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "slideitin_pool_waiting",
+		Help: "Jobs waiting for a slot in each worker pool (gemini or render).",
+	}, []string{"pool"})
+
+	// StageDuration observes how long each stage of a job takes
+	StageDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "slideitin_stage_duration_seconds",
+		Help:    "Duration of each job stage: upload to Gemini, generation, Marp PDF and HTML renders, storing the result.",
+		Buckets: stageDurationBuckets,
+	}, []string{"stage"})
+
+	// GeminiErrors counts failed Gemini API calls by operation and error code
+	GeminiErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "slideitin_gemini_errors_total",
+		Help: "Failed Gemini API calls by operation and error code.",
+	}, []string{"operation", "code"})
+
+	// FirestoreDuration observes the latency of Firestore RPCs
+	FirestoreDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "slideitin_firestore_operation_duration_seconds",
+		Help:    "Latency of Firestore operations by RPC method and gRPC status code.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation", "code"})
+)
+
+// MetricsServer serves the metrics in the Prometheus exposition format at /metrics on addr. It is
+// kept off the public router so only scrapers that can reach the port see them.
+func MetricsServer(addr string) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	return &http.Server{Addr: addr, Handler: mux}
+}
+
+// ObserveStage records the duration of a job stage that started at started
+func ObserveStage(stage string, started time.Time) {
+	StageDuration.WithLabelValues(stage).Observe(time.Since(started).Seconds())
+}
+
+// ObserveStageDuration records a stage timed elsewhere, such as by the Marp renderer
+func ObserveStageDuration(stage string, duration time.Duration) {
+	StageDuration.WithLabelValues(stage).Observe(duration.Seconds())
+}
+
+// GeminiError counts a failed Gemini call
+func GeminiError(operation string, err error) {
+	GeminiErrors.WithLabelValues(operation, geminiErrorCode(err)).Inc()
+}
+
+// geminiErrorCode classifies an error returned by the Gemini client
+func geminiErrorCode(err error) string {
+	var blocked *genai.BlockedError
+	if errors.As(err, &blocked) {
+		return "blocked"
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		return strconv.Itoa(apiErr.Code)
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return "deadline_exceeded"
+	}
+	if errors.Is(err, context.Canceled) {
+		return "canceled"
+	}
+	if st, ok := status.FromError(err); ok {
+		return st.Code().String()
+	}
+	return "unknown"
+}
+
+// FirestoreClientOptions instrument the RPCs of a Firestore client created with them
+func FirestoreClientOptions() []option.ClientOption {
+	return []option.ClientOption{
+		option.WithGRPCDialOption(grpc.WithChainUnaryInterceptor(unaryInterceptor)),
+		option.WithGRPCDialOption(grpc.WithChainStreamInterceptor(streamInterceptor)),
+	}
+}
+
+// operationName turns a full gRPC method such as /google.firestore.v1.Firestore/Commit into Commit
+func operationName(method string) string {
+	return method[strings.LastIndex(method, "/")+1:]
+}
+
+// observeFirestore records one Firestore operation
+func observeFirestore(method string, started time.Time, err error) {
+	FirestoreDuration.WithLabelValues(operationName(method), status.Code(err).String()).Observe(time.Since(started).Seconds())
+}
+
+func unaryInterceptor(ctx context.Context, method string, req, reply any, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	started := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	observeFirestore(method, started, err)
+	return err
+}
+
+func streamInterceptor(ctx context.Context, desc *grpc.StreamDesc, cc *grpc.ClientConn, method string, streamer grpc.Streamer, opts ...grpc.CallOption) (grpc.ClientStream, error) {
+	started := time.Now()
+	stream, err := streamer(ctx, desc, cc, method, opts...)
+	if err != nil {
+		observeFirestore(method, started, err)
+		return nil, err
+	}
+	return &timedStream{ClientStream: stream, method: method, started: started}, nil
+}
+
+// timedStream records a streaming operation, e.g. a document get or query, once it has been read to the end
+type timedStream struct {
+	grpc.ClientStream
+	method   string
+	started  time.Time
+	observed bool
+}
+
+func (s *timedStream) RecvMsg(m any) error {
+	err := s.ClientStream.RecvMsg(m)
+	if err != nil && !s.observed {
+		s.observed = true
+		if errors.Is(err, io.EOF) {
+			err = nil
+		}
+		observeFirestore(s.method, s.started, err)
+	}
+	return err
+}